@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Directions and cost sources of adjustment reasons
+const (
+	adjustIncrease = "increase"
+	adjustDecrease = "decrease"
+
+	costLast    = "last_cost"
+	costAverage = "average"
+	costManual  = "manual"
+)
+
+type AdjustmentReasonJSON struct {
+	ReasonCode  string `json:"reasonCode"`
+	Description string `json:"description"`
+	Direction   string `json:"direction"`
+	CostSource  string `json:"costSource"`
+}
+
+type AdjustmentReasonDB struct {
+	ReasonCode  string `field:"reason_code"`
+	Description string `field:"description"`
+	Direction   string `field:"direction"`
+	CostSource  string `field:"cost_source"`
+}
+
+// Stock found without a row is adjusted by stock ID and location
+type AdjustmentJSON struct {
+	MaterialID    string   `json:"materialId"`
+	StockID       string   `json:"stockId"`
+	LocationID    string   `json:"locationId"`
+	LotNumber     string   `json:"lotNumber"`
+	Qty           string   `json:"quantity"`
+	ReasonCode    string   `json:"reasonCode"`
+	Cost          string   `json:"cost"`
+	Notes         string   `json:"notes"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+func setAdjustmentReason(reason AdjustmentReasonJSON, db *sql.DB) error {
+	if reason.ReasonCode == "" {
+		return errors.New("Reason code is required")
+	}
+	if reason.Direction != adjustIncrease && reason.Direction != adjustDecrease {
+		return errors.New("Direction must be either " + adjustIncrease + " or " + adjustDecrease)
+	}
+	if reason.CostSource == "" {
+		reason.CostSource = costLast
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO adjustment_reasons (reason_code, description, direction, cost_source)
+		VALUES ($1,$2,$3,$4)
+		ON CONFLICT (reason_code) DO UPDATE
+			SET description = $2, direction = $3, cost_source = $4;`,
+		reason.ReasonCode, reason.Description, reason.Direction, reason.CostSource)
+	return err
+}
+
+func fetchAdjustmentReasons(db *sql.DB) ([]AdjustmentReasonDB, error) {
+	rows, err := db.Query(`
+		SELECT reason_code, COALESCE(description, ''), direction, cost_source
+		FROM adjustment_reasons ORDER BY reason_code;`)
+	if err != nil {
+		log.Println("Error fetchAdjustmentReasons1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	reasons := []AdjustmentReasonDB{}
+	for rows.Next() {
+		var reason AdjustmentReasonDB
+		if err := rows.Scan(
+			&reason.ReasonCode,
+			&reason.Description,
+			&reason.Direction,
+			&reason.CostSource,
+		); err != nil {
+			log.Println("Error fetchAdjustmentReasons2: ", err)
+			return nil, err
+		}
+		reasons = append(reasons, reason)
+	}
+
+	return reasons, rows.Err()
+}
+
+func fetchAdjustmentReason(db dbExecutor, reasonCode string) (AdjustmentReasonDB, error) {
+	var reason AdjustmentReasonDB
+	err := db.QueryRow(`
+		SELECT reason_code, COALESCE(description, ''), direction, cost_source
+		FROM adjustment_reasons WHERE reason_code = $1;`, reasonCode).
+		Scan(&reason.ReasonCode, &reason.Description, &reason.Direction, &reason.CostSource)
+	if err == sql.ErrNoRows {
+		return reason, errors.New("Adjustment reason " + reasonCode + " is not found")
+	}
+
+	return reason, err
+}
+
+func adjustMaterial(adjustment AdjustmentJSON, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Stock in transit is only written off by receiving its transfer short
+	locationId, _ := strconv.Atoi(adjustment.LocationID)
+	if materialId, _ := strconv.Atoi(adjustment.MaterialID); materialId != 0 {
+		material, err := getMaterialById(materialId, tx)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		locationId = material.LocationID
+	}
+	if err := checkNotInTransit(tx, locationId); err != nil {
+		return nil, err
+	}
+
+	trxIds, err := postAdjustment(adjustment, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return trxIds, tx.Commit()
+}
+
+// Writes stock off or adds found stock. The quantity is always positive,
+// the reason tells the direction
+func postAdjustment(adjustment AdjustmentJSON, db dbExecutor) ([]int, error) {
+	quantity, _ := strconv.Atoi(adjustment.Qty)
+	if quantity <= 0 {
+		return nil, errors.New("Quantity must be positive")
+	}
+
+	reason, err := fetchAdjustmentReason(db, adjustment.ReasonCode)
+	if err != nil {
+		return nil, err
+	}
+
+	material, err := adjustedMaterial(db, adjustment, reason.Direction)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWarehouseFrozen(db, material.LocationID); err != nil {
+		return nil, err
+	}
+
+	serialized, err := isSerializedStock(db, material.StockID)
+	if err != nil {
+		return nil, err
+	}
+	if serialized {
+		if err := validateSerials(adjustment.SerialNumbers, quantity); err != nil {
+			return nil, err
+		}
+	}
+
+	trx := &TransactionInfo{
+		materialId: material.MaterialID,
+		stockId:    material.StockID,
+		notes:      adjustment.Notes,
+		updatedAt:  time.Now(),
+		trxType:    trxAdjustment,
+		reasonCode: reason.ReasonCode,
+	}
+
+	if reason.Direction == adjustDecrease {
+		if material.Quantity < quantity {
+			return nil, errors.New(`The adjusting quantity (` + strconv.Itoa(quantity) +
+				`) is more than the actual one (` + strconv.Itoa(material.Quantity) + `)`)
+		}
+		if serialized {
+			err := consumeSerials(db, material.MaterialID, adjustment.SerialNumbers, serialAdjusted, "", adjustment.Notes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		trx.quantity = -quantity
+	} else {
+		cost, err := adjustmentCost(db, reason.CostSource, material, adjustment.Cost)
+		if err != nil {
+			return nil, err
+		}
+		if serialized {
+			err := receiveSerials(db, material.StockID, material.MaterialID, adjustment.SerialNumbers, serialAdjusted, adjustment.Notes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		trx.quantity = quantity
+		trx.cost = cost
+	}
+
+	_, err = db.Exec(`
+		UPDATE materials SET quantity = quantity + $1 WHERE material_id = $2;`,
+		trx.quantity, material.MaterialID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addTranscation(trx, db); err != nil {
+		return nil, err
+	}
+
+	return trx.trxIds, nil
+}
+
+// Found stock may go to a location the stock is not kept in yet
+func adjustedMaterial(db dbExecutor, adjustment AdjustmentJSON, direction string) (MaterialDB, error) {
+	materialId, _ := strconv.Atoi(adjustment.MaterialID)
+	if materialId == 0 && direction == adjustIncrease && adjustment.StockID != "" {
+		locationId, _ := strconv.Atoi(adjustment.LocationID)
+		if locationId == 0 {
+			return MaterialDB{}, errors.New("Location is required for found stock")
+		}
+
+		var templateId int
+		err := db.QueryRow(`
+			SELECT material_id FROM materials WHERE stock_id = $1
+			ORDER BY material_id DESC LIMIT 1;`, adjustment.StockID).Scan(&templateId)
+		if err == sql.ErrNoRows {
+			return MaterialDB{}, errors.New("Stock " + adjustment.StockID + " has never been received")
+		}
+		if err != nil {
+			return MaterialDB{}, err
+		}
+
+		template, err := getMaterialById(templateId, db)
+		if err != nil {
+			return MaterialDB{}, err
+		}
+		template.Status = statusAvailable
+		template.LotNumber = adjustment.LotNumber
+		template.ExpirationDate = ""
+
+		materialId, err = findOrCreateMaterial(db, template, locationId)
+		if err != nil {
+			return MaterialDB{}, err
+		}
+	}
+
+	material, err := getMaterialById(materialId, db)
+	if err == sql.ErrNoRows {
+		return MaterialDB{}, errors.New("Material " + adjustment.MaterialID + " is not found")
+	}
+
+	return material, err
+}
+
+// Unit cost of found stock
+func adjustmentCost(db dbExecutor, costSource string, material MaterialDB, manualCost string) (float64, error) {
+	switch costSource {
+	case costManual:
+		cost, err := strconv.ParseFloat(manualCost, 64)
+		if err != nil || cost < 0 {
+			return 0, errors.New("A valid cost is required for the reason")
+		}
+		return cost, nil
+	case costAverage:
+		var average sql.NullFloat64
+		err := db.QueryRow(`
+			SELECT SUM(remaining_quantity * cost) / NULLIF(SUM(remaining_quantity), 0)
+			FROM transactions_log
+			WHERE stock_id = $1 AND quantity_change > 0 AND layer_id IS NULL
+				AND remaining_quantity > 0;`, material.StockID).Scan(&average)
+		if err != nil {
+			return 0, err
+		}
+		if average.Valid {
+			return average.Float64, nil
+		}
+	}
+
+	var lastCost float64
+	err := db.QueryRow(`
+		SELECT COALESCE(cost, 0) FROM transactions_log
+		WHERE stock_id = $1 AND quantity_change > 0 AND layer_id IS NULL
+		ORDER BY transaction_id DESC LIMIT 1;`, material.StockID).Scan(&lastCost)
+	if err == sql.ErrNoRows {
+		return material.Cost, nil
+	}
+
+	return lastCost, err
+}
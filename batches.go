@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+// Outcome of a single line of a batch
+type BatchLineResult struct {
+	Line           int
+	MaterialID     string
+	TransactionIDs []int
+	Error          string
+	Warning        string `json:",omitempty"`
+}
+
+// Removes several materials in one database transaction.
+// Nothing is posted unless every line succeeds
+func removeMaterialsBatch(db *sql.DB, lines []MaterialToRemoveJSON) ([]BatchLineResult, error) {
+	results := make([]BatchLineResult, len(lines))
+	quantities := make(map[int]int)
+
+	failed := false
+	for i, line := range lines {
+		results[i] = BatchLineResult{Line: i + 1, MaterialID: line.MaterialID, TransactionIDs: []int{}}
+		if err := validateBatchLine(db, line.MaterialID, line.Qty, quantities, true); err != nil {
+			results[i].Error = err.Error()
+			failed = true
+		}
+	}
+	if failed {
+		return results, errors.New("Batch validation failed")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return results, err
+	}
+	defer tx.Rollback()
+
+	for i, line := range lines {
+		trxIds, err := removeMaterial(line, tx)
+		if err != nil {
+			results[i].Error = err.Error()
+			return rolledBack(results), err
+		}
+		results[i].TransactionIDs = trxIds
+	}
+
+	return results, tx.Commit()
+}
+
+// Moves several materials in one database transaction.
+// Nothing is posted unless every line succeeds
+func moveMaterialsBatch(db *sql.DB, lines []MaterialJSON) ([]BatchLineResult, error) {
+	results := make([]BatchLineResult, len(lines))
+	quantities := make(map[int]int)
+
+	failed := false
+	for i, line := range lines {
+		results[i] = BatchLineResult{Line: i + 1, MaterialID: line.MaterialID, TransactionIDs: []int{}}
+
+		err := validateBatchLine(db, line.MaterialID, line.Qty, quantities, false)
+		if err == nil {
+			err = validateBatchLocation(db, line.LocationID)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			failed = true
+		}
+	}
+	if failed {
+		return results, errors.New("Batch validation failed")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return results, err
+	}
+	defer tx.Rollback()
+
+	for i, line := range lines {
+		trxIds, err := moveMaterial(line, tx)
+		if err != nil {
+			results[i].Error = err.Error()
+			return rolledBack(results), err
+		}
+		results[i].TransactionIDs = trxIds
+
+		locationId, _ := strconv.Atoi(line.LocationID)
+		results[i].Warning, err = capacityWarning(tx, locationId)
+		if err != nil {
+			return rolledBack(results), err
+		}
+	}
+
+	return results, tx.Commit()
+}
+
+// Lines taking from the same material are checked against its quantity together
+func validateBatchLine(db *sql.DB, materialIdStr string, qtyStr string, quantities map[int]int, isRemoval bool) error {
+	materialId, _ := strconv.Atoi(materialIdStr)
+	quantity, _ := strconv.Atoi(qtyStr)
+	if quantity <= 0 {
+		return errors.New("Quantity must be positive")
+	}
+
+	currMaterial, err := getMaterialById(materialId, db)
+	if err == sql.ErrNoRows {
+		return errors.New("Material " + materialIdStr + " is not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if isRemoval && currMaterial.Status != statusAvailable {
+		return errors.New(`The material is not available for removal (status: ` + currMaterial.Status + `)`)
+	}
+
+	quantities[materialId] += quantity
+	if quantities[materialId] > currMaterial.Quantity {
+		return errors.New(`The total quantity (` + strconv.Itoa(quantities[materialId]) +
+			`) is more than the actual one (` + strconv.Itoa(currMaterial.Quantity) + `)`)
+	}
+
+	return nil
+}
+
+func validateBatchLocation(db *sql.DB, locationIdStr string) error {
+	var locationId int
+	err := db.QueryRow(`SELECT location_id FROM locations WHERE location_id = $1;`,
+		locationIdStr).Scan(&locationId)
+	if err == sql.ErrNoRows {
+		return errors.New("Location " + locationIdStr + " is not found")
+	}
+
+	return err
+}
+
+// Nothing of a failed batch is posted, so no log entries are reported
+func rolledBack(results []BatchLineResult) []BatchLineResult {
+	for i := range results {
+		results[i].TransactionIDs = []int{}
+	}
+	return results
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Capacity measures of locations and what happens when one is exceeded
+const (
+	capacityUnits   = "units"
+	capacityPallets = "pallets"
+	capacityVolume  = "volume"
+	capacityWeight  = "weight"
+
+	enforceReject = "reject"
+	enforceWarn   = "warn"
+)
+
+type LocationUtilization struct {
+	LocationID          int
+	LocationName        string
+	WarehouseID         int
+	WarehouseName       string
+	CapacityType        string
+	CapacityEnforcement string
+	Capacity            float64
+	Used                float64
+	Percent             float64
+	UnmeasuredStocks    int // stocks without the dimension of the capacity
+}
+
+// Locations of the warehouse are summed per capacity measure
+type WarehouseUtilization struct {
+	WarehouseID   int
+	WarehouseName string
+	CapacityType  string
+	LocationCount int
+	Capacity      float64
+	Used          float64
+	Percent       float64
+}
+
+type UtilizationFilter struct {
+	warehouseId int
+	locationId  int
+}
+
+// SQL expression of a stock quantity in the capacity measure of a location.
+// Pallets are counted whole per stock. Stock without the dimension measures as NULL
+func capacityUsage(capacityType string, quantity string) string {
+	return `CASE ` + capacityType + `
+		WHEN 'units' THEN ` + quantity + `
+		WHEN 'pallets' THEN CEIL(` + quantity + `::DECIMAL / NULLIF(sp.units_per_pallet, 0))
+		WHEN 'volume' THEN ` + quantity + ` * sp.unit_volume
+		WHEN 'weight' THEN ` + quantity + ` * sp.unit_weight
+	END`
+}
+
+func validateCapacity(capacityType string, enforcement string) error {
+	switch capacityType {
+	case capacityUnits, capacityPallets, capacityVolume, capacityWeight:
+	default:
+		return errors.New("Capacity type must be one of " + capacityUnits + ", " + capacityPallets +
+			", " + capacityVolume + " or " + capacityWeight)
+	}
+	if enforcement != enforceReject && enforcement != enforceWarn {
+		return errors.New("Capacity enforcement must be either " + enforceReject + " or " + enforceWarn)
+	}
+	return nil
+}
+
+// Dimension of the stock profile the capacity is measured by
+func capacityDimension(capacityType string) string {
+	switch capacityType {
+	case capacityPallets:
+		return "units per pallet"
+	case capacityVolume:
+		return "unit volume"
+	case capacityWeight:
+		return "unit weight"
+	}
+	return ""
+}
+
+// Usage of the location after the quantity of the stock is put in it,
+// and the number of stocks in it without the dimension of the capacity
+func projectedUsage(db dbExecutor, locationId int, capacityType string, stockId string, quantity int) (float64, int, error) {
+	var used float64
+	var unmeasured int
+	usage := capacityUsage("$4::TEXT", "s.quantity")
+	err := db.QueryRow(`
+		WITH stored AS (
+			SELECT stock_id, quantity FROM materials WHERE location_id = $1 AND quantity > 0
+			UNION ALL
+			SELECT $2::VARCHAR, $3::INT
+		)
+		SELECT COALESCE(SUM(`+usage+`), 0),
+			COUNT(s.stock_id) FILTER (WHERE s.quantity > 0 AND (`+usage+`) IS NULL)
+		FROM (SELECT stock_id, SUM(quantity) AS quantity FROM stored GROUP BY stock_id) s
+		LEFT JOIN stock_profiles sp ON sp.stock_id = s.stock_id;`,
+		locationId, stockId, quantity, capacityType).Scan(&used, &unmeasured)
+
+	return used, unmeasured, err
+}
+
+func isMeasured(db dbExecutor, capacityType string, stockId string) (bool, error) {
+	var measured bool
+	err := db.QueryRow(`
+		SELECT (`+capacityUsage("$1::TEXT", "1")+`) IS NOT NULL
+		FROM (SELECT $2::VARCHAR AS stock_id) s
+		LEFT JOIN stock_profiles sp ON sp.stock_id = s.stock_id;`,
+		capacityType, stockId).Scan(&measured)
+
+	return measured, err
+}
+
+// Rejects the quantity when it does not fit in a location enforcing its capacity.
+// Stock without the dimension of the capacity cannot be measured, so it is rejected too
+func checkCapacity(db dbExecutor, locationId int, stockId string, quantity int) error {
+	var name, capacityType, enforcement string
+	var capacity float64
+	err := db.QueryRow(`
+		SELECT name, COALESCE(capacity, 0), capacity_type, capacity_enforcement
+		FROM locations WHERE location_id = $1;`, locationId).
+		Scan(&name, &capacity, &capacityType, &enforcement)
+	if err == sql.ErrNoRows {
+		return errors.New("Location " + strconv.Itoa(locationId) + " is not found")
+	}
+	if err != nil || capacity <= 0 || enforcement != enforceReject {
+		return err
+	}
+
+	measured, err := isMeasured(db, capacityType, stockId)
+	if err != nil {
+		return err
+	}
+	if !measured {
+		return fmt.Errorf("Location %s measures its capacity in %s. Set the %s of the stock %s first",
+			name, capacityType, capacityDimension(capacityType), stockId)
+	}
+
+	used, _, err := projectedUsage(db, locationId, capacityType, stockId, quantity)
+	if err != nil {
+		return err
+	}
+	if used > capacity {
+		return fmt.Errorf("Location %s is over capacity: %s of %s %s",
+			name, formatMeasure(used), formatMeasure(capacity), capacityType)
+	}
+
+	return nil
+}
+
+// Tells when a location allowed to go over its capacity is over it,
+// or holds stock its capacity cannot measure
+func capacityWarning(db dbExecutor, locationId int) (string, error) {
+	var name, capacityType, enforcement string
+	var capacity float64
+	err := db.QueryRow(`
+		SELECT name, COALESCE(capacity, 0), capacity_type, capacity_enforcement
+		FROM locations WHERE location_id = $1;`, locationId).
+		Scan(&name, &capacity, &capacityType, &enforcement)
+	if err != nil || capacity <= 0 || enforcement != enforceWarn {
+		return "", err
+	}
+
+	used, unmeasured, err := projectedUsage(db, locationId, capacityType, "", 0)
+	if err != nil {
+		return "", err
+	}
+
+	var warnings []string
+	if used > capacity {
+		warnings = append(warnings, fmt.Sprintf("Location %s is over capacity: %s of %s %s",
+			name, formatMeasure(used), formatMeasure(capacity), capacityType))
+	}
+	if unmeasured > 0 {
+		warnings = append(warnings, fmt.Sprintf("Location %s holds %d stocks without their %s, "+
+			"which its usage leaves out", name, unmeasured, capacityDimension(capacityType)))
+	}
+	return strings.Join(warnings, ". "), nil
+}
+
+// Locations without a capacity are left out
+func fetchLocationUtilization(db dbExecutor, opts UtilizationFilter) ([]LocationUtilization, error) {
+	usage := capacityUsage("l.capacity_type::TEXT", "s.quantity")
+	rows, err := db.Query(`
+		WITH RECURSIVE `+locationAncestors+`,
+		stored AS (
+			SELECT location_id, stock_id, SUM(quantity) AS quantity FROM materials
+			WHERE quantity > 0
+			GROUP BY location_id, stock_id
+		)
+		SELECT l.location_id, l.name, w.warehouse_id, w.name,
+			l.capacity_type, l.capacity_enforcement, l.capacity,
+			COALESCE(SUM(`+usage+`), 0),
+			COUNT(s.stock_id) FILTER (WHERE (`+usage+`) IS NULL)
+		FROM locations l
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		LEFT JOIN stored s ON s.location_id = l.location_id
+		LEFT JOIN stock_profiles sp ON sp.stock_id = s.stock_id
+		WHERE
+			l.capacity > 0 AND
+			($1 = 0 OR l.warehouse_id = $1) AND
+			($2 = 0 OR l.location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $2))
+		GROUP BY l.location_id, w.warehouse_id
+		ORDER BY w.name, l.pick_sequence, l.name;`,
+		opts.warehouseId, opts.locationId)
+	if err != nil {
+		log.Println("Error fetchLocationUtilization1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	utilization := []LocationUtilization{}
+	for rows.Next() {
+		var u LocationUtilization
+		if err := rows.Scan(
+			&u.LocationID,
+			&u.LocationName,
+			&u.WarehouseID,
+			&u.WarehouseName,
+			&u.CapacityType,
+			&u.CapacityEnforcement,
+			&u.Capacity,
+			&u.Used,
+			&u.UnmeasuredStocks,
+		); err != nil {
+			log.Println("Error fetchLocationUtilization2: ", err)
+			return nil, err
+		}
+		u.Percent = utilizationPercent(u.Used, u.Capacity)
+		utilization = append(utilization, u)
+	}
+
+	return utilization, rows.Err()
+}
+
+func fetchWarehouseUtilization(db dbExecutor, warehouseId int) ([]WarehouseUtilization, error) {
+	locations, err := fetchLocationUtilization(db, UtilizationFilter{warehouseId: warehouseId})
+	if err != nil {
+		return nil, err
+	}
+
+	utilization := []WarehouseUtilization{}
+	index := make(map[string]int)
+	for _, location := range locations {
+		key := strconv.Itoa(location.WarehouseID) + "/" + location.CapacityType
+		i, ok := index[key]
+		if !ok {
+			i = len(utilization)
+			index[key] = i
+			utilization = append(utilization, WarehouseUtilization{
+				WarehouseID:   location.WarehouseID,
+				WarehouseName: location.WarehouseName,
+				CapacityType:  location.CapacityType,
+			})
+		}
+		utilization[i].LocationCount++
+		utilization[i].Capacity += location.Capacity
+		utilization[i].Used += location.Used
+	}
+
+	for i := range utilization {
+		utilization[i].Percent = utilizationPercent(utilization[i].Used, utilization[i].Capacity)
+	}
+
+	return utilization, nil
+}
+
+func utilizationPercent(used float64, capacity float64) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return math.Round(used/capacity*1000) / 10
+}
+
+func formatMeasure(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Warnings of a location stock has just been put in
+func locationWarnings(db dbExecutor, locationIdStr string) []string {
+	locationId, _ := strconv.Atoi(locationIdStr)
+	warning, err := capacityWarning(db, locationId)
+	if err != nil {
+		log.Println("Error capacityWarning: ", err)
+		return nil
+	}
+	if warning == "" {
+		return nil
+	}
+	return []string{warning}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Count task statuses
+const (
+	countOpen     = "open"
+	countCounted  = "counted"
+	countApproved = "approved"
+	countRejected = "rejected"
+)
+
+// Adjustment reasons of count variances
+const (
+	reasonCountGain = "count_gain"
+	reasonCountLoss = "count_loss"
+)
+
+// Tasks are generated for the material rows matching every given filter.
+// A location includes the locations under it
+type CountTaskFilterJSON struct {
+	LocationID  string `json:"locationId"`
+	WarehouseID string `json:"warehouseId"`
+	AbcClass    string `json:"abcClass"`
+	StockID     string `json:"stockId"`
+	IsBlind     bool   `json:"isBlind"`
+}
+
+type CountSubmitJSON struct {
+	CountedQty string `json:"countedQuantity"`
+	CountedBy  string `json:"countedBy"`
+	Notes      string `json:"notes"`
+}
+
+// Serial numbers of the found or missing units
+type CountApproveJSON struct {
+	Notes         string   `json:"notes"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+// System quantity and variance of blind tasks are hidden until the count is approved or rejected
+type CountTaskDB struct {
+	CountTaskID   int       `field:"count_task_id"`
+	MaterialID    int       `field:"material_id"`
+	StockID       string    `field:"stock_id"`
+	WarehouseName string    `field:"warehouse_name"`
+	LocationName  string    `field:"location_name"`
+	LotNumber     string    `field:"lot_number"`
+	IsBlind       bool      `field:"is_blind"`
+	Status        string    `field:"status"`
+	SystemQty     *int      `field:"system_quantity"`
+	CountedQty    *int      `field:"counted_quantity"`
+	VarianceQty   *int      // derived
+	CountedBy     string    `field:"counted_by"`
+	Notes         string    `field:"notes"`
+	CreatedAt     time.Time `field:"created_at"`
+	CountedAt     string    `field:"counted_at"`
+
+	systemQty         int
+	lastTransactionId int // of the material when the count was submitted
+}
+
+func generateCountTasks(filter CountTaskFilterJSON, db *sql.DB) ([]CountTaskDB, error) {
+	locationId, _ := strconv.Atoi(filter.LocationID)
+	warehouseId, _ := strconv.Atoi(filter.WarehouseID)
+	if locationId == 0 && warehouseId == 0 && filter.AbcClass == "" && filter.StockID == "" {
+		return nil, errors.New("Location, warehouse, ABC class or stock ID is required")
+	}
+
+	// Rows with a count in progress are skipped
+	rows, err := db.Query(`
+		WITH RECURSIVE `+locationAncestors+`
+		INSERT INTO count_tasks (material_id, is_blind)
+		SELECT m.material_id, $5
+		FROM materials m
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		LEFT JOIN stock_profiles sp ON sp.stock_id = m.stock_id
+		WHERE
+			l.location_type <> 'in_transit' AND
+			($1 = 0 OR m.location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $1)) AND
+			($2 = 0 OR l.warehouse_id = $2) AND
+			($3 = '' OR sp.abc_class = $3) AND
+			($4 = '' OR m.stock_id = $4) AND
+			NOT EXISTS (
+				SELECT 1 FROM count_tasks ct
+				WHERE ct.material_id = m.material_id AND ct.status IN ('open', 'counted')
+			)
+		ORDER BY l.warehouse_id, l.pick_sequence, l.name
+		RETURNING count_task_id;`,
+		locationId, warehouseId, filter.AbcClass, filter.StockID, filter.IsBlind)
+	if err != nil {
+		log.Println("Error generateCountTasks1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var taskIds []int
+	for rows.Next() {
+		var taskId int
+		if err := rows.Scan(&taskId); err != nil {
+			return nil, err
+		}
+		taskIds = append(taskIds, taskId)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tasks := []CountTaskDB{}
+	for _, taskId := range taskIds {
+		task, err := fetchCountTask(db, taskId)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+func fetchCountTasks(db *sql.DB, status string) ([]CountTaskDB, error) {
+	return queryCountTasks(db, 0, status)
+}
+
+func fetchCountTask(db dbExecutor, taskId int) (CountTaskDB, error) {
+	tasks, err := queryCountTasks(db, taskId, "")
+	if err != nil {
+		return CountTaskDB{}, err
+	}
+	if len(tasks) == 0 {
+		return CountTaskDB{}, errors.New("Count task " + strconv.Itoa(taskId) + " is not found")
+	}
+
+	return tasks[0], nil
+}
+
+func queryCountTasks(db dbExecutor, taskId int, status string) ([]CountTaskDB, error) {
+	rows, err := db.Query(`
+		SELECT ct.count_task_id, ct.material_id, m.stock_id,
+			COALESCE(w.name, ''), COALESCE(l.name, ''), m.lot_number,
+			ct.is_blind, ct.status, COALESCE(ct.system_quantity, m.quantity), ct.counted_quantity,
+			COALESCE(ct.counted_by, ''), COALESCE(ct.notes, ''), ct.created_at,
+			COALESCE(TO_CHAR(ct.counted_at, 'YYYY-MM-DD HH24:MI'), ''),
+			COALESCE(ct.last_transaction_id, 0)
+		FROM count_tasks ct
+		LEFT JOIN materials m ON m.material_id = ct.material_id
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		WHERE
+			($1 = 0 OR ct.count_task_id = $1) AND
+			($2 = '' OR ct.status::TEXT = $2)
+		ORDER BY ct.count_task_id;`, taskId, status)
+	if err != nil {
+		log.Println("Error queryCountTasks1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []CountTaskDB{}
+	for rows.Next() {
+		var task CountTaskDB
+		var countedQty sql.NullInt64
+		if err := rows.Scan(
+			&task.CountTaskID,
+			&task.MaterialID,
+			&task.StockID,
+			&task.WarehouseName,
+			&task.LocationName,
+			&task.LotNumber,
+			&task.IsBlind,
+			&task.Status,
+			&task.systemQty,
+			&countedQty,
+			&task.CountedBy,
+			&task.Notes,
+			&task.CreatedAt,
+			&task.CountedAt,
+			&task.lastTransactionId,
+		); err != nil {
+			log.Println("Error queryCountTasks2: ", err)
+			return nil, err
+		}
+
+		if countedQty.Valid {
+			counted := int(countedQty.Int64)
+			task.CountedQty = &counted
+		}
+		if !task.IsBlind || task.Status == countApproved || task.Status == countRejected {
+			systemQty := task.systemQty
+			task.SystemQty = &systemQty
+			if task.CountedQty != nil {
+				variance := *task.CountedQty - systemQty
+				task.VarianceQty = &variance
+			}
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// The system quantity and the last transaction of the material are taken
+// when the count is submitted. A counted task is recounted only after a
+// supervisor reopens it
+func submitCount(taskId int, count CountSubmitJSON, db *sql.DB) error {
+	countedQty, err := strconv.Atoi(count.CountedQty)
+	if err != nil || countedQty < 0 {
+		return errors.New("Counted quantity must be zero or more")
+	}
+
+	res, err := db.Exec(`
+		UPDATE count_tasks ct
+		SET counted_quantity = $1,
+			system_quantity = m.quantity,
+			last_transaction_id = (SELECT MAX(transaction_id) FROM transactions_log
+				WHERE material_id = ct.material_id),
+			counted_by = $2,
+			notes = $3,
+			counted_at = NOW(),
+			status = 'counted'
+		FROM materials m
+		WHERE m.material_id = ct.material_id
+			AND ct.count_task_id = $4
+			AND ct.status = 'open';`,
+		countedQty, count.CountedBy, count.Notes, taskId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Count task " + strconv.Itoa(taskId) + " is not found or not open. " +
+			"Counted tasks are reopened for a recount")
+	}
+
+	return nil
+}
+
+// Takes the count back so the task is counted again
+func reopenCount(taskId int, db *sql.DB) error {
+	res, err := db.Exec(`
+		UPDATE count_tasks
+		SET counted_quantity = NULL,
+			system_quantity = NULL,
+			last_transaction_id = NULL,
+			counted_by = NULL,
+			counted_at = NULL,
+			status = 'open'
+		WHERE count_task_id = $1 AND status = 'counted';`, taskId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Only counted tasks can be reopened")
+	}
+
+	return nil
+}
+
+// Posts the variance as an adjustment valued by the costing engine.
+// Counts of rows changed since they were submitted are refused
+func approveCount(taskId int, approval CountApproveJSON, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	task, err := fetchCountTask(tx, taskId)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status != countCounted {
+		return nil, errors.New("Only counted tasks can be approved (status: " + task.Status + ")")
+	}
+
+	// Stock posted since the count makes the counted quantity stale
+	var lastTransactionId int
+	err = tx.QueryRow(`
+		SELECT COALESCE(MAX(transaction_id), 0) FROM transactions_log WHERE material_id = $1;`,
+		task.MaterialID).Scan(&lastTransactionId)
+	if err != nil {
+		return nil, err
+	}
+	if lastTransactionId != task.lastTransactionId {
+		return nil, errors.New("The material has been posted to since the count. " +
+			"Reopen the task and recount it before approving")
+	}
+
+	trxIds := []int{}
+	if variance := *task.CountedQty - task.systemQty; variance != 0 {
+		reasonCode := reasonCountGain
+		if variance < 0 {
+			reasonCode = reasonCountLoss
+		}
+
+		notes := approval.Notes
+		if notes == "" {
+			notes = "Cycle count " + strconv.Itoa(taskId)
+		}
+
+		trxIds, err = postAdjustment(AdjustmentJSON{
+			MaterialID:    strconv.Itoa(task.MaterialID),
+			Qty:           strconv.Itoa(max(variance, -variance)),
+			ReasonCode:    reasonCode,
+			Notes:         notes,
+			SerialNumbers: approval.SerialNumbers,
+		}, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := closeCountTask(tx, taskId, countApproved); err != nil {
+		return nil, err
+	}
+
+	return trxIds, tx.Commit()
+}
+
+func rejectCount(taskId int, db *sql.DB) error {
+	task, err := fetchCountTask(db, taskId)
+	if err != nil {
+		return err
+	}
+	if task.Status != countOpen && task.Status != countCounted {
+		return errors.New("The count task is already closed (status: " + task.Status + ")")
+	}
+
+	return closeCountTask(db, taskId, countRejected)
+}
+
+func closeCountTask(db dbExecutor, taskId int, status string) error {
+	_, err := db.Exec(`
+		UPDATE count_tasks SET status = $1, closed_at = NOW() WHERE count_task_id = $2;`,
+		status, taskId)
+	return err
+}
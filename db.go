@@ -40,3 +40,11 @@ func connectToDB() (*sql.DB, error) {
 
 	return db, nil
 }
+
+// Implemented by both *sql.DB and *sql.Tx, so the same functions
+// can run on their own or as a part of a database transaction
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
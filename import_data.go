@@ -22,13 +22,13 @@ func importDataToDB(db *sql.DB) error {
 		return err
 	}
 
-	db.Query(`
-		DELETE FROM transactions_log;
-		DELETE FROM materials;
-		DELETE FROM locations;
-		DELETE FROM customers;
-		DELETE FROM warehouses;
+	// Tables referencing these ones are emptied with them
+	_, err = db.Exec(`
+		TRUNCATE transactions_log, materials, locations, customers, warehouses CASCADE;
 	`)
+	if err != nil {
+		return err
+	}
 
 	for _, record := range records {
 		customerName := record[0]
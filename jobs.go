@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Job statuses are derived from what has been issued to the job
+const (
+	jobOpen       = "open"
+	jobInProgress = "in_progress"
+	jobIssued     = "issued"
+)
+
+type JobJSON struct {
+	JobTicket  string        `json:"jobTicket"`
+	CustomerID string        `json:"customerId"`
+	DueDate    string        `json:"dueDate"`
+	Notes      string        `json:"notes"`
+	Lines      []JobLineJSON `json:"lines"`
+}
+
+type JobLineJSON struct {
+	StockID string `json:"stockId"`
+	Qty     string `json:"quantity"`
+}
+
+// Issue material to a job
+type JobIssueJSON struct {
+	MaterialID    string   `json:"materialId"`
+	Qty           string   `json:"quantity"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+type JobDB struct {
+	JobID        int         `field:"job_id"`
+	JobTicket    string      `field:"job_ticket"`
+	CustomerID   int         `field:"customer_id"`
+	CustomerName string      `field:"customer_name"`
+	DueDate      string      `field:"due_date"`
+	Notes        string      `field:"notes"`
+	CreatedAt    time.Time   `field:"created_at"`
+	Status       string      // derived
+	Lines        []JobLineDB // BOM
+}
+
+type JobLineDB struct {
+	StockID      string `field:"stock_id"`
+	RequiredQty  int    `field:"quantity"`
+	IssuedQty    int    `field:"issued_quantity"`
+	RemainingQty int
+}
+
+type JobAvailability struct {
+	StockID      string
+	RemainingQty int
+	AvailableQty int
+	ShortQty     int
+}
+
+func createJob(job JobJSON, db *sql.DB) (int, error) {
+	if job.JobTicket == "" {
+		return 0, errors.New("Job ticket is required")
+	}
+	if len(job.Lines) == 0 {
+		return 0, errors.New("Job must have at least one material line")
+	}
+
+	for _, line := range job.Lines {
+		qty, _ := strconv.Atoi(line.Qty)
+		if line.StockID == "" || qty <= 0 {
+			return 0, errors.New("Every job line needs a stock ID and a positive quantity")
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var jobId int
+	err = tx.QueryRow(`
+		INSERT INTO jobs (job_ticket, customer_id, due_date, notes)
+		VALUES ($1, NULLIF($2, '')::INT, NULLIF($3, '')::DATE, $4)
+		RETURNING job_id;`,
+		job.JobTicket, job.CustomerID, job.DueDate, job.Notes).Scan(&jobId)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range job.Lines {
+		qty, _ := strconv.Atoi(line.Qty)
+		_, err := tx.Exec(`
+			INSERT INTO job_lines (job_id, stock_id, quantity) VALUES ($1,$2,$3)
+			ON CONFLICT (job_id, stock_id) DO UPDATE
+				SET quantity = job_lines.quantity + $3;`,
+			jobId, line.StockID, qty)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return jobId, tx.Commit()
+}
+
+func fetchJobs(db *sql.DB) ([]JobDB, error) {
+	return queryJobs(db, 0, "")
+}
+
+func fetchJob(db dbExecutor, jobId int) (JobDB, error) {
+	jobs, err := queryJobs(db, jobId, "")
+	if err != nil {
+		return JobDB{}, err
+	}
+	if len(jobs) == 0 {
+		return JobDB{}, errors.New("Job " + strconv.Itoa(jobId) + " is not found")
+	}
+
+	return jobs[0], nil
+}
+
+func fetchJobByTicket(db dbExecutor, jobTicket string) (JobDB, bool, error) {
+	jobs, err := queryJobs(db, 0, jobTicket)
+	if err != nil {
+		return JobDB{}, false, err
+	}
+	if len(jobs) == 0 {
+		return JobDB{}, false, nil
+	}
+
+	return jobs[0], true, nil
+}
+
+func queryJobs(db dbExecutor, jobId int, jobTicket string) ([]JobDB, error) {
+	rows, err := db.Query(`
+		SELECT j.job_id, j.job_ticket, COALESCE(j.customer_id, 0), COALESCE(c.name, ''),
+			COALESCE(TO_CHAR(j.due_date, 'YYYY-MM-DD'), ''), COALESCE(j.notes, ''), j.created_at
+		FROM jobs j
+		LEFT JOIN customers c ON c.customer_id = j.customer_id
+		WHERE
+			($1 = 0 OR j.job_id = $1) AND
+			($2 = '' OR j.job_ticket = $2)
+		ORDER BY j.job_id;`, jobId, jobTicket)
+	if err != nil {
+		log.Println("Error queryJobs1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []JobDB{}
+	for rows.Next() {
+		var job JobDB
+		if err := rows.Scan(
+			&job.JobID,
+			&job.JobTicket,
+			&job.CustomerID,
+			&job.CustomerName,
+			&job.DueDate,
+			&job.Notes,
+			&job.CreatedAt,
+		); err != nil {
+			log.Println("Error queryJobs2: ", err)
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range jobs {
+		lines, err := fetchJobLines(db, jobs[i].JobID)
+		if err != nil {
+			return nil, err
+		}
+		jobs[i].Lines = lines
+		jobs[i].Status = jobStatus(lines)
+	}
+
+	return jobs, nil
+}
+
+// Issued quantity is what was removed from the stock with the job ticket
+// and neither returned nor reversed
+func fetchJobLines(db dbExecutor, jobId int) ([]JobLineDB, error) {
+	rows, err := db.Query(`
+		SELECT jl.stock_id, jl.quantity,
+			COALESCE((
+				SELECT -SUM(tl.quantity_change) FROM transactions_log tl
+				WHERE tl.job_ticket = j.job_ticket
+					AND tl.stock_id = jl.stock_id
+					AND tl.transaction_type IN ('removal', 'return', 'reversal')
+			), 0) AS "issued_quantity"
+		FROM job_lines jl
+		LEFT JOIN jobs j ON j.job_id = jl.job_id
+		WHERE jl.job_id = $1
+		ORDER BY jl.job_line_id;`, jobId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying job lines: %w", err)
+	}
+	defer rows.Close()
+
+	lines := []JobLineDB{}
+	for rows.Next() {
+		var line JobLineDB
+		if err := rows.Scan(&line.StockID, &line.RequiredQty, &line.IssuedQty); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+		line.RemainingQty = max(line.RequiredQty-line.IssuedQty, 0)
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+func jobStatus(lines []JobLineDB) string {
+	issued, remaining := 0, 0
+	for _, line := range lines {
+		issued += line.IssuedQty
+		remaining += line.RemainingQty
+	}
+
+	if issued == 0 {
+		return jobOpen
+	}
+	if remaining > 0 {
+		return jobInProgress
+	}
+	return jobIssued
+}
+
+// Compares what is still to be issued to the job with the available stock
+func checkJobAvailability(db *sql.DB, jobId int) ([]JobAvailability, error) {
+	job, err := fetchJob(db, jobId)
+	if err != nil {
+		return nil, err
+	}
+
+	availability := []JobAvailability{}
+	for _, line := range job.Lines {
+		// Stock reserved for the job itself is available to it
+		stock, err := fetchStockAvailability(db, line.StockID, job.CustomerID, job.JobTicket)
+		if err != nil {
+			return nil, err
+		}
+
+		availability = append(availability, JobAvailability{
+			StockID:      line.StockID,
+			RemainingQty: line.RemainingQty,
+			AvailableQty: stock.AvailableQty,
+			ShortQty:     max(line.RemainingQty-stock.AvailableQty, 0),
+		})
+	}
+
+	return availability, nil
+}
+
+func issueMaterialToJob(jobId int, issue JobIssueJSON, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	job, err := fetchJob(tx, jobId)
+	if err != nil {
+		return err
+	}
+
+	_, err = removeMaterial(MaterialToRemoveJSON{
+		MaterialID:    issue.MaterialID,
+		Qty:           issue.Qty,
+		JobTicket:     job.JobTicket,
+		SerialNumbers: issue.SerialNumbers,
+	}, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Removals with a ticket of a registered job must follow its BOM.
+// Free-text tickets are not checked
+func validateJobIssue(db dbExecutor, jobTicket string, stockId string, quantity int) error {
+	if jobTicket == "" {
+		return nil
+	}
+
+	job, found, err := fetchJobByTicket(db, jobTicket)
+	if err != nil || !found {
+		return err
+	}
+
+	for _, line := range job.Lines {
+		if line.StockID != stockId {
+			continue
+		}
+		if quantity > line.RemainingQty {
+			return errors.New(`The removing quantity (` + strconv.Itoa(quantity) +
+				`) is more than the remaining one of the job ` + jobTicket +
+				` (` + strconv.Itoa(line.RemainingQty) + `)`)
+		}
+		return nil
+	}
+
+	return errors.New("Stock " + stockId + " is not in the bill of materials of the job " + jobTicket)
+}
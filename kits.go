@@ -0,0 +1,599 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+type KitJSON struct {
+	StockID      string             `json:"stockId"`
+	CustomerID   string             `json:"customerId"`
+	MaterialType string             `json:"type"`
+	Description  string             `json:"description"`
+	Owner        string             `json:"owner"`
+	Components   []KitComponentJSON `json:"components"`
+}
+
+// Quantity of the component in one kit
+type KitComponentJSON struct {
+	StockID string `json:"stockId"`
+	Qty     string `json:"quantity"`
+}
+
+// Serialized components are consumed by the given serials,
+// or by the serials of their rows in order when none are given
+type KitAssemblyJSON struct {
+	LocationID    string   `json:"locationId"`
+	Qty           string   `json:"quantity"`
+	Notes         string   `json:"notes"`
+	Override      bool     `json:"override"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+// Serials of the serialized components put back
+type KitDisassemblyJSON struct {
+	MaterialID    string   `json:"materialId"`
+	Qty           string   `json:"quantity"`
+	Notes         string   `json:"notes"`
+	Override      bool     `json:"override"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+type KitDB struct {
+	KitID        int    `field:"kit_id"`
+	StockID      string `field:"stock_id"`
+	CustomerID   int    `field:"customer_id"`
+	CustomerName string `field:"customer_name"`
+	MaterialType string `field:"material_type"`
+	Description  string `field:"description"`
+	Owner        string `field:"owner"`
+	Components   []KitComponentDB
+}
+
+type KitComponentDB struct {
+	StockID string `field:"stock_id"`
+	Qty     int    `field:"quantity"`
+}
+
+// Component entry of an assembly and the quantity of it not restored yet
+type assembledComponent struct {
+	transactionId int
+	materialId    int
+	stockId       string
+	layerId       int
+	quantity      int
+	restorableQty int
+}
+
+func createKit(kit KitJSON, db *sql.DB) (int, error) {
+	if kit.StockID == "" || kit.CustomerID == "" || kit.MaterialType == "" || kit.Owner == "" {
+		return 0, errors.New("Stock ID, customer, type and owner of the kit are required")
+	}
+	if len(kit.Components) == 0 {
+		return 0, errors.New("Kit must have at least one component")
+	}
+	for _, component := range kit.Components {
+		qty, _ := strconv.Atoi(component.Qty)
+		if component.StockID == "" || qty <= 0 {
+			return 0, errors.New("Every kit component needs a stock ID and a positive quantity")
+		}
+		if component.StockID == kit.StockID {
+			return 0, errors.New("Kit cannot be a component of itself")
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var kitId int
+	err = tx.QueryRow(`
+		INSERT INTO kits (stock_id, customer_id, material_type, description, owner)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING kit_id;`,
+		kit.StockID, kit.CustomerID, kit.MaterialType, kit.Description, kit.Owner,
+	).Scan(&kitId)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, component := range kit.Components {
+		qty, _ := strconv.Atoi(component.Qty)
+		_, err := tx.Exec(`
+			INSERT INTO kit_components (kit_id, stock_id, quantity) VALUES ($1,$2,$3)
+			ON CONFLICT (kit_id, stock_id) DO UPDATE
+				SET quantity = kit_components.quantity + $3;`,
+			kitId, component.StockID, qty)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return kitId, tx.Commit()
+}
+
+func fetchKits(db *sql.DB) ([]KitDB, error) {
+	return queryKits(db, 0)
+}
+
+func fetchKit(db dbExecutor, kitId int) (KitDB, error) {
+	kits, err := queryKits(db, kitId)
+	if err != nil {
+		return KitDB{}, err
+	}
+	if len(kits) == 0 {
+		return KitDB{}, errors.New("Kit " + strconv.Itoa(kitId) + " is not found")
+	}
+
+	return kits[0], nil
+}
+
+func queryKits(db dbExecutor, kitId int) ([]KitDB, error) {
+	rows, err := db.Query(`
+		SELECT k.kit_id, k.stock_id, COALESCE(k.customer_id, 0), COALESCE(c.name, ''),
+			k.material_type, COALESCE(k.description, ''), k.owner
+		FROM kits k
+		LEFT JOIN customers c ON c.customer_id = k.customer_id
+		WHERE ($1 = 0 OR k.kit_id = $1)
+		ORDER BY k.kit_id;`, kitId)
+	if err != nil {
+		log.Println("Error queryKits1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	kits := []KitDB{}
+	for rows.Next() {
+		var kit KitDB
+		if err := rows.Scan(
+			&kit.KitID,
+			&kit.StockID,
+			&kit.CustomerID,
+			&kit.CustomerName,
+			&kit.MaterialType,
+			&kit.Description,
+			&kit.Owner,
+		); err != nil {
+			log.Println("Error queryKits2: ", err)
+			return nil, err
+		}
+		kits = append(kits, kit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range kits {
+		components, err := fetchKitComponents(db, kits[i].KitID)
+		if err != nil {
+			return nil, err
+		}
+		kits[i].Components = components
+	}
+
+	return kits, nil
+}
+
+func fetchKitComponents(db dbExecutor, kitId int) ([]KitComponentDB, error) {
+	rows, err := db.Query(`
+		SELECT stock_id, quantity FROM kit_components
+		WHERE kit_id = $1
+		ORDER BY stock_id;`, kitId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying kit components: %w", err)
+	}
+	defer rows.Close()
+
+	components := []KitComponentDB{}
+	for rows.Next() {
+		var component KitComponentDB
+		if err := rows.Scan(&component.StockID, &component.Qty); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+		components = append(components, component)
+	}
+
+	return components, rows.Err()
+}
+
+// Consumes the components of the kit's customer and owner in FIFO order and
+// receives the kits into the location. The unit cost of the kits is the sum
+// of the consumed component costs
+func assembleKit(kitId int, assembly KitAssemblyJSON, db *sql.DB) ([]int, error) {
+	quantity, _ := strconv.Atoi(assembly.Qty)
+	if quantity <= 0 {
+		return nil, errors.New("Quantity must be positive")
+	}
+	locationId, _ := strconv.Atoi(assembly.LocationID)
+	if locationId == 0 {
+		return nil, errors.New("Location is required")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	kit, err := fetchKit(tx, kitId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWarehouseFrozen(tx, locationId); err != nil {
+		return nil, err
+	}
+
+	var componentIds []int
+	usedSerials := make(map[string]bool)
+	for _, component := range kit.Components {
+		required := component.Qty * quantity
+
+		candidates, err := fetchPickCandidates(tx, component.StockID, kit.CustomerID, kit.Owner, "", pickFIFO)
+		if err != nil {
+			return nil, err
+		}
+		serialized, err := isSerializedStock(tx, component.StockID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, candidate := range candidates {
+			if required == 0 {
+				break
+			}
+			if candidate.freeQty <= 0 {
+				continue
+			}
+
+			take := min(candidate.freeQty, required)
+			var serials []string
+			if serialized {
+				serials, err = componentSerials(tx, candidate.MaterialID, assembly.SerialNumbers, take)
+				if err != nil {
+					return nil, err
+				}
+				take = len(serials)
+				if take == 0 {
+					continue
+				}
+				for _, serial := range serials {
+					usedSerials[serial] = true
+				}
+			}
+
+			ids, err := removeMaterialAs(MaterialToRemoveJSON{
+				MaterialID:    strconv.Itoa(candidate.MaterialID),
+				Qty:           strconv.Itoa(take),
+				Override:      assembly.Override,
+				SerialNumbers: serials,
+			}, trxAssembly, tx)
+			if err != nil {
+				return nil, fmt.Errorf("Component %s: %w", component.StockID, err)
+			}
+			componentIds = append(componentIds, ids...)
+			required -= take
+		}
+
+		if required > 0 {
+			return nil, errors.New(`Not enough of the component ` + component.StockID + ` (` +
+				strconv.Itoa(required) + ` short)`)
+		}
+	}
+	for _, serial := range assembly.SerialNumbers {
+		if !usedSerials[serial] {
+			return nil, errors.New("Serial number " + serial + " is not in stock of the kit components")
+		}
+	}
+
+	var totalCost float64
+	for _, transactionId := range componentIds {
+		var cost float64
+		err := tx.QueryRow(`
+			SELECT -quantity_change * COALESCE(cost, 0) FROM transactions_log
+			WHERE transaction_id = $1;`, transactionId).Scan(&cost)
+		if err != nil {
+			return nil, err
+		}
+		totalCost += cost
+	}
+	unitCost := totalCost / float64(quantity)
+
+	kitMaterialId, err := findOrCreateMaterial(tx, MaterialDB{
+		StockID:      kit.StockID,
+		CustomerID:   kit.CustomerID,
+		MaterialType: kit.MaterialType,
+		Description:  kit.Description,
+		Notes:        assembly.Notes,
+		Cost:         unitCost,
+		IsActive:     true,
+		Owner:        kit.Owner,
+		Status:       statusAvailable,
+	}, locationId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE materials SET quantity = quantity + $1 WHERE material_id = $2;`,
+		quantity, kitMaterialId)
+	if err != nil {
+		return nil, err
+	}
+
+	trx := &TransactionInfo{
+		materialId: kitMaterialId,
+		stockId:    kit.StockID,
+		quantity:   quantity,
+		notes:      assembly.Notes,
+		cost:       unitCost,
+		updatedAt:  time.Now(),
+		trxType:    trxAssembly,
+	}
+	if err := addTranscation(trx, tx); err != nil {
+		return nil, err
+	}
+	kitLayerId := trx.trxIds[0]
+
+	// The component entries point to the kit layer they went into.
+	// Their reference stays with the posting they belong to
+	for _, transactionId := range componentIds {
+		_, err := tx.Exec(`
+			UPDATE transactions_log SET assembly_id = $1 WHERE transaction_id = $2;`,
+			kitLayerId, transactionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return append(componentIds, kitLayerId), tx.Commit()
+}
+
+// Serials the component row gives to the assembly, the given ones if there
+// are any and its own in order otherwise
+func componentSerials(db dbExecutor, materialId int, given []string, quantity int) ([]string, error) {
+	inStock, err := materialSerials(db, materialId)
+	if err != nil {
+		return nil, err
+	}
+
+	serials := inStock
+	if len(given) > 0 {
+		requested := make(map[string]bool)
+		for _, serial := range given {
+			requested[serial] = true
+		}
+		serials = []string{}
+		for _, serial := range inStock {
+			if requested[serial] {
+				serials = append(serials, serial)
+			}
+		}
+	}
+
+	return serials[:min(len(serials), quantity)], nil
+}
+
+// Takes the kits out of the material row and puts their components back
+// to the rows and cost layers they were consumed from
+func disassembleKit(kitId int, disassembly KitDisassemblyJSON, db *sql.DB) ([]int, error) {
+	materialId, _ := strconv.Atoi(disassembly.MaterialID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	kit, err := fetchKit(tx, kitId)
+	if err != nil {
+		return nil, err
+	}
+	material, err := getMaterialById(materialId, tx)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Material " + disassembly.MaterialID + " is not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if material.StockID != kit.StockID {
+		return nil, errors.New("Material " + disassembly.MaterialID + " is not the kit " + kit.StockID)
+	}
+
+	kitIds, err := removeMaterialAs(MaterialToRemoveJSON{
+		MaterialID: disassembly.MaterialID,
+		Qty:        disassembly.Qty,
+		Override:   disassembly.Override,
+	}, trxDisassembly, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	trxIds := kitIds
+	restoredSerials := make(map[string]bool)
+	for _, transactionId := range kitIds {
+		entry, err := fetchLoggedTransaction(tx, transactionId)
+		if err != nil {
+			return nil, err
+		}
+
+		assemblyId, err := findAssemblyLayer(tx, entry.layerId)
+		if err != nil {
+			return nil, err
+		}
+
+		ids, err := restoreComponents(tx, assemblyId, -entry.quantity, disassembly, restoredSerials)
+		if err != nil {
+			return nil, err
+		}
+		trxIds = append(trxIds, ids...)
+	}
+
+	for _, serial := range disassembly.SerialNumbers {
+		if !restoredSerials[serial] {
+			return nil, errors.New("Serial number " + serial + " is not a component of the disassembled kits")
+		}
+	}
+
+	return trxIds, tx.Commit()
+}
+
+// Follows moved kits back to the layer they were assembled in
+func findAssemblyLayer(db dbExecutor, layerId int) (int, error) {
+	for {
+		layer, err := fetchLoggedTransaction(db, layerId)
+		if err != nil {
+			return 0, err
+		}
+
+		switch layer.trxType {
+		case trxAssembly:
+			return layer.transactionId, nil
+		case trxMoveIn:
+			moveOut, err := fetchLoggedTransaction(db, layer.referenceId)
+			if err != nil {
+				return 0, err
+			}
+			layerId = moveOut.layerId
+		default:
+			return 0, errors.New("The kits of the cost layer " + strconv.Itoa(layer.transactionId) +
+				" were not assembled here and cannot be disassembled")
+		}
+	}
+}
+
+// Restores the components of the given number of kits of the assembly,
+// the latest consumed first. Serialized components take their serials from
+// the disassembly, the restored ones are marked
+func restoreComponents(db dbExecutor, assemblyId int, kitQty int, disassembly KitDisassemblyJSON,
+	restoredSerials map[string]bool) ([]int, error) {
+	assembly, err := fetchLoggedTransaction(db, assemblyId)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT tl.transaction_id, tl.material_id, tl.stock_id, COALESCE(tl.layer_id, 0),
+			-tl.quantity_change,
+			-tl.quantity_change - COALESCE((
+				SELECT SUM(rs.quantity_change) FROM transactions_log rs
+				WHERE rs.reference_id = tl.transaction_id AND rs.transaction_type = 'disassembly'
+			), 0) AS "restorable_quantity"
+		FROM transactions_log tl
+		WHERE tl.assembly_id = $1
+			AND tl.transaction_type = 'assembly'
+			AND tl.quantity_change < 0
+		ORDER BY tl.transaction_id DESC;`, assemblyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var components []assembledComponent
+	consumed := make(map[string]int)
+	for rows.Next() {
+		var component assembledComponent
+		if err := rows.Scan(
+			&component.transactionId,
+			&component.materialId,
+			&component.stockId,
+			&component.layerId,
+			&component.quantity,
+			&component.restorableQty,
+		); err != nil {
+			return nil, err
+		}
+		components = append(components, component)
+		consumed[component.stockId] += component.quantity
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Per kit quantities are taken from the assembly, not from the current definition
+	required := make(map[string]int)
+	for stockId, qty := range consumed {
+		required[stockId] = qty / assembly.quantity * kitQty
+	}
+
+	var trxIds []int
+	for _, component := range components {
+		restoringQty := min(component.restorableQty, required[component.stockId])
+		if restoringQty <= 0 {
+			continue
+		}
+		if component.layerId == 0 {
+			return nil, errors.New("Component entry " + strconv.Itoa(component.transactionId) +
+				" does not keep its cost layer")
+		}
+
+		ids, err := putBack(db, loggedTransaction{
+			transactionId: component.transactionId,
+			materialId:    component.materialId,
+			stockId:       component.stockId,
+			quantity:      -restoringQty,
+			layerId:       component.layerId,
+		}, trxDisassembly, disassembly.Notes)
+		if err != nil {
+			return nil, err
+		}
+		trxIds = append(trxIds, ids...)
+		required[component.stockId] -= restoringQty
+
+		if err := restoreComponentSerials(db, component, restoringQty, disassembly, restoredSerials); err != nil {
+			return nil, err
+		}
+	}
+
+	for stockId, qty := range required {
+		if qty > 0 {
+			return nil, errors.New(`Only part of the component ` + stockId + ` can be restored (` +
+				strconv.Itoa(qty) + ` short)`)
+		}
+	}
+
+	return trxIds, nil
+}
+
+// Puts the serials consumed from the component row back to it
+func restoreComponentSerials(db dbExecutor, component assembledComponent, quantity int,
+	disassembly KitDisassemblyJSON, restoredSerials map[string]bool) error {
+	serialized, err := isSerializedStock(db, component.stockId)
+	if err != nil || !serialized {
+		return err
+	}
+
+	serials := []string{}
+	for _, serial := range disassembly.SerialNumbers {
+		if len(serials) == quantity {
+			break
+		}
+		if restoredSerials[serial] {
+			continue
+		}
+		materialId, err := findConsumedSerial(db, component.stockId, serial)
+		if err != nil || materialId != component.materialId {
+			continue
+		}
+		serials = append(serials, serial)
+	}
+	if len(serials) < quantity {
+		return errors.New("Serial numbers of " + strconv.Itoa(quantity) + " units of the component " +
+			component.stockId + " are required")
+	}
+
+	if err := receiveSerials(db, component.stockId, component.materialId, serials, serialReversed, disassembly.Notes); err != nil {
+		return err
+	}
+	for _, serial := range serials {
+		restoredSerials[serial] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/go-pdf/fpdf"
+	"github.com/go-pdf/fpdf/contrib/barcode"
+)
+
+// Label outputs and the barcodes printed on them
+const (
+	labelPDF = "pdf"
+	labelZPL = "zpl"
+
+	symbologyCode128 = "code128"
+	symbologyQR      = "qr"
+)
+
+// Prefixes of the codes telling locations and material rows from stock IDs
+const (
+	locationCodePrefix = "LOC-"
+	materialCodePrefix = "MAT-"
+)
+
+// Sheet of 2 x 7 labels of 99.1 x 38.1 mm on A4
+const (
+	sheetColumns = 2
+	sheetRows    = 7
+	sheetLeft    = 4.65
+	sheetTop     = 15.15
+	labelWidth   = 99.1
+	labelHeight  = 38.1
+	labelGap     = 2.5
+)
+
+type label struct {
+	Code  string // encoded in the barcode
+	Title string
+	Lines []string
+}
+
+type LabelFilter struct {
+	warehouseId int
+	locationId  int
+	materialId  int
+	shippingId  int
+	customerId  int
+}
+
+type LabelOptions struct {
+	format    string
+	symbology string
+}
+
+func validateLabelOptions(opts *LabelOptions) error {
+	if opts.format == "" {
+		opts.format = labelPDF
+	}
+	if opts.symbology == "" {
+		opts.symbology = symbologyCode128
+	}
+	if opts.format != labelPDF && opts.format != labelZPL {
+		return errors.New("Label format must be either " + labelPDF + " or " + labelZPL)
+	}
+	if opts.symbology != symbologyCode128 && opts.symbology != symbologyQR {
+		return errors.New("Barcode must be either " + symbologyCode128 + " or " + symbologyQR)
+	}
+	return nil
+}
+
+func locationCode(locationId int) string {
+	return locationCodePrefix + strconv.Itoa(locationId)
+}
+
+func materialCode(materialId int) string {
+	return materialCodePrefix + strconv.Itoa(materialId)
+}
+
+// Labels of the locations of a warehouse or of a location with the ones under it
+func fetchLocationLabels(db *sql.DB, opts LabelFilter) ([]label, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE `+locationAncestors+`
+		SELECT l.location_id, l.name, COALESCE(w.name, ''), l.location_type, COALESCE(l.zone, '')
+		FROM locations l
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		WHERE
+			l.warehouse_id IS NOT NULL AND
+			($1 = 0 OR l.warehouse_id = $1) AND
+			($2 = 0 OR l.location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $2))
+		ORDER BY w.name, l.pick_sequence, l.name;`,
+		opts.warehouseId, opts.locationId)
+	if err != nil {
+		log.Println("Error fetchLocationLabels1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []label{}
+	for rows.Next() {
+		var locationId int
+		var name, warehouseName, locationType, zone string
+		if err := rows.Scan(&locationId, &name, &warehouseName, &locationType, &zone); err != nil {
+			log.Println("Error fetchLocationLabels2: ", err)
+			return nil, err
+		}
+
+		lines := []string{warehouseName}
+		if zone != "" {
+			lines = append(lines, "Zone "+zone)
+		}
+		if locationType != locationStorage {
+			lines = append(lines, strings.ReplaceAll(locationType, "_", " "))
+		}
+		labels = append(labels, label{Code: locationCode(locationId), Title: name, Lines: lines})
+	}
+
+	return labels, rows.Err()
+}
+
+// Labels of the material rows holding stock in a warehouse or a location
+func fetchMaterialLabels(db *sql.DB, opts LabelFilter) ([]label, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE `+locationAncestors+`
+		SELECT m.material_id, m.stock_id, COALESCE(m.description, ''), m.lot_number,
+			COALESCE(TO_CHAR(m.expiration_date, 'YYYY-MM-DD'), ''),
+			COALESCE(c.name, ''), l.name
+		FROM materials m
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		LEFT JOIN customers c ON c.customer_id = m.customer_id
+		WHERE
+			($1 = 0 OR m.material_id = $1) AND
+			($1 <> 0 OR m.quantity > 0) AND
+			($2 = 0 OR l.warehouse_id = $2) AND
+			($3 = 0 OR m.location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $3))
+		ORDER BY l.pick_sequence, l.name, m.stock_id;`,
+		opts.materialId, opts.warehouseId, opts.locationId)
+	if err != nil {
+		log.Println("Error fetchMaterialLabels1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []label{}
+	for rows.Next() {
+		var materialId int
+		var stockId, description, lotNumber, expirationDate, customerName, locationName string
+		if err := rows.Scan(&materialId, &stockId, &description, &lotNumber,
+			&expirationDate, &customerName, &locationName); err != nil {
+			log.Println("Error fetchMaterialLabels2: ", err)
+			return nil, err
+		}
+
+		labels = append(labels, label{
+			Code:  materialCode(materialId),
+			Title: stockId,
+			Lines: []string{description, lotLine(lotNumber, expirationDate), customerName + " / " + locationName},
+		})
+	}
+
+	return labels, rows.Err()
+}
+
+// Carton labels of the materials expected to arrive. They carry the stock ID
+// since the material rows are made on receipt
+func fetchIncomingLabels(db *sql.DB, opts LabelFilter) ([]label, error) {
+	rows, err := db.Query(`
+		SELECT im.shipping_id, im.stock_id, COALESCE(im.description, ''), im.quantity,
+			im.lot_number, COALESCE(TO_CHAR(im.expiration_date, 'YYYY-MM-DD'), ''),
+			COALESCE(c.name, '')
+		FROM incoming_materials im
+		LEFT JOIN customers c ON c.customer_id = im.customer_id
+		WHERE
+			($1 = 0 OR im.shipping_id = $1) AND
+			($2 = 0 OR im.customer_id = $2)
+		ORDER BY im.shipping_id;`,
+		opts.shippingId, opts.customerId)
+	if err != nil {
+		log.Println("Error fetchIncomingLabels1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []label{}
+	for rows.Next() {
+		var shippingId, quantity int
+		var stockId, description, lotNumber, expirationDate, customerName string
+		if err := rows.Scan(&shippingId, &stockId, &description, &quantity,
+			&lotNumber, &expirationDate, &customerName); err != nil {
+			log.Println("Error fetchIncomingLabels2: ", err)
+			return nil, err
+		}
+
+		labels = append(labels, label{
+			Code:  stockId,
+			Title: stockId,
+			Lines: []string{
+				description,
+				lotLine(lotNumber, expirationDate),
+				fmt.Sprintf("%s / Qty %d / Shipping %d", customerName, quantity, shippingId),
+			},
+		})
+	}
+
+	return labels, rows.Err()
+}
+
+func lotLine(lotNumber string, expirationDate string) string {
+	line := ""
+	if lotNumber != "" {
+		line = "Lot " + lotNumber
+	}
+	if expirationDate != "" {
+		line = strings.TrimSpace(line + " Exp " + expirationDate)
+	}
+	return line
+}
+
+func renderLabels(w io.Writer, labels []label, opts LabelOptions) error {
+	if opts.format == labelZPL {
+		return renderLabelsZPL(w, labels, opts.symbology)
+	}
+	return renderLabelsPDF(w, labels, opts.symbology)
+}
+
+func renderLabelsPDF(w io.Writer, labels []label, symbology string) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	perSheet := sheetColumns * sheetRows
+	for i, l := range labels {
+		if i%perSheet == 0 {
+			pdf.AddPage()
+		}
+		x := sheetLeft + float64(i%sheetColumns)*(labelWidth+labelGap)
+		y := sheetTop + float64(i%perSheet/sheetColumns)*labelHeight
+
+		// Code128 runs along the top of the label, QR sits on its left side
+		textX, textWidth := x+4, labelWidth-8
+		var key string
+		if symbology == symbologyQR {
+			key = barcode.RegisterQR(pdf, l.Code, qr.M, qr.Auto)
+			barcode.Barcode(pdf, key, x+3, y+3, 32, 32, false)
+			textX, textWidth = x+38, labelWidth-41
+		}
+
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.SetXY(textX, y+2)
+		pdf.CellFormat(textWidth, 6, fitText(pdf, tr(l.Title), textWidth), "", 0, "L", false, 0, "")
+
+		lineY := y + 9.5
+		if symbology == symbologyCode128 {
+			key = barcode.RegisterCode128(pdf, l.Code)
+			barcode.Barcode(pdf, key, textX, y+8.5, textWidth, 13, false)
+			lineY = y + 22
+		}
+
+		pdf.SetFont("Courier", "", 8)
+		pdf.SetXY(textX, lineY)
+		pdf.CellFormat(textWidth, 3.5, fitText(pdf, tr(l.Code), textWidth), "", 0, "L", false, 0, "")
+
+		pdf.SetFont("Helvetica", "", 7)
+		for _, line := range l.Lines {
+			if line == "" {
+				continue
+			}
+			lineY += 3.5
+			if lineY+3.5 > y+labelHeight {
+				break
+			}
+			pdf.SetXY(textX, lineY)
+			pdf.CellFormat(textWidth, 3.5, fitText(pdf, tr(line), textWidth), "", 0, "L", false, 0, "")
+		}
+	}
+
+	return pdf.Output(w)
+}
+
+// Cuts the text to the width of the label in the current font
+func fitText(pdf *fpdf.Fpdf, text string, width float64) string {
+	for pdf.GetStringWidth(text) > width && len(text) > 0 {
+		text = text[:len(text)-1]
+	}
+	return text
+}
+
+// 4 x 2 in labels at 203 dpi. Field data is hex escaped so carets
+// and tildes in it are printed
+func renderLabelsZPL(w io.Writer, labels []label, symbology string) error {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString("^XA^CI28^PW812^LL406\n")
+
+		textX := 30
+		if symbology == symbologyQR {
+			fmt.Fprintf(&b, "^FO20,30^BQN,2,7^FH^FDMA,%s^FS\n", zplEscape(l.Code))
+			textX = 300
+		}
+		fmt.Fprintf(&b, "^FO%d,25^A0N,45,45^FH^FD%s^FS\n", textX, zplEscape(l.Title))
+
+		lineY := 85
+		if symbology == symbologyCode128 {
+			fmt.Fprintf(&b, "^FO%d,80^BY2^BCN,100,N,N,N^FH^FD%s^FS\n", textX, zplEscape(l.Code))
+			lineY = 195
+		}
+		fmt.Fprintf(&b, "^FO%d,%d^A0N,26,26^FH^FD%s^FS\n", textX, lineY, zplEscape(l.Code))
+
+		for _, line := range l.Lines {
+			if line == "" {
+				continue
+			}
+			lineY += 34
+			fmt.Fprintf(&b, "^FO%d,%d^A0N,26,26^FB%d,1,0,L^FH^FD%s^FS\n",
+				textX, lineY, 812-textX-20, zplEscape(line))
+		}
+		b.WriteString("^XZ\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func zplEscape(text string) string {
+	return strings.NewReplacer("_", "_5F", "^", "_5E", "~", "_7E").Replace(text)
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestZplEscape(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "STK-1", want: "STK-1"},
+		{text: "A_B", want: "A_5FB"},
+		{text: "^XZ", want: "_5EXZ"},
+		{text: "~JA", want: "_7EJA"},
+		{text: "_5E", want: "_5F5E"},
+	}
+
+	for _, tt := range tests {
+		if got := zplEscape(tt.text); got != tt.want {
+			t.Errorf("zplEscape(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLotLine(t *testing.T) {
+	tests := []struct {
+		lotNumber      string
+		expirationDate string
+		want           string
+	}{
+		{lotNumber: "", expirationDate: "", want: ""},
+		{lotNumber: "L1", expirationDate: "", want: "Lot L1"},
+		{lotNumber: "", expirationDate: "2026-01-31", want: "Exp 2026-01-31"},
+		{lotNumber: "L1", expirationDate: "2026-01-31", want: "Lot L1 Exp 2026-01-31"},
+	}
+
+	for _, tt := range tests {
+		if got := lotLine(tt.lotNumber, tt.expirationDate); got != tt.want {
+			t.Errorf("lotLine(%q, %q) = %q, want %q", tt.lotNumber, tt.expirationDate, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+)
+
+// What a location and the ones under it hold now or held at the end of a day
+type LocationContents struct {
+	Location  LocationDB
+	AsOf      string
+	TotalQty  int
+	Materials []LocationMaterial
+}
+
+type LocationMaterial struct {
+	MaterialID     int    `field:"material_id"`
+	StockID        string `field:"stock_id"`
+	Description    string `field:"description"`
+	LocationID     int    `field:"location_id"`
+	LocationName   string `field:"location_name"`
+	CustomerID     int    `field:"customer_id"`
+	CustomerName   string `field:"customer_name"`
+	Owner          string `field:"owner"`
+	Status         string `field:"status"`
+	LotNumber      string `field:"lot_number"`
+	ExpirationDate string `field:"expiration_date"`
+	Qty            int    `field:"quantity"`
+}
+
+// Moves what a location holds, or the stock of a customer or owner in it
+type LocationMoveJSON struct {
+	DestinationLocationID string `json:"destinationLocationId"`
+	CustomerID            string `json:"customerId"`
+	Owner                 string `json:"owner"`
+	Notes                 string `json:"notes"`
+	Override              bool   `json:"override"`
+}
+
+type LocationHistoryFilter struct {
+	dateFrom string
+	dateTo   string
+	stockId  string
+}
+
+// Entries of the transaction log posted to the rows of a location.
+// Running totals start from the balance before the first date
+type LocationHistoryLine struct {
+	TransactionID   int    `field:"transaction_id"`
+	Date            string `field:"updated_at"`
+	Type            string `field:"transaction_type"`
+	MaterialID      int    `field:"material_id"`
+	StockID         string `field:"stock_id"`
+	LotNumber       string `field:"lot_number"`
+	LocationName    string `field:"location_name"`
+	CustomerName    string `field:"customer_name"`
+	Owner           string `field:"owner"`
+	Qty             int    `field:"quantity_change"`
+	RunningQty      int    // of the location
+	StockRunningQty int    // of the stock in the location
+	ReasonCode      string `field:"reason_code"`
+	JobTicket       string `field:"job_ticket"`
+	Notes           string `field:"notes"`
+}
+
+// Quantities as of a date are summed from the transaction log
+func fetchLocationContents(db *sql.DB, locationId int, asOf string) (LocationContents, error) {
+	location, err := fetchLocation(db, locationId)
+	if err != nil {
+		return LocationContents{}, err
+	}
+
+	rows, err := db.Query(`
+		WITH RECURSIVE `+locationAncestors+`
+		SELECT * FROM (
+			SELECT m.material_id, m.stock_id, COALESCE(m.description, ''),
+				l.location_id, l.name, COALESCE(m.customer_id, 0), COALESCE(c.name, ''),
+				m.owner, m.status, m.lot_number,
+				COALESCE(TO_CHAR(m.expiration_date, 'YYYY-MM-DD'), ''),
+				CASE WHEN $2 = '' THEN m.quantity ELSE (
+					SELECT COALESCE(SUM(tl.quantity_change), 0) FROM transactions_log tl
+					WHERE tl.material_id = m.material_id AND tl.updated_at < NULLIF($2, '')::DATE + 1
+				) END AS "quantity",
+				l.pick_sequence
+			FROM materials m
+			LEFT JOIN locations l ON l.location_id = m.location_id
+			LEFT JOIN customers c ON c.customer_id = m.customer_id
+			WHERE m.location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $1)
+		) contents
+		WHERE "quantity" > 0
+		ORDER BY pick_sequence, name, stock_id, lot_number;`,
+		locationId, asOf)
+	if err != nil {
+		log.Println("Error fetchLocationContents1: ", err)
+		return LocationContents{}, err
+	}
+	defer rows.Close()
+
+	contents := LocationContents{Location: location, AsOf: asOf, Materials: []LocationMaterial{}}
+	for rows.Next() {
+		var material LocationMaterial
+		var pickSequence int
+		if err := rows.Scan(
+			&material.MaterialID,
+			&material.StockID,
+			&material.Description,
+			&material.LocationID,
+			&material.LocationName,
+			&material.CustomerID,
+			&material.CustomerName,
+			&material.Owner,
+			&material.Status,
+			&material.LotNumber,
+			&material.ExpirationDate,
+			&material.Qty,
+			&pickSequence,
+		); err != nil {
+			log.Println("Error fetchLocationContents2: ", err)
+			return LocationContents{}, err
+		}
+		contents.TotalQty += material.Qty
+		contents.Materials = append(contents.Materials, material)
+	}
+
+	return contents, rows.Err()
+}
+
+// Moves between locations under the same one show on both sides
+// and leave its running total unchanged
+func fetchLocationHistory(db *sql.DB, locationId int, opts LocationHistoryFilter) ([]LocationHistoryLine, error) {
+	if _, err := fetchLocation(db, locationId); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		WITH RECURSIVE `+locationAncestors+`,
+		entries AS (
+			SELECT tl.transaction_id, tl.updated_at, tl.transaction_type, tl.material_id,
+				tl.stock_id, m.lot_number, l.name AS "location_name",
+				COALESCE(c.name, '') AS "customer_name", m.owner, tl.quantity_change,
+				COALESCE(tl.reason_code, '') AS "reason_code",
+				COALESCE(tl.job_ticket, '') AS "job_ticket", COALESCE(tl.notes, '') AS "notes"
+			FROM transactions_log tl
+			LEFT JOIN materials m ON m.material_id = tl.material_id
+			LEFT JOIN locations l ON l.location_id = m.location_id
+			LEFT JOIN customers c ON c.customer_id = m.customer_id
+			WHERE
+				m.location_id IN (
+					SELECT location_id FROM location_ancestors WHERE ancestor_id = $1) AND
+				($2 = '' OR tl.stock_id = $2) AND
+				($4 = '' OR tl.updated_at < NULLIF($4, '')::DATE + 1)
+		),
+		running AS (
+			SELECT *,
+				SUM(quantity_change) OVER (ORDER BY transaction_id) AS "running_quantity",
+				SUM(quantity_change) OVER (
+					PARTITION BY stock_id ORDER BY transaction_id) AS "stock_running_quantity"
+			FROM entries
+		)
+		SELECT transaction_id, COALESCE(TO_CHAR(updated_at, 'YYYY-MM-DD'), ''), transaction_type,
+			material_id, stock_id, lot_number, location_name, customer_name, owner,
+			quantity_change, running_quantity, stock_running_quantity,
+			reason_code, job_ticket, notes
+		FROM running
+		WHERE $3 = '' OR updated_at::TEXT >= $3
+		ORDER BY transaction_id;`,
+		locationId, opts.stockId, opts.dateFrom, opts.dateTo)
+	if err != nil {
+		log.Println("Error fetchLocationHistory1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []LocationHistoryLine{}
+	for rows.Next() {
+		var line LocationHistoryLine
+		if err := rows.Scan(
+			&line.TransactionID,
+			&line.Date,
+			&line.Type,
+			&line.MaterialID,
+			&line.StockID,
+			&line.LotNumber,
+			&line.LocationName,
+			&line.CustomerName,
+			&line.Owner,
+			&line.Qty,
+			&line.RunningQty,
+			&line.StockRunningQty,
+			&line.ReasonCode,
+			&line.JobTicket,
+			&line.Notes,
+		); err != nil {
+			log.Println("Error fetchLocationHistory2: ", err)
+			return nil, err
+		}
+		history = append(history, line)
+	}
+
+	return history, rows.Err()
+}
+
+// Moves every row of the location holding stock in one database transaction.
+// Rows merge into the ones of the same stock, owner, status and lot at the
+// destination, and their serials and active reservations go with them.
+// Reserved stock moves only with the override
+func moveLocationContents(locationId int, move LocationMoveJSON, db *sql.DB) ([]BatchLineResult, error) {
+	results := []BatchLineResult{}
+	destinationId, _ := strconv.Atoi(move.DestinationLocationID)
+	if destinationId == locationId {
+		return results, errors.New("The destination must be another location")
+	}
+	if _, err := fetchLocation(db, locationId); err != nil {
+		return results, err
+	}
+	if _, err := fetchLocation(db, destinationId); err != nil {
+		return results, err
+	}
+	customerId, _ := strconv.Atoi(move.CustomerID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return results, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT material_id, quantity FROM materials
+		WHERE
+			location_id = $1 AND
+			quantity > 0 AND
+			($2 = 0 OR customer_id = $2) AND
+			($3 = '' OR owner::TEXT = $3)
+		ORDER BY material_id;`,
+		locationId, customerId, move.Owner)
+	if err != nil {
+		return results, err
+	}
+
+	lines := []MaterialJSON{}
+	for rows.Next() {
+		var materialId, quantity int
+		if err := rows.Scan(&materialId, &quantity); err != nil {
+			rows.Close()
+			return results, err
+		}
+		lines = append(lines, MaterialJSON{
+			MaterialID: strconv.Itoa(materialId),
+			LocationID: move.DestinationLocationID,
+			Qty:        strconv.Itoa(quantity),
+			Notes:      move.Notes,
+			Override:   move.Override,
+		})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return results, err
+	}
+	if len(lines) == 0 {
+		return results, errors.New("Location " + strconv.Itoa(locationId) + " holds nothing to move")
+	}
+
+	for i, line := range lines {
+		results = append(results, BatchLineResult{Line: i + 1, MaterialID: line.MaterialID, TransactionIDs: []int{}})
+
+		materialId, _ := strconv.Atoi(line.MaterialID)
+		line.SerialNumbers, err = materialSerials(tx, materialId)
+		if err != nil {
+			return rolledBack(results), err
+		}
+
+		trxIds, err := moveMaterial(line, tx)
+		if err != nil {
+			results[i].Error = err.Error()
+			return rolledBack(results), err
+		}
+		results[i].TransactionIDs = trxIds
+
+		newMaterialId, err := movedToMaterial(tx, trxIds)
+		if err != nil {
+			return rolledBack(results), err
+		}
+		_, err = tx.Exec(`
+			UPDATE reservations r SET material_id = $1
+			WHERE r.material_id = $2 AND `+activeReservation+`;`,
+			newMaterialId, materialId)
+		if err != nil {
+			return rolledBack(results), err
+		}
+
+		results[i].Warning, err = capacityWarning(tx, destinationId)
+		if err != nil {
+			return rolledBack(results), err
+		}
+	}
+
+	return results, tx.Commit()
+}
@@ -2,27 +2,141 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"strconv"
 )
 
+// Location levels from the top of the hierarchy down
+var locationLevels = []string{"zone", "aisle", "rack", "shelf", "bin"}
+
+// What a location is used for. Stock is put away to storage locations only
+const (
+	locationStorage       = "storage"
+	locationReceivingDock = "receiving_dock"
+	locationStaging       = "staging"
+	locationQuarantine    = "quarantine"
+	locationInTransit     = "in_transit"
+)
+
+// What a location may hold at the same time
+const (
+	storageSingleSku      = "single_sku"
+	storageSingleCustomer = "single_customer"
+	storageMixed          = "mixed"
+)
+
+// Pairs of every location with each of its ancestors, the location itself included.
+// Filters roll up by matching the ancestor, reports by grouping on it
+const locationAncestors = `location_ancestors AS (
+	SELECT location_id, location_id AS ancestor_id FROM locations
+	UNION ALL
+	SELECT la.location_id, p.parent_id FROM location_ancestors la
+	JOIN locations p ON p.location_id = la.ancestor_id
+	WHERE p.parent_id IS NOT NULL
+)`
+
+// The name of a child location is the path of its parent followed by its code
+type LocationJSON struct {
+	WarehouseID  string `json:"warehouseId"`
+	ParentID     string `json:"parentId"`
+	Level        string `json:"level"`
+	Code         string `json:"code"`
+	LocationType string `json:"locationType"`
+	StorageRule  string `json:"storageRule"`
+	Zone         string `json:"zone"`
+	PickSequence string `json:"pickSequence"`
+	Capacity     string `json:"capacity"`
+	CapacityType string `json:"capacityType"`
+	Enforcement  string `json:"capacityEnforcement"`
+}
+
+// Codes of a level run from From to To, either letters (A-F)
+// or numbers keeping the zero padding of From (01-20)
+type LocationLevelPatternJSON struct {
+	Level  string `json:"level"`
+	Prefix string `json:"prefix"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// Every combination of the level codes is created under the parent.
+// Capacity is given to the locations of the last level
+type LocationPatternJSON struct {
+	WarehouseID  string                     `json:"warehouseId"`
+	ParentID     string                     `json:"parentId"`
+	Levels       []LocationLevelPatternJSON `json:"levels"`
+	StorageRule  string                     `json:"storageRule"`
+	Capacity     string                     `json:"capacity"`
+	CapacityType string                     `json:"capacityType"`
+	Enforcement  string                     `json:"capacityEnforcement"`
+}
+
+// At most this many locations are created from one pattern
+const maxPatternLocations = 10000
+
+type LocationTreeFilter struct {
+	warehouseId  int
+	locationId   int
+	level        string
+	locationType string
+	active       string
+}
+
 type LocationFilter struct {
-	stockId string
-	owner   string
+	stockId      string
+	customerId   int
+	owner        string
+	locationType string
 }
 
 type LocationDB struct {
-	ID          int    `field:"location_id"`
-	Name        string `field:"name"`
-	WarehouseID int    `field:"warehouse_id"`
+	ID           int     `field:"location_id"`
+	Name         string  `field:"name"`
+	WarehouseID  int     `field:"warehouse_id"`
+	ParentID     int     `field:"parent_id"`
+	Level        string  `field:"level"`
+	Code         string  `field:"code"`
+	LocationType string  `field:"location_type"`
+	IsActive     bool    `field:"is_active"`
+	StorageRule  string  `field:"storage_rule"`
+	Zone         string  `field:"zone"`
+	PickSequence int     `field:"pick_sequence"`
+	Capacity     float64 `field:"capacity"`
+	CapacityType string  `field:"capacity_type"`
+	Enforcement  string  `field:"capacity_enforcement"`
 }
 
+// Active locations of the type the stock can be put in under their storage rules.
+// The type defaults to storage, the customer to the one the stock is kept for.
+// Given an owner, locations holding stock of the other one are left out
 func fetchAvailableLocations(db *sql.DB, opts LocationFilter) ([]LocationDB, error) {
+	if opts.locationType == "" {
+		opts.locationType = locationStorage
+	}
+
 	rows, err := db.Query(`
-		SELECT l.location_id, l.name, l.warehouse_id FROM locations l
-		LEFT JOIN materials m
-		ON l.location_id = m.location_id
-		WHERE m.stock_id = $1 AND m.owner = $2 OR m.material_id IS NULL;
-	`, opts.stockId, opts.owner)
+		SELECT l.location_id, l.name, l.warehouse_id, l.location_type, l.storage_rule FROM locations l
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		WHERE l.is_active AND w.is_active AND l.location_type::TEXT = $3 AND (
+			l.storage_rule = 'mixed' OR NOT EXISTS (
+			SELECT 1 FROM materials m
+			WHERE m.location_id = l.location_id AND m.quantity > 0 AND (
+				(l.storage_rule = 'single_sku' AND m.stock_id <> $1) OR
+				(l.storage_rule = 'single_customer' AND m.customer_id IS DISTINCT FROM COALESCE(
+					NULLIF($2, 0),
+					(SELECT customer_id FROM materials WHERE stock_id = $1 LIMIT 1),
+					(SELECT customer_id FROM incoming_materials WHERE stock_id = $1 LIMIT 1)
+				))
+			)
+		)) AND ($4 = '' OR NOT EXISTS (
+			SELECT 1 FROM materials m
+			WHERE m.location_id = l.location_id AND m.quantity > 0 AND m.owner::TEXT <> $4
+		))
+		ORDER BY l.warehouse_id, l.pick_sequence, l.name;
+	`, opts.stockId, opts.customerId, opts.locationType, opts.owner)
 	if err != nil {
 		log.Println("Error fetchLocations1: ", err)
 		return nil, err
@@ -33,7 +147,13 @@ func fetchAvailableLocations(db *sql.DB, opts LocationFilter) ([]LocationDB, err
 
 	for rows.Next() {
 		var location LocationDB
-		if err := rows.Scan(&location.ID, &location.Name, &location.WarehouseID); err != nil {
+		if err := rows.Scan(
+			&location.ID,
+			&location.Name,
+			&location.WarehouseID,
+			&location.LocationType,
+			&location.StorageRule,
+		); err != nil {
 			log.Println("Error fetchLocations2: ", err)
 			return locations, err
 		}
@@ -45,3 +165,550 @@ func fetchAvailableLocations(db *sql.DB, opts LocationFilter) ([]LocationDB, err
 
 	return locations, nil
 }
+
+// Locations under the given one, the location itself included
+func fetchLocations(db dbExecutor, opts LocationTreeFilter) ([]LocationDB, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE `+locationAncestors+`
+		SELECT l.location_id, l.name, COALESCE(l.warehouse_id, 0), COALESCE(l.parent_id, 0),
+			COALESCE(l.level::TEXT, ''), COALESCE(l.code, ''), l.location_type, l.is_active,
+			l.storage_rule, COALESCE(l.zone, ''),
+			l.pick_sequence, COALESCE(l.capacity, 0), l.capacity_type, l.capacity_enforcement
+		FROM locations l
+		WHERE
+			($1 = 0 OR l.warehouse_id = $1) AND
+			($2 = 0 OR l.location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $2)) AND
+			($3 = '' OR l.level::TEXT = $3) AND
+			($4 = '' OR l.location_type::TEXT = $4) AND
+			($5 = '' OR l.is_active::TEXT = $5)
+		ORDER BY l.warehouse_id, l.name;`,
+		opts.warehouseId, opts.locationId, opts.level, opts.locationType, opts.active)
+	if err != nil {
+		log.Println("Error fetchLocations1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []LocationDB{}
+	for rows.Next() {
+		var location LocationDB
+		if err := rows.Scan(
+			&location.ID,
+			&location.Name,
+			&location.WarehouseID,
+			&location.ParentID,
+			&location.Level,
+			&location.Code,
+			&location.LocationType,
+			&location.IsActive,
+			&location.StorageRule,
+			&location.Zone,
+			&location.PickSequence,
+			&location.Capacity,
+			&location.CapacityType,
+			&location.Enforcement,
+		); err != nil {
+			log.Println("Error fetchLocations2: ", err)
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+
+	return locations, rows.Err()
+}
+
+func fetchLocation(db dbExecutor, locationId int) (LocationDB, error) {
+	var location LocationDB
+	err := db.QueryRow(`
+		SELECT location_id, name, COALESCE(warehouse_id, 0), COALESCE(parent_id, 0),
+			COALESCE(level::TEXT, ''), COALESCE(code, ''), location_type, is_active,
+			storage_rule, COALESCE(zone, ''),
+			pick_sequence, COALESCE(capacity, 0), capacity_type, capacity_enforcement
+		FROM locations WHERE location_id = $1;`, locationId).
+		Scan(
+			&location.ID,
+			&location.Name,
+			&location.WarehouseID,
+			&location.ParentID,
+			&location.Level,
+			&location.Code,
+			&location.LocationType,
+			&location.IsActive,
+			&location.StorageRule,
+			&location.Zone,
+			&location.PickSequence,
+			&location.Capacity,
+			&location.CapacityType,
+			&location.Enforcement,
+		)
+	if err == sql.ErrNoRows {
+		return location, errors.New("Location " + strconv.Itoa(locationId) + " is not found")
+	}
+
+	return location, err
+}
+
+func createLocation(location LocationJSON, db dbExecutor) (int, error) {
+	if location.Code == "" {
+		return 0, errors.New("Location code is required")
+	}
+	if !slices.Contains(locationLevels, location.Level) {
+		return 0, fmt.Errorf("Location level must be one of %v", locationLevels)
+	}
+
+	warehouseId, _ := strconv.Atoi(location.WarehouseID)
+	parentId, _ := strconv.Atoi(location.ParentID)
+	name := location.Code
+	zone := location.Zone
+	storageRule := location.StorageRule
+
+	if parentId != 0 {
+		parent, err := fetchLocation(db, parentId)
+		if err != nil {
+			return 0, err
+		}
+		if parent.Level != "" &&
+			slices.Index(locationLevels, location.Level) <= slices.Index(locationLevels, parent.Level) {
+			return 0, errors.New("A " + location.Level + " cannot be placed under a " + parent.Level)
+		}
+		warehouseId = parent.WarehouseID
+		name = parent.Name + "-" + location.Code
+		if zone == "" {
+			zone = parent.Zone
+		}
+		if storageRule == "" {
+			storageRule = parent.StorageRule
+		}
+	}
+	if warehouseId == 0 {
+		return 0, errors.New("Warehouse or parent location is required")
+	}
+	if zone == "" && location.Level == "zone" {
+		zone = location.Code
+	}
+	if storageRule == "" {
+		storageRule = storageMixed
+	}
+	if err := validateStorageRule(storageRule); err != nil {
+		return 0, err
+	}
+	if location.LocationType == "" {
+		location.LocationType = locationStorage
+	}
+	if err := validateLocationType(location.LocationType); err != nil {
+		return 0, err
+	}
+
+	pickSequence, _ := strconv.Atoi(location.PickSequence)
+	capacity, _ := strconv.ParseFloat(location.Capacity, 64)
+	if location.CapacityType == "" {
+		location.CapacityType = capacityUnits
+	}
+	if location.Enforcement == "" {
+		location.Enforcement = enforceReject
+	}
+	if err := validateCapacity(location.CapacityType, location.Enforcement); err != nil {
+		return 0, err
+	}
+
+	var locationId int
+	err := db.QueryRow(`
+		INSERT INTO locations (name, warehouse_id, parent_id, level, code, location_type, storage_rule,
+			zone, pick_sequence, capacity, capacity_type, capacity_enforcement)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+		RETURNING location_id;`,
+		name, warehouseId,
+		sql.NullInt64{Int64: int64(parentId), Valid: parentId != 0},
+		location.Level, location.Code, location.LocationType, storageRule,
+		sql.NullString{String: zone, Valid: zone != ""},
+		pickSequence,
+		sql.NullFloat64{Float64: capacity, Valid: capacity > 0},
+		location.CapacityType, location.Enforcement,
+	).Scan(&locationId)
+	if err != nil {
+		return 0, err
+	}
+
+	return locationId, nil
+}
+
+// Creates the locations of the pattern in one transaction. Existing locations
+// of the upper levels are reused, so a pattern can extend an existing area
+func createLocations(pattern LocationPatternJSON, db *sql.DB) ([]LocationDB, error) {
+	if len(pattern.Levels) == 0 {
+		return nil, errors.New("At least one level is required")
+	}
+
+	codes := make([][]string, len(pattern.Levels))
+	total := 1
+	for i, level := range pattern.Levels {
+		levelCodes, err := expandCodes(level.From, level.To)
+		if err != nil {
+			return nil, err
+		}
+		for j := range levelCodes {
+			levelCodes[j] = level.Prefix + levelCodes[j]
+		}
+		codes[i] = levelCodes
+		total *= len(levelCodes)
+		if total > maxPatternLocations {
+			return nil, errors.New("The pattern creates more than " + strconv.Itoa(maxPatternLocations) + " locations")
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	warehouseId, _ := strconv.Atoi(pattern.WarehouseID)
+	parentId, _ := strconv.Atoi(pattern.ParentID)
+	if parentId != 0 {
+		parent, err := fetchLocation(tx, parentId)
+		if err != nil {
+			return nil, err
+		}
+		warehouseId = parent.WarehouseID
+	}
+	if warehouseId == 0 {
+		return nil, errors.New("Warehouse or parent location is required")
+	}
+
+	// New locations are picked in the order they are created
+	var pickSequence int
+	err = tx.QueryRow(`
+		SELECT COALESCE(MAX(pick_sequence), 0) FROM locations WHERE warehouse_id = $1;`,
+		warehouseId).Scan(&pickSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	var locationIds []int
+	var create func(parentId int, depth int) error
+	create = func(parentId int, depth int) error {
+		level := pattern.Levels[depth]
+		last := depth == len(pattern.Levels)-1
+		for _, code := range codes[depth] {
+			locationId, err := findChildLocation(tx, warehouseId, parentId, code)
+			if err != nil {
+				return err
+			}
+			if locationId == 0 {
+				pickSequence++
+				location := LocationJSON{
+					WarehouseID:  strconv.Itoa(warehouseId),
+					ParentID:     strconv.Itoa(parentId),
+					Level:        level.Level,
+					Code:         code,
+					StorageRule:  pattern.StorageRule,
+					PickSequence: strconv.Itoa(pickSequence),
+				}
+				if last {
+					location.Capacity = pattern.Capacity
+					location.CapacityType = pattern.CapacityType
+					location.Enforcement = pattern.Enforcement
+				}
+				locationId, err = createLocation(location, tx)
+				if err != nil {
+					return fmt.Errorf("Location %s: %w", code, err)
+				}
+				locationIds = append(locationIds, locationId)
+			}
+			if !last {
+				if err := create(locationId, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := create(parentId, 0); err != nil {
+		return nil, err
+	}
+
+	locations := []LocationDB{}
+	for _, locationId := range locationIds {
+		location, err := fetchLocation(tx, locationId)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, location)
+	}
+
+	return locations, tx.Commit()
+}
+
+func findChildLocation(db dbExecutor, warehouseId int, parentId int, code string) (int, error) {
+	var locationId int
+	err := db.QueryRow(`
+		SELECT location_id FROM locations
+		WHERE warehouse_id = $1 AND COALESCE(parent_id, 0) = $2 AND code = $3;`,
+		warehouseId, parentId, code).Scan(&locationId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return locationId, err
+}
+
+// Expands A-F to A, B, ... F and 01-20 to 01, 02, ... 20
+func expandCodes(from string, to string) ([]string, error) {
+	if from == "" {
+		return nil, errors.New("Level range is required")
+	}
+	if to == "" {
+		to = from
+	}
+
+	if len(from) == 1 && len(to) == 1 && isLetter(from[0]) && isLetter(to[0]) {
+		if from[0] > to[0] {
+			return nil, errors.New("Invalid level range " + from + "-" + to)
+		}
+		var codes []string
+		for c := from[0]; c <= to[0]; c++ {
+			codes = append(codes, string(c))
+		}
+		return codes, nil
+	}
+
+	first, err1 := strconv.Atoi(from)
+	last, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || first < 0 || first > last {
+		return nil, errors.New("Invalid level range " + from + "-" + to)
+	}
+	var codes []string
+	for n := first; n <= last; n++ {
+		codes = append(codes, fmt.Sprintf("%0*d", len(from), n))
+	}
+
+	return codes, nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func validateStorageRule(rule string) error {
+	if rule != storageSingleSku && rule != storageSingleCustomer && rule != storageMixed {
+		return errors.New("Storage rule must be one of " + storageSingleSku + ", " +
+			storageSingleCustomer + " or " + storageMixed)
+	}
+	return nil
+}
+
+// Rejects stock that the storage rule of the location does not allow next to what it holds
+func checkStorageRule(db dbExecutor, locationId int, stockId string, customerId int) error {
+	var name, rule string
+	err := db.QueryRow(`
+		SELECT name, storage_rule FROM locations WHERE location_id = $1;`,
+		locationId).Scan(&name, &rule)
+	if err == sql.ErrNoRows {
+		return errors.New("Location " + strconv.Itoa(locationId) + " is not found")
+	}
+	if err != nil || rule == storageMixed {
+		return err
+	}
+
+	var conflicting string
+	err = db.QueryRow(`
+		SELECT stock_id FROM materials
+		WHERE location_id = $1 AND quantity > 0 AND (
+			($2 = 'single_sku' AND stock_id <> $3) OR
+			($2 = 'single_customer' AND customer_id IS DISTINCT FROM $4)
+		)
+		LIMIT 1;`, locationId, rule, stockId, customerId).Scan(&conflicting)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if rule == storageSingleSku {
+		return errors.New("Location " + name + " holds a single stock and already has " + conflicting)
+	}
+	return errors.New("Location " + name + " holds a single customer's stock and already has " +
+		conflicting + " of another customer")
+}
+
+func validateLocationType(locationType string) error {
+	switch locationType {
+	case locationStorage, locationReceivingDock, locationStaging, locationQuarantine:
+		return nil
+	}
+	return errors.New("Location type must be one of " + locationStorage + ", " + locationReceivingDock +
+		", " + locationStaging + " or " + locationQuarantine)
+}
+
+// Empty fields keep their values. A new code renames the location
+// and the paths of the locations under it
+func updateLocation(locationId int, update LocationJSON, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	location, err := fetchLocation(tx, locationId)
+	if err != nil {
+		return err
+	}
+
+	if update.LocationType != "" {
+		location.LocationType = update.LocationType
+	}
+	if update.StorageRule != "" {
+		location.StorageRule = update.StorageRule
+	}
+	if update.Zone != "" {
+		location.Zone = update.Zone
+	}
+	if update.PickSequence != "" {
+		location.PickSequence, _ = strconv.Atoi(update.PickSequence)
+	}
+	if update.Capacity != "" {
+		location.Capacity, _ = strconv.ParseFloat(update.Capacity, 64)
+	}
+	if update.CapacityType != "" {
+		location.CapacityType = update.CapacityType
+	}
+	if update.Enforcement != "" {
+		location.Enforcement = update.Enforcement
+	}
+	if err := validateLocationType(location.LocationType); err != nil {
+		return err
+	}
+	if err := validateStorageRule(location.StorageRule); err != nil {
+		return err
+	}
+	if err := validateCapacity(location.CapacityType, location.Enforcement); err != nil {
+		return err
+	}
+
+	if update.Code != "" && update.Code != location.Code {
+		name := update.Code
+		if location.ParentID != 0 {
+			parent, err := fetchLocation(tx, location.ParentID)
+			if err != nil {
+				return err
+			}
+			name = parent.Name + "-" + update.Code
+		}
+
+		// Locations under it keep the rest of their paths
+		_, err = tx.Exec(`
+			WITH RECURSIVE `+locationAncestors+`
+			UPDATE locations SET name = $1 || SUBSTRING(name FROM LENGTH($2) + 1)
+			WHERE location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $3
+			) AND (location_id = $3 OR LEFT(name, LENGTH($2) + 1) = $2 || '-');`,
+			name, location.Name, locationId)
+		if err != nil {
+			return err
+		}
+		location.Code = update.Code
+	}
+
+	_, err = tx.Exec(`
+		UPDATE locations
+		SET code = NULLIF($1, ''), location_type = $2, storage_rule = $3, zone = NULLIF($4, ''),
+			pick_sequence = $5, capacity = $6, capacity_type = $7, capacity_enforcement = $8
+		WHERE location_id = $9;`,
+		location.Code, location.LocationType, location.StorageRule, location.Zone,
+		location.PickSequence,
+		sql.NullFloat64{Float64: location.Capacity, Valid: location.Capacity > 0},
+		location.CapacityType, location.Enforcement, locationId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The locations under it are activated or deactivated with it
+func setLocationActive(locationId int, isActive bool, db *sql.DB) error {
+	res, err := db.Exec(`
+		WITH RECURSIVE `+locationAncestors+`
+		UPDATE locations SET is_active = $1
+		WHERE location_id IN (SELECT location_id FROM location_ancestors WHERE ancestor_id = $2);`,
+		isActive, locationId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Location " + strconv.Itoa(locationId) + " is not found")
+	}
+
+	return nil
+}
+
+// Locations holding stock or referenced by history cannot be deleted.
+// Deactivate them instead
+func deleteLocation(locationId int, db dbExecutor) error {
+	if err := checkLocationDeletable(db, locationId); err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`DELETE FROM locations WHERE location_id = $1;`, locationId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Location " + strconv.Itoa(locationId) + " is not found")
+	}
+
+	return nil
+}
+
+func checkLocationDeletable(db dbExecutor, locationId int) error {
+	var hasChildren, hasStock, hasHistory bool
+	err := db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM locations WHERE parent_id = $1),
+			EXISTS (SELECT 1 FROM materials WHERE location_id = $1 AND quantity > 0),
+			EXISTS (SELECT 1 FROM materials WHERE location_id = $1) OR
+			EXISTS (SELECT 1 FROM inventory_event_lines WHERE location_id = $1);`,
+		locationId).Scan(&hasChildren, &hasStock, &hasHistory)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case hasChildren:
+		return errors.New("Location " + strconv.Itoa(locationId) + " has locations under it")
+	case hasStock:
+		return errors.New("Location " + strconv.Itoa(locationId) + " holds stock")
+	case hasHistory:
+		return errors.New("Location " + strconv.Itoa(locationId) +
+			" is referenced by transaction history. Deactivate it instead")
+	}
+
+	return nil
+}
+
+// Stock is only put in active locations of active warehouses
+func checkLocationActive(db dbExecutor, locationId int) error {
+	var name string
+	var isActive, warehouseActive bool
+	err := db.QueryRow(`
+		SELECT l.name, l.is_active, COALESCE(w.is_active, TRUE) FROM locations l
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		WHERE l.location_id = $1;`, locationId).Scan(&name, &isActive, &warehouseActive)
+	if err == sql.ErrNoRows {
+		return errors.New("Location " + strconv.Itoa(locationId) + " is not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if !warehouseActive {
+		return errors.New("The warehouse of the location " + name + " is inactive")
+	}
+	if !isActive {
+		return errors.New("Location " + name + " is inactive")
+	}
+
+	return nil
+}
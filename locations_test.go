@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandCodes(t *testing.T) {
+	tests := []struct {
+		from, to string
+		codes    []string
+		wantErr  bool
+	}{
+		{from: "A", to: "D", codes: []string{"A", "B", "C", "D"}},
+		{from: "b", to: "b", codes: []string{"b"}},
+		{from: "C", to: "", codes: []string{"C"}},
+		{from: "01", to: "04", codes: []string{"01", "02", "03", "04"}},
+		{from: "08", to: "11", codes: []string{"08", "09", "10", "11"}},
+		{from: "1", to: "3", codes: []string{"1", "2", "3"}},
+		{from: "7", to: "", codes: []string{"7"}},
+		{from: "", to: "3", wantErr: true},
+		{from: "D", to: "A", wantErr: true},
+		{from: "05", to: "02", wantErr: true},
+		{from: "A", to: "05", wantErr: true},
+		{from: "-1", to: "2", wantErr: true},
+		{from: "AA", to: "AC", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		codes, err := expandCodes(tt.from, tt.to)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expandCodes(%q, %q) = %v, want an error", tt.from, tt.to, codes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandCodes(%q, %q) failed: %v", tt.from, tt.to, err)
+			continue
+		}
+		if !reflect.DeepEqual(codes, tt.codes) {
+			t.Errorf("expandCodes(%q, %q) = %v, want %v", tt.from, tt.to, codes, tt.codes)
+		}
+	}
+}
@@ -33,15 +33,107 @@ func main() {
 	router.HandleFunc("/material_types", getMaterialTypesHandler).Methods("GET")
 	router.HandleFunc("/materials/move-to-location", moveMaterialHandler).Methods("PATCH")
 	router.HandleFunc("/materials/remove-from-location", removeMaterialHandler).Methods("PATCH")
+	router.HandleFunc("/materials/move-to-location/batch", moveMaterialsBatchHandler).Methods("PATCH")
+	router.HandleFunc("/materials/remove-from-location/batch", removeMaterialsBatchHandler).Methods("PATCH")
+	router.HandleFunc("/materials/return", returnMaterialHandler).Methods("POST")
+	router.HandleFunc("/materials/adjust", adjustMaterialHandler).Methods("POST")
+	router.HandleFunc("/adjustment_reasons", setAdjustmentReasonHandler).Methods("POST")
+	router.HandleFunc("/adjustment_reasons", getAdjustmentReasonsHandler).Methods("GET")
+	router.HandleFunc("/transactions/{id}/reverse", reverseTransactionHandler).Methods("POST")
+	router.HandleFunc("/materials/release", releaseMaterialHandler).Methods("PATCH")
+	router.HandleFunc("/materials/reject", rejectMaterialHandler).Methods("PATCH")
+
+	router.HandleFunc("/stock_profiles", setStockProfileHandler).Methods("POST")
+	router.HandleFunc("/stock_profiles", getStockProfilesHandler).Methods("GET")
+	router.HandleFunc("/serials/{serialNumber}", getSerialHistoryHandler).Methods("GET")
+
+	router.HandleFunc("/materials/availability", getStockAvailabilityHandler).Methods("GET")
+	router.HandleFunc("/reservations", createReservationHandler).Methods("POST")
+	router.HandleFunc("/reservations", getReservationsHandler).Methods("GET")
+	router.HandleFunc("/reservations/{id}", deleteReservationHandler).Methods("DELETE")
 
 	router.HandleFunc("/incoming_materials", sendMaterialHandler).Methods("POST")
 	router.HandleFunc("/incoming_materials", getIncomingMaterialsHandler).Methods("GET")
 
+	router.HandleFunc("/pick_lists", generatePickListHandler).Methods("POST")
+	router.HandleFunc("/pick_lists/confirm", confirmPickListHandler).Methods("POST")
+
+	router.HandleFunc("/jobs", createJobHandler).Methods("POST")
+	router.HandleFunc("/jobs", getJobsHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}", getJobHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}/availability", getJobAvailabilityHandler).Methods("GET")
+	router.HandleFunc("/jobs/{id}/consume", consumeJobMaterialHandler).Methods("POST")
+
+	router.HandleFunc("/count_tasks/generate", generateCountTasksHandler).Methods("POST")
+	router.HandleFunc("/count_tasks", getCountTasksHandler).Methods("GET")
+	router.HandleFunc("/count_tasks/{id}", getCountTaskHandler).Methods("GET")
+	router.HandleFunc("/count_tasks/{id}/submit", submitCountHandler).Methods("POST")
+	router.HandleFunc("/count_tasks/{id}/approve", approveCountHandler).Methods("POST")
+	router.HandleFunc("/count_tasks/{id}/reject", rejectCountHandler).Methods("POST")
+	router.HandleFunc("/count_tasks/{id}/reopen", reopenCountHandler).Methods("POST")
+
+	router.HandleFunc("/inventory_events", startInventoryEventHandler).Methods("POST")
+	router.HandleFunc("/inventory_events", getInventoryEventsHandler).Methods("GET")
+	router.HandleFunc("/inventory_events/{id}", getInventoryEventHandler).Methods("GET")
+	router.HandleFunc("/inventory_events/{id}/counts", submitInventoryCountHandler).Methods("POST")
+	router.HandleFunc("/inventory_events/{id}/count_sheet", getCountSheetHandler).Methods("GET")
+	router.HandleFunc("/inventory_events/{id}/close", closeInventoryEventHandler).Methods("POST")
+	router.HandleFunc("/inventory_events/{id}/report", getInventoryReportHandler).Methods("GET")
+
+	router.HandleFunc("/kits", createKitHandler).Methods("POST")
+	router.HandleFunc("/kits", getKitsHandler).Methods("GET")
+	router.HandleFunc("/kits/{id}", getKitHandler).Methods("GET")
+	router.HandleFunc("/kits/{id}/assemble", assembleKitHandler).Methods("POST")
+	router.HandleFunc("/kits/{id}/disassemble", disassembleKitHandler).Methods("POST")
+
+	router.HandleFunc("/shipments", createShipmentHandler).Methods("POST")
+	router.HandleFunc("/shipments", getShipmentsHandler).Methods("GET")
+	router.HandleFunc("/shipments/{id}", getShipmentHandler).Methods("GET")
+	router.HandleFunc("/shipments/{id}/pick", pickShipmentHandler).Methods("POST")
+	router.HandleFunc("/shipments/{id}/pack", packShipmentHandler).Methods("POST")
+	router.HandleFunc("/shipments/{id}/ship", shipShipmentHandler).Methods("POST")
+	router.HandleFunc("/shipments/{id}/packing_slip", getPackingSlipHandler).Methods("GET")
+
+	router.HandleFunc("/transfers", createTransferHandler).Methods("POST")
+	router.HandleFunc("/transfers", getTransfersHandler).Methods("GET")
+	router.HandleFunc("/transfers/in_transit", getInTransitReportHandler).Methods("GET")
+	router.HandleFunc("/transfers/{id}", getTransferHandler).Methods("GET")
+	router.HandleFunc("/transfers/{id}/receive", receiveTransferHandler).Methods("POST")
+
 	router.HandleFunc("/warehouses", createWarehouseHandler).Methods("POST")
 	router.HandleFunc("/available_locations", getAvailableLocationsHandler).Methods("GET")
+	router.HandleFunc("/locations/suggestions", getLocationSuggestionsHandler).Methods("GET")
+	router.HandleFunc("/locations", createLocationHandler).Methods("POST")
+	router.HandleFunc("/locations", getLocationsHandler).Methods("GET")
+	router.HandleFunc("/locations/bulk", createLocationsHandler).Methods("POST")
+	router.HandleFunc("/locations/utilization", getLocationUtilizationHandler).Methods("GET")
+	router.HandleFunc("/warehouses/utilization", getWarehouseUtilizationHandler).Methods("GET")
+	router.HandleFunc("/warehouses", getWarehousesHandler).Methods("GET")
+	router.HandleFunc("/warehouses/{id}", getWarehouseHandler).Methods("GET")
+	router.HandleFunc("/warehouses/{id}", updateWarehouseHandler).Methods("PUT")
+	router.HandleFunc("/warehouses/{id}", deleteWarehouseHandler).Methods("DELETE")
+	router.HandleFunc("/warehouses/{id}/deactivate", deactivateWarehouseHandler).Methods("POST")
+	router.HandleFunc("/warehouses/{id}/activate", activateWarehouseHandler).Methods("POST")
+	router.HandleFunc("/locations/{id}", getLocationHandler).Methods("GET")
+	router.HandleFunc("/locations/{id}", updateLocationHandler).Methods("PUT")
+	router.HandleFunc("/locations/{id}", deleteLocationHandler).Methods("DELETE")
+	router.HandleFunc("/locations/{id}/deactivate", deactivateLocationHandler).Methods("POST")
+	router.HandleFunc("/locations/{id}/activate", activateLocationHandler).Methods("POST")
+	router.HandleFunc("/locations/{id}/contents", getLocationContentsHandler).Methods("GET")
+	router.HandleFunc("/locations/{id}/history", getLocationHistoryHandler).Methods("GET")
+	router.HandleFunc("/locations/{id}/move_contents", moveLocationContentsHandler).Methods("POST")
+	router.HandleFunc("/customer_warehouses", setCustomerWarehouseHandler).Methods("POST")
+	router.HandleFunc("/putaway_zone_rules", createPutawayZoneRuleHandler).Methods("POST")
+
+	router.HandleFunc("/labels/locations", getLocationLabelsHandler).Methods("GET")
+	router.HandleFunc("/labels/materials", getMaterialLabelsHandler).Methods("GET")
+	router.HandleFunc("/labels/incoming_materials", getIncomingLabelsHandler).Methods("GET")
+	router.HandleFunc("/scan/{code}", scanHandler).Methods("GET")
 
 	router.HandleFunc("/reports/transactions", getTransactionsReport).Methods("GET")
 	router.HandleFunc("/reports/balance", getBalanceReport).Methods("GET")
+	router.HandleFunc("/reports/shrinkage", getShrinkageReport).Methods("GET")
+	router.HandleFunc("/reports/occupancy", getOccupancyReport).Methods("GET")
 
 	router.HandleFunc("/import_data", importData).Methods("POST")
 
@@ -134,13 +226,24 @@ func createMaterialHandler(w http.ResponseWriter, r *http.Request) {
 			`"}`, http.StatusConflict)
 		return
 	}
+	material.Warnings = locationWarnings(db, material.LocationID)
 	json.NewEncoder(w).Encode(material)
 }
 
 func getMaterialsHandler(w http.ResponseWriter, r *http.Request) {
 	db, _ := connectToDB()
 	defer db.Close()
-	materials, err := getMaterials(db)
+	lotNumber := r.URL.Query().Get("lotNumber")
+	expiresBefore := r.URL.Query().Get("expiresBefore")
+	locationId, _ := strconv.Atoi(r.URL.Query().Get("locationId"))
+	stockId := r.URL.Query().Get("stockId")
+
+	materials, err := getMaterials(db, MaterialFilter{
+		lotNumber:     lotNumber,
+		expiresBefore: expiresBefore,
+		locationId:    locationId,
+		stockId:       stockId,
+	})
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -155,12 +258,24 @@ func moveMaterialHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 	var material MaterialJSON
 	json.NewDecoder(r.Body).Decode(&material)
-	err := moveMaterial(material, db)
+
+	// The move posts to several tables, so it either succeeds or leaves them all
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = moveMaterial(material, tx)
+	if err == nil {
+		err = tx.Commit()
+	}
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	material.Warnings = locationWarnings(db, material.LocationID)
 	json.NewEncoder(w).Encode(material)
 }
 
@@ -169,7 +284,17 @@ func removeMaterialHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 	var material MaterialToRemoveJSON
 	json.NewDecoder(r.Body).Decode(&material)
-	err := removeMaterial(material, db)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = removeMaterial(material, tx)
+	if err == nil {
+		err = tx.Commit()
+	}
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -178,77 +303,1416 @@ func removeMaterialHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(material)
 }
 
-func createWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+func moveMaterialsBatchHandler(w http.ResponseWriter, r *http.Request) {
 	db, _ := connectToDB()
 	defer db.Close()
+	var lines []MaterialJSON
+	json.NewDecoder(r.Body).Decode(&lines)
 
-	var warehouse WarehouseJSON
-	json.NewDecoder(r.Body).Decode(&warehouse)
-	err := createWarehouse(warehouse, db)
+	results, err := moveMaterialsBatch(db, lines)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+func removeMaterialsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var lines []MaterialToRemoveJSON
+	json.NewDecoder(r.Body).Decode(&lines)
+
+	results, err := removeMaterialsBatch(db, lines)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+func returnMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var ret ReturnJSON
+	json.NewDecoder(r.Body).Decode(&ret)
+	trxIds, err := returnMaterial(ret, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func adjustMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var adjustment AdjustmentJSON
+	json.NewDecoder(r.Body).Decode(&adjustment)
+	trxIds, err := adjustMaterial(adjustment, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func setAdjustmentReasonHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var reason AdjustmentReasonJSON
+	json.NewDecoder(r.Body).Decode(&reason)
+	err := setAdjustmentReason(reason, db)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(warehouse)
+	json.NewEncoder(w).Encode(reason)
 }
 
-func getAvailableLocationsHandler(w http.ResponseWriter, r *http.Request) {
+func getAdjustmentReasonsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	reasons, err := fetchAdjustmentReasons(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reasons)
+}
+
+func reverseTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	transactionId, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var reversal ReversalJSON
+	json.NewDecoder(r.Body).Decode(&reversal)
+	trxIds, err := reverseTransaction(transactionId, reversal, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func releaseMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var material MaterialStatusJSON
+	json.NewDecoder(r.Body).Decode(&material)
+	err := releaseMaterial(material, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(material)
+}
+
+func rejectMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var material MaterialStatusJSON
+	json.NewDecoder(r.Body).Decode(&material)
+	err := rejectMaterial(material, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(material)
+}
+
+func setStockProfileHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var profile StockProfileJSON
+	json.NewDecoder(r.Body).Decode(&profile)
+	err := setStockProfile(profile, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(profile)
+}
+
+func getStockProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	profiles, err := fetchStockProfiles(db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
+
+func getSerialHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	serialNumber := mux.Vars(r)["serialNumber"]
+
+	history, err := fetchSerialHistory(db, serialNumber)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func getStockAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
 	db, _ := connectToDB()
 	defer db.Close()
 	stockId := r.URL.Query().Get("stockId")
-	owner := r.URL.Query().Get("owner")
 
-	locations, _ := fetchAvailableLocations(db, LocationFilter{stockId: stockId, owner: owner})
-	json.NewEncoder(w).Encode(locations)
+	availability, err := fetchStockAvailabilities(db, stockId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(availability)
 }
 
-func getTransactionsReport(w http.ResponseWriter, r *http.Request) {
+func createReservationHandler(w http.ResponseWriter, r *http.Request) {
 	db, _ := connectToDB()
 	defer db.Close()
+	var reservation ReservationJSON
+	json.NewDecoder(r.Body).Decode(&reservation)
+	_, err := createReservation(reservation, db)
 
-	customerIdStr := r.URL.Query().Get("customerId")
-	customerId, _ := strconv.Atoi(customerIdStr)
-	materialType := r.URL.Query().Get("materialType")
-	dateFrom := r.URL.Query().Get("dateFrom")
-	dateTo := r.URL.Query().Get("dateTo")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func getReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	reservations, err := fetchReservations(db)
 
-	trxRep := TransactionReport{Report: Report{db: db}, trxFilter: SearchQuery{
-		customerId:   customerId,
-		materialType: materialType,
-		dateFrom:     dateFrom,
-		dateTo:       dateTo,
-	}}
-	trxReport, err := trxRep.getReportList()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservations)
+}
 
-	json.NewEncoder(w).Encode(trxReport)
+func deleteReservationHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	reservationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	err := deleteReservation(db, reservationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ResponseJSON{Message: "success"})
 }
 
-func getBalanceReport(w http.ResponseWriter, r *http.Request) {
+func generatePickListHandler(w http.ResponseWriter, r *http.Request) {
 	db, _ := connectToDB()
 	defer db.Close()
+	var request PickRequestJSON
+	json.NewDecoder(r.Body).Decode(&request)
 
-	customerIdStr := r.URL.Query().Get("customerId")
-	customerId, _ := strconv.Atoi(customerIdStr)
-	materialType := r.URL.Query().Get("materialType")
-	dateAsOf := r.URL.Query().Get("dateAsOf")
+	pickList, err := generatePickList(db, request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pickList)
+}
+
+func confirmPickListHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var confirm PickConfirmJSON
+	json.NewDecoder(r.Body).Decode(&confirm)
+
+	err := confirmPickList(db, confirm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(confirm)
+}
+
+func createJobHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var job JobJSON
+	json.NewDecoder(r.Body).Decode(&job)
+	jobId, err := createJob(job, db)
 
-	balanceRep := BalanceReport{Report: Report{db: db}, blcFilter: SearchQuery{
-		customerId:   customerId,
-		materialType: materialType,
-		dateAsOf:     dateAsOf,
-	}}
-	balanceReport, err := balanceRep.getReportList()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(balanceReport)
+	createdJob, err := fetchJob(db, jobId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createdJob)
+}
+
+func getJobsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	jobs, err := fetchJobs(db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	jobId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	job, err := fetchJob(db, jobId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func getJobAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	jobId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	availability, err := checkJobAvailability(db, jobId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(availability)
+}
+
+func consumeJobMaterialHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	jobId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var issue JobIssueJSON
+	json.NewDecoder(r.Body).Decode(&issue)
+	err := issueMaterialToJob(jobId, issue, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(issue)
+}
+
+func generateCountTasksHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var filter CountTaskFilterJSON
+	json.NewDecoder(r.Body).Decode(&filter)
+
+	tasks, err := generateCountTasks(filter, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+func getCountTasksHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	status := r.URL.Query().Get("status")
+
+	tasks, err := fetchCountTasks(db, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+func getCountTaskHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	taskId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	task, err := fetchCountTask(db, taskId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+func submitCountHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	taskId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var count CountSubmitJSON
+	json.NewDecoder(r.Body).Decode(&count)
+	if err := submitCount(taskId, count, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	task, err := fetchCountTask(db, taskId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+func approveCountHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	taskId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var approval CountApproveJSON
+	json.NewDecoder(r.Body).Decode(&approval)
+	trxIds, err := approveCount(taskId, approval, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func rejectCountHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	taskId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := rejectCount(taskId, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	task, err := fetchCountTask(db, taskId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+func reopenCountHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	taskId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := reopenCount(taskId, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	task, err := fetchCountTask(db, taskId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+func startInventoryEventHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var event InventoryEventJSON
+	json.NewDecoder(r.Body).Decode(&event)
+
+	eventId, err := startInventoryEvent(event, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	startedEvent, err := fetchInventoryEvent(db, eventId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(startedEvent)
+}
+
+func getInventoryEventsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	events, err := fetchInventoryEvents(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func getInventoryEventHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	eventId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	event, err := fetchInventoryEvent(db, eventId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+func submitInventoryCountHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	eventId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var count InventoryCountJSON
+	json.NewDecoder(r.Body).Decode(&count)
+	if err := submitInventoryCount(eventId, count, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	event, err := fetchInventoryEvent(db, eventId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+func getCountSheetHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	eventId, _ := strconv.Atoi(mux.Vars(r)["id"])
+	showExpected := r.URL.Query().Get("showExpected") == "true"
+
+	sheet, err := fetchCountSheet(db, eventId, showExpected)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := renderCountSheet(w, sheet); err != nil {
+		log.Println("Error count sheet: ", err)
+	}
+}
+
+func closeInventoryEventHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	eventId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var closing InventoryCloseJSON
+	json.NewDecoder(r.Body).Decode(&closing)
+	trxIds, err := closeInventoryEvent(eventId, closing, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func getInventoryReportHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	eventId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	report, err := fetchInventoryReport(db, eventId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func createKitHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var kit KitJSON
+	json.NewDecoder(r.Body).Decode(&kit)
+	kitId, err := createKit(kit, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	createdKit, err := fetchKit(db, kitId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createdKit)
+}
+
+func getKitsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	kits, err := fetchKits(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kits)
+}
+
+func getKitHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	kitId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	kit, err := fetchKit(db, kitId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kit)
+}
+
+func assembleKitHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	kitId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var assembly KitAssemblyJSON
+	json.NewDecoder(r.Body).Decode(&assembly)
+	trxIds, err := assembleKit(kitId, assembly, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func disassembleKitHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	kitId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var disassembly KitDisassemblyJSON
+	json.NewDecoder(r.Body).Decode(&disassembly)
+	trxIds, err := disassembleKit(kitId, disassembly, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func createShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var shipment ShipmentJSON
+	json.NewDecoder(r.Body).Decode(&shipment)
+	shipmentId, err := createShipment(shipment, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	createdShipment, err := fetchShipment(db, shipmentId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createdShipment)
+}
+
+func getShipmentsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	shipments, err := fetchShipments(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipments)
+}
+
+func getShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	shipmentId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	shipment, err := fetchShipment(db, shipmentId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
+}
+
+func pickShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	shipmentId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := pickShipment(shipmentId, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	shipment, err := fetchShipment(db, shipmentId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
+}
+
+func packShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	shipmentId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := packShipment(shipmentId, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	shipment, err := fetchShipment(db, shipmentId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
+}
+
+func shipShipmentHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	shipmentId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var ship ShipJSON
+	json.NewDecoder(r.Body).Decode(&ship)
+	trxIds, err := shipShipment(shipmentId, ship, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func getPackingSlipHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	shipmentId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	shipment, err := fetchShipment(db, shipmentId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := renderPackingSlip(w, shipment); err != nil {
+		log.Println("Error packing slip: ", err)
+	}
+}
+
+func createTransferHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var transfer TransferJSON
+	json.NewDecoder(r.Body).Decode(&transfer)
+	transferId, err := shipTransfer(transfer, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	createdTransfer, err := fetchTransfer(db, transferId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createdTransfer)
+}
+
+func getTransfersHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	transfers, err := fetchTransfers(db, r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfers)
+}
+
+func getTransferHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	transferId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	transfer, err := fetchTransfer(db, transferId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfer)
+}
+
+func receiveTransferHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	transferId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var receipt TransferReceiptJSON
+	json.NewDecoder(r.Body).Decode(&receipt)
+	trxIds, err := receiveTransfer(transferId, receipt, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trxIds)
+}
+
+func getInTransitReportHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	report, err := fetchInTransitReport(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func scanHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	result, err := resolveScan(db, mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func getLocationLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(r.URL.Query().Get("warehouseId"))
+	locationId, _ := strconv.Atoi(r.URL.Query().Get("locationId"))
+
+	labels, err := fetchLocationLabels(db, LabelFilter{warehouseId: warehouseId, locationId: locationId})
+	writeLabels(w, r, labels, err)
+}
+
+func getMaterialLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	materialId, _ := strconv.Atoi(r.URL.Query().Get("materialId"))
+	warehouseId, _ := strconv.Atoi(r.URL.Query().Get("warehouseId"))
+	locationId, _ := strconv.Atoi(r.URL.Query().Get("locationId"))
+
+	labels, err := fetchMaterialLabels(db, LabelFilter{
+		materialId:  materialId,
+		warehouseId: warehouseId,
+		locationId:  locationId,
+	})
+	writeLabels(w, r, labels, err)
+}
+
+func getIncomingLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	shippingId, _ := strconv.Atoi(r.URL.Query().Get("shippingId"))
+	customerId, _ := strconv.Atoi(r.URL.Query().Get("customerId"))
+
+	labels, err := fetchIncomingLabels(db, LabelFilter{shippingId: shippingId, customerId: customerId})
+	writeLabels(w, r, labels, err)
+}
+
+// Renders the labels in the format and barcode asked for
+func writeLabels(w http.ResponseWriter, r *http.Request, labels []label, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(labels) == 0 {
+		http.Error(w, "Nothing to label", http.StatusNotFound)
+		return
+	}
+
+	opts := LabelOptions{
+		format:    r.URL.Query().Get("format"),
+		symbology: r.URL.Query().Get("barcode"),
+	}
+	if err := validateLabelOptions(&opts); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if opts.format == labelZPL {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/pdf")
+	}
+	if err := renderLabels(w, labels, opts); err != nil {
+		log.Println("Error labels: ", err)
+	}
+}
+
+func createWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	var warehouse WarehouseJSON
+	json.NewDecoder(r.Body).Decode(&warehouse)
+	err := createWarehouse(warehouse, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(warehouse)
+}
+
+func getWarehousesHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	warehouses, err := fetchWarehouses(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouses)
+}
+
+func getWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	warehouse, err := fetchWarehouse(db, warehouseId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouse)
+}
+
+func updateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var warehouse WarehouseJSON
+	json.NewDecoder(r.Body).Decode(&warehouse)
+	if err := updateWarehouse(warehouseId, warehouse, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	respondWarehouse(w, db, warehouseId)
+}
+
+func deactivateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	setWarehouseActiveHandler(w, r, false)
+}
+
+func activateWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	setWarehouseActiveHandler(w, r, true)
+}
+
+func setWarehouseActiveHandler(w http.ResponseWriter, r *http.Request, isActive bool) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := setWarehouseActive(warehouseId, isActive, db); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	respondWarehouse(w, db, warehouseId)
+}
+
+func respondWarehouse(w http.ResponseWriter, db dbExecutor, warehouseId int) {
+	warehouse, err := fetchWarehouse(db, warehouseId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouse)
+}
+
+func deleteWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := deleteWarehouse(warehouseId, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(ResponseJSON{Message: "success"})
+}
+
+func getAvailableLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	stockId := r.URL.Query().Get("stockId")
+	customerId, _ := strconv.Atoi(r.URL.Query().Get("customerId"))
+	owner := r.URL.Query().Get("owner")
+	locationType := r.URL.Query().Get("locationType")
+
+	locations, _ := fetchAvailableLocations(db, LocationFilter{
+		stockId:      stockId,
+		customerId:   customerId,
+		owner:        owner,
+		locationType: locationType,
+	})
+	json.NewEncoder(w).Encode(locations)
+}
+
+func getLocationSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	shippingId := r.URL.Query().Get("shippingId")
+	quantity := r.URL.Query().Get("quantity")
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	suggestions, err := suggestLocations(db, SuggestionFilter{
+		shippingId: shippingId,
+		quantity:   quantity,
+		limit:      limit,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+func createLocationHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var location LocationJSON
+	json.NewDecoder(r.Body).Decode(&location)
+
+	locationId, err := createLocation(location, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	createdLocation, err := fetchLocation(db, locationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(createdLocation)
+}
+
+func createLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var pattern LocationPatternJSON
+	json.NewDecoder(r.Body).Decode(&pattern)
+
+	locations, err := createLocations(pattern, db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locations)
+}
+
+func getLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(r.URL.Query().Get("warehouseId"))
+	locationId, _ := strconv.Atoi(r.URL.Query().Get("locationId"))
+	level := r.URL.Query().Get("level")
+	locationType := r.URL.Query().Get("locationType")
+	active := r.URL.Query().Get("active")
+
+	locations, err := fetchLocations(db, LocationTreeFilter{
+		warehouseId:  warehouseId,
+		locationId:   locationId,
+		level:        level,
+		locationType: locationType,
+		active:       active,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locations)
+}
+
+func getLocationHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	locationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	location, err := fetchLocation(db, locationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(location)
+}
+
+func updateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	locationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var location LocationJSON
+	json.NewDecoder(r.Body).Decode(&location)
+	if err := updateLocation(locationId, location, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	respondLocation(w, db, locationId)
+}
+
+func getLocationContentsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	locationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+	asOf := r.URL.Query().Get("asOf")
+
+	contents, err := fetchLocationContents(db, locationId, asOf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contents)
+}
+
+func getLocationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	locationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	history, err := fetchLocationHistory(db, locationId, LocationHistoryFilter{
+		dateFrom: r.URL.Query().Get("dateFrom"),
+		dateTo:   r.URL.Query().Get("dateTo"),
+		stockId:  r.URL.Query().Get("stockId"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func moveLocationContentsHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	locationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var move LocationMoveJSON
+	json.NewDecoder(r.Body).Decode(&move)
+	results, err := moveLocationContents(locationId, move, db)
+
+	if err != nil && len(results) == 0 {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+func deactivateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	setLocationActiveHandler(w, r, false)
+}
+
+func activateLocationHandler(w http.ResponseWriter, r *http.Request) {
+	setLocationActiveHandler(w, r, true)
+}
+
+func setLocationActiveHandler(w http.ResponseWriter, r *http.Request, isActive bool) {
+	db, _ := connectToDB()
+	defer db.Close()
+	locationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := setLocationActive(locationId, isActive, db); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	respondLocation(w, db, locationId)
+}
+
+func respondLocation(w http.ResponseWriter, db dbExecutor, locationId int) {
+	location, err := fetchLocation(db, locationId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(location)
+}
+
+func deleteLocationHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	locationId, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	if err := deleteLocation(locationId, db); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(ResponseJSON{Message: "success"})
+}
+
+func getLocationUtilizationHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(r.URL.Query().Get("warehouseId"))
+	locationId, _ := strconv.Atoi(r.URL.Query().Get("locationId"))
+
+	utilization, err := fetchLocationUtilization(db, UtilizationFilter{
+		warehouseId: warehouseId,
+		locationId:  locationId,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(utilization)
+}
+
+func getWarehouseUtilizationHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	warehouseId, _ := strconv.Atoi(r.URL.Query().Get("warehouseId"))
+
+	utilization, err := fetchWarehouseUtilization(db, warehouseId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(utilization)
+}
+
+func setCustomerWarehouseHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var pref CustomerWarehouseJSON
+	json.NewDecoder(r.Body).Decode(&pref)
+	err := setCustomerWarehouse(pref, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(pref)
+}
+
+func createPutawayZoneRuleHandler(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+	var rule PutawayZoneRuleJSON
+	json.NewDecoder(r.Body).Decode(&rule)
+	err := createPutawayZoneRule(rule, db)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(rule)
+}
+
+func getTransactionsReport(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	customerIdStr := r.URL.Query().Get("customerId")
+	customerId, _ := strconv.Atoi(customerIdStr)
+	materialType := r.URL.Query().Get("materialType")
+	dateFrom := r.URL.Query().Get("dateFrom")
+	dateTo := r.URL.Query().Get("dateTo")
+	lotNumber := r.URL.Query().Get("lotNumber")
+	expiresBefore := r.URL.Query().Get("expiresBefore")
+	locationId, _ := strconv.Atoi(r.URL.Query().Get("locationId"))
+
+	trxRep := TransactionReport{Report: Report{db: db}, trxFilter: SearchQuery{
+		customerId:    customerId,
+		materialType:  materialType,
+		dateFrom:      dateFrom,
+		dateTo:        dateTo,
+		lotNumber:     lotNumber,
+		expiresBefore: expiresBefore,
+		locationId:    locationId,
+	}}
+	trxReport, err := trxRep.getReportList()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(trxReport)
+}
+
+func getBalanceReport(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	customerIdStr := r.URL.Query().Get("customerId")
+	customerId, _ := strconv.Atoi(customerIdStr)
+	materialType := r.URL.Query().Get("materialType")
+	dateAsOf := r.URL.Query().Get("dateAsOf")
+	lotNumber := r.URL.Query().Get("lotNumber")
+	expiresBefore := r.URL.Query().Get("expiresBefore")
+	locationId, _ := strconv.Atoi(r.URL.Query().Get("locationId"))
+	rollUpLevel := r.URL.Query().Get("rollUpLevel")
+
+	balanceRep := BalanceReport{Report: Report{db: db}, blcFilter: SearchQuery{
+		customerId:    customerId,
+		materialType:  materialType,
+		dateAsOf:      dateAsOf,
+		lotNumber:     lotNumber,
+		expiresBefore: expiresBefore,
+		locationId:    locationId,
+		rollUpLevel:   rollUpLevel,
+	}}
+	balanceReport, err := balanceRep.getReportList()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(balanceReport)
+}
+
+func getShrinkageReport(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	customerIdStr := r.URL.Query().Get("customerId")
+	customerId, _ := strconv.Atoi(customerIdStr)
+	dateFrom := r.URL.Query().Get("dateFrom")
+	dateTo := r.URL.Query().Get("dateTo")
+	reasonCode := r.URL.Query().Get("reasonCode")
+
+	shrinkageRep := ShrinkageReport{Report: Report{db: db}, shrFilter: SearchQuery{
+		customerId: customerId,
+		dateFrom:   dateFrom,
+		dateTo:     dateTo,
+		reasonCode: reasonCode,
+	}}
+	shrinkageReport, err := shrinkageRep.getReportList()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(shrinkageReport)
+}
+
+func getOccupancyReport(w http.ResponseWriter, r *http.Request) {
+	db, _ := connectToDB()
+	defer db.Close()
+
+	customerId, _ := strconv.Atoi(r.URL.Query().Get("customerId"))
+	warehouseId, _ := strconv.Atoi(r.URL.Query().Get("warehouseId"))
+	owner := r.URL.Query().Get("owner")
+
+	occupancyRep := OccupancyReport{Report: Report{db: db}, occFilter: SearchQuery{
+		customerId:  customerId,
+		warehouseId: warehouseId,
+		owner:       owner,
+	}}
+	occupancyReport, err := occupancyRep.getReportList()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(occupancyReport)
 }
 
 func importData(w http.ResponseWriter, r *http.Request) {
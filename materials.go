@@ -4,75 +4,134 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
-	"math"
 	"strconv"
-	"strings"
 	"time"
 )
 
+// Types of the log entries
+const (
+	trxReceipt     = "receipt"
+	trxMoveOut     = "move_out"
+	trxMoveIn      = "move_in"
+	trxRemoval     = "removal"
+	trxReturn      = "return"
+	trxReversal    = "reversal"
+	trxShipment    = "shipment"
+	trxAssembly    = "assembly"
+	trxDisassembly = "disassembly"
+	trxAdjustment  = "adjustment"
+)
+
+// Stock statuses of a material row.
+// Only available stock can be removed
+const (
+	statusAvailable   = "available"
+	statusQCHold      = "qc_hold"
+	statusQuarantined = "quarantined"
+	statusDamaged     = "damaged"
+)
+
+// Owners of the stock
+const (
+	ownerTag      = "Tag"
+	ownerCustomer = "Customer"
+)
+
 type IncomingMaterialJSON struct {
-	CustomerID   string `json:"customerId"`
-	StockID      string `json:"stockId"`
-	MaterialType string `json:"type"`
-	Qty          string `json:"quantity"`
-	Cost         string `json:"cost"`
-	MinQty       string `json:"minQuantity"`
-	MaxQty       string `json:"maxQuantity"`
-	Description  string `json:"description"`
-	Owner        string `json:"owner"`
-	IsActive     bool   `json:"isActive"`
+	CustomerID         string `json:"customerId"`
+	StockID            string `json:"stockId"`
+	MaterialType       string `json:"type"`
+	Qty                string `json:"quantity"`
+	Cost               string `json:"cost"`
+	MinQty             string `json:"minQuantity"`
+	MaxQty             string `json:"maxQuantity"`
+	Description        string `json:"description"`
+	Owner              string `json:"owner"`
+	IsActive           bool   `json:"isActive"`
+	RequiresInspection bool   `json:"requiresInspection"`
+	LotNumber          string `json:"lotNumber"`
+	ExpirationDate     string `json:"expirationDate"`
 }
 
 type IncomingMaterialDB struct {
-	ShippingID   string  `field:"shipping_id"`
-	CustomerName string  `field:"customer_name"`
-	CustomerID   int     `field:"customer_id"`
-	StockID      string  `field:"stock_id"`
-	Cost         float64 `field:"cost"`
-	Quantity     int     `field:"quantity"`
-	MinQty       int     `field:"min_required_quantity"`
-	MaxQty       int     `field:"max_required_quantity"`
-	Description  string  `field:"description"`
-	IsActive     bool    `field:"is_active"`
-	MaterialType string  `field:"material_type"`
-	Owner        string  `field:"owner"`
+	ShippingID         string  `field:"shipping_id"`
+	CustomerName       string  `field:"customer_name"`
+	CustomerID         int     `field:"customer_id"`
+	StockID            string  `field:"stock_id"`
+	Cost               float64 `field:"cost"`
+	Quantity           int     `field:"quantity"`
+	MinQty             int     `field:"min_required_quantity"`
+	MaxQty             int     `field:"max_required_quantity"`
+	Description        string  `field:"description"`
+	IsActive           bool    `field:"is_active"`
+	MaterialType       string  `field:"material_type"`
+	Owner              string  `field:"owner"`
+	RequiresInspection bool    `field:"requires_inspection"`
+	LotNumber          string  `field:"lot_number"`
+	ExpirationDate     string  `field:"expiration_date"`
+}
+
+type MaterialFilter struct {
+	lotNumber     string
+	expiresBefore string
+	locationId    int
+	stockId       string
+	materialId    int
 }
 
 // Create Material
 // Move Material
 type MaterialJSON struct {
-	MaterialID string `json:"materialId"`
-	LocationID string `json:"locationId"`
-	Qty        string `json:"quantity"`
-	Notes      string `json:"notes"`
+	MaterialID    string   `json:"materialId"`
+	LocationID    string   `json:"locationId"`
+	Qty           string   `json:"quantity"`
+	Notes         string   `json:"notes"`
+	SerialNumbers []string `json:"serialNumbers"`
+	Override      bool     `json:"override"`
+	Warnings      []string `json:"warnings,omitempty"`
 }
 
 // Remove Material
 type MaterialToRemoveJSON struct {
-	MaterialID string `json:"materialId"`
-	Qty        string `json:"quantity"`
-	JobTicket  string `json:"jobTicket"`
+	MaterialID    string   `json:"materialId"`
+	Qty           string   `json:"quantity"`
+	JobTicket     string   `json:"jobTicket"`
+	SerialNumbers []string `json:"serialNumbers"`
+	Override      bool     `json:"override"`
+}
+
+// Release or reject held material
+type MaterialStatusJSON struct {
+	MaterialID    string   `json:"materialId"`
+	Status        string   `json:"status"`
+	Notes         string   `json:"notes"`
+	Qty           string   `json:"quantity"` // the whole row when empty
+	SerialNumbers []string `json:"serialNumbers"`
 }
 
 type MaterialDB struct {
-	MaterialID    int       `field:"material_id"`
-	WarehouseName string    `field:"warehouse_name"`
-	StockID       string    `field:"stock_id"`
-	CustomerID    int       `field:"customer_id"`
-	CustomerName  string    `field:"customer_name"`
-	LocationID    int       `field:"location_id"`
-	LocationName  string    `field:"location_name"`
-	MaterialType  string    `field:"material_type"`
-	Description   string    `field:"description"`
-	Notes         string    `field:"notes"`
-	Quantity      int       `field:"quantity"`
-	UpdatedAt     time.Time `field:"updated_at"`
-	IsActive      bool      `field:"is_active"`
-	Cost          float64   `field:"cost"`
-	MinQty        int       `field:"min_required_quantity"`
-	MaxQty        int       `field:"max_required_quantity"`
-	Owner         string    `field:"onwer"`
+	MaterialID     int       `field:"material_id"`
+	WarehouseName  string    `field:"warehouse_name"`
+	StockID        string    `field:"stock_id"`
+	CustomerID     int       `field:"customer_id"`
+	CustomerName   string    `field:"customer_name"`
+	LocationID     int       `field:"location_id"`
+	LocationName   string    `field:"location_name"`
+	MaterialType   string    `field:"material_type"`
+	Description    string    `field:"description"`
+	Notes          string    `field:"notes"`
+	Quantity       int       `field:"quantity"`
+	UpdatedAt      time.Time `field:"updated_at"`
+	IsActive       bool      `field:"is_active"`
+	Cost           float64   `field:"cost"`
+	MinQty         int       `field:"min_required_quantity"`
+	MaxQty         int       `field:"max_required_quantity"`
+	Owner          string    `field:"onwer"`
+	Status         string    `field:"status"`
+	LotNumber      string    `field:"lot_number"`
+	ExpirationDate string    `field:"expiration_date"`
+	ReservedQty    int       `field:"reserved_quantity"`
+	AvailableQty   int       `field:"available_quantity"`
 }
 
 type TransactionInfo struct {
@@ -83,8 +142,18 @@ type TransactionInfo struct {
 	cost          float64   `field:"cost"`
 	updatedAt     time.Time `field:"updated_at"`
 	jobTicket     string    `field:"job_ticket"`
+	trxType       string    `field:"transaction_type"`
+	referenceId   int       `field:"reference_id"`
+	reasonCode    string    `field:"reason_code"`
 	isMove        bool      // opts
 	newMaterialId int       // opts
+	trxIds        []int     // result: log entries written
+}
+
+type costLayer struct {
+	transactionId int
+	cost          float64
+	remainingQty  int
 }
 
 func fetchMaterialTypes(db *sql.DB) ([]string, error) {
@@ -118,12 +187,14 @@ func sendMaterial(material IncomingMaterialJSON, db *sql.DB) error {
 				INSERT INTO incoming_materials
 					(customer_id, stock_id, cost, quantity,
 					max_required_quantity, min_required_quantity,
-					description, is_active, type, owner)
-				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)`,
+					description, is_active, type, owner, requires_inspection,
+					lot_number, expiration_date)
+				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,NULLIF($13, '')::DATE)`,
 		material.CustomerID, material.StockID, material.Cost,
 		qty, maxQty, minQty,
 		material.Description, material.IsActive, material.MaterialType,
-		material.Owner,
+		material.Owner, material.RequiresInspection,
+		material.LotNumber, material.ExpirationDate,
 	)
 
 	if err != nil {
@@ -135,7 +206,8 @@ func sendMaterial(material IncomingMaterialJSON, db *sql.DB) error {
 func getIncomingMaterials(db *sql.DB) ([]IncomingMaterialDB, error) {
 	rows, err := db.Query(`
 		SELECT shipping_id, c.name, c.customer_id, stock_id, cost, quantity,
-		min_required_quantity, max_required_quantity, description, is_active, type, owner
+		min_required_quantity, max_required_quantity, description, is_active, type, owner,
+		requires_inspection, lot_number, COALESCE(TO_CHAR(expiration_date, 'YYYY-MM-DD'), '')
 		FROM incoming_materials im
 		LEFT JOIN customers c ON c.customer_id = im.customer_id
 		`)
@@ -160,6 +232,9 @@ func getIncomingMaterials(db *sql.DB) ([]IncomingMaterialDB, error) {
 			&material.IsActive,
 			&material.MaterialType,
 			&material.Owner,
+			&material.RequiresInspection,
+			&material.LotNumber,
+			&material.ExpirationDate,
 		); err != nil {
 			return nil, fmt.Errorf("Error scanning row: %w", err)
 		}
@@ -168,18 +243,31 @@ func getIncomingMaterials(db *sql.DB) ([]IncomingMaterialDB, error) {
 	return materials, nil
 }
 
-func getMaterials(db *sql.DB) ([]MaterialDB, error) {
+func getMaterials(db *sql.DB, opts MaterialFilter) ([]MaterialDB, error) {
 	rows, err := db.Query(`
-		SELECT material_id, w.name as "warehouse_name",
+		WITH RECURSIVE `+locationAncestors+`
+		SELECT material_id, COALESCE(w.name, '') as "warehouse_name",
 		c.name as "customer_name", c.customer_id,
 		l.location_id, l.name as "location_name",
 		stock_id, cost, quantity, min_required_quantity, max_required_quantity,
-		m.description, notes, is_active, material_type, owner
+		m.description, notes, is_active, material_type, owner, status,
+		lot_number, COALESCE(TO_CHAR(expiration_date, 'YYYY-MM-DD'), ''),
+		(
+			SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+			WHERE r.material_id = m.material_id AND `+activeReservation+`
+		) AS "reserved_quantity"
 		FROM materials m
 		LEFT JOIN customers c ON c.customer_id = m.customer_id
 		LEFT JOIN locations l ON l.location_id = m.location_id
 		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
-		`)
+		WHERE
+			($1 = '' OR m.lot_number = $1) AND
+			($2 = '' OR m.expiration_date::TEXT <= $2) AND
+			($3 = 0 OR m.location_id IN (
+				SELECT location_id FROM location_ancestors WHERE ancestor_id = $3)) AND
+			($4 = '' OR m.stock_id = $4) AND
+			($5 = 0 OR m.material_id = $5)
+		`, opts.lotNumber, opts.expiresBefore, opts.locationId, opts.stockId, opts.materialId)
 	if err != nil {
 		return nil, fmt.Errorf("Error querying incoming materials: %w", err)
 	}
@@ -205,20 +293,35 @@ func getMaterials(db *sql.DB) ([]MaterialDB, error) {
 			&material.IsActive,
 			&material.MaterialType,
 			&material.Owner,
+			&material.Status,
+			&material.LotNumber,
+			&material.ExpirationDate,
+			&material.ReservedQty,
 		); err != nil {
 			return nil, fmt.Errorf("Error scanning row: %w", err)
 		}
+		if material.Status == statusAvailable {
+			material.AvailableQty = max(material.Quantity-material.ReservedQty, 0)
+		}
 		materials = append(materials, material)
 	}
 	return materials, nil
 }
 
+// The receipt is posted in one database transaction,
+// so nothing is left half received when a check fails
 func createMaterial(material MaterialJSON, db *sql.DB) error {
-	var incomingMaterial IncomingMaterialDB
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	err := db.QueryRow(`
+	var incomingMaterial IncomingMaterialDB
+	err = tx.QueryRow(`
 		SELECT customer_id, stock_id, cost, min_required_quantity,
-		max_required_quantity, description, is_active, type, owner
+		max_required_quantity, description, is_active, type, owner,
+		requires_inspection, lot_number, COALESCE(TO_CHAR(expiration_date, 'YYYY-MM-DD'), '')
 		FROM incoming_materials
 		WHERE shipping_id = $1`, material.MaterialID).
 		Scan(
@@ -231,21 +334,60 @@ func createMaterial(material MaterialJSON, db *sql.DB) error {
 			&incomingMaterial.IsActive,
 			&incomingMaterial.MaterialType,
 			&incomingMaterial.Owner,
+			&incomingMaterial.RequiresInspection,
+			&incomingMaterial.LotNumber,
+			&incomingMaterial.ExpirationDate,
 		)
 	if err != nil {
 		return err
 	}
 
-	// Update material in the current location
-	rows, err := db.Query(`
+	qty, _ := strconv.Atoi(material.Qty)
+
+	serialized, err := isSerializedStock(tx, incomingMaterial.StockID)
+	if err != nil {
+		return err
+	}
+	if serialized {
+		if err := validateSerials(material.SerialNumbers, qty); err != nil {
+			return err
+		}
+	}
+
+	locationId, _ := strconv.Atoi(material.LocationID)
+	if err := checkLocationActive(tx, locationId); err != nil {
+		return err
+	}
+	if err := checkWarehouseFrozen(tx, locationId); err != nil {
+		return err
+	}
+	if err := checkStorageRule(tx, locationId, incomingMaterial.StockID, incomingMaterial.CustomerID); err != nil {
+		return err
+	}
+	if err := checkCapacity(tx, locationId, incomingMaterial.StockID, qty); err != nil {
+		return err
+	}
+
+	// Materials to be inspected are put on hold until released
+	status := statusAvailable
+	if incomingMaterial.RequiresInspection {
+		status = statusQCHold
+	}
+
+	// Update material in the current location.
+	// Different lots of the same stock are kept apart
+	rows, err := tx.Query(`
 					UPDATE materials
 					SET quantity = (quantity + $1),
 						notes = $2
 					WHERE stock_id = $3
 						AND location_id = $4
 						AND owner = $5
+						AND status = $6
+						AND lot_number = $7
 					RETURNING material_id;
 					`, material.Qty, material.Notes, incomingMaterial.StockID, material.LocationID, incomingMaterial.Owner,
+		status, incomingMaterial.LotNumber,
 	)
 	if err != nil {
 		return err
@@ -263,7 +405,7 @@ func createMaterial(material MaterialJSON, db *sql.DB) error {
 	// If there is no the same material in the current location
 	// Then add the material in the chosen one
 	if materialId == 0 {
-		err := db.QueryRow(`
+		err := tx.QueryRow(`
 						INSERT INTO materials
 						(
 							stock_id,
@@ -278,9 +420,13 @@ func createMaterial(material MaterialJSON, db *sql.DB) error {
 							max_required_quantity,
 							is_active,
 							cost,
-							owner
+							owner,
+							status,
+							lot_number,
+							expiration_date
 						)
-						VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) RETURNING material_id;`,
+						VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,NULLIF($16, '')::DATE)
+						RETURNING material_id;`,
 			incomingMaterial.StockID,
 			material.LocationID,
 			incomingMaterial.CustomerID,
@@ -294,6 +440,9 @@ func createMaterial(material MaterialJSON, db *sql.DB) error {
 			incomingMaterial.IsActive,
 			incomingMaterial.Cost,
 			incomingMaterial.Owner,
+			status,
+			incomingMaterial.LotNumber,
+			incomingMaterial.ExpirationDate,
 		).Scan(&materialId)
 		if err != nil {
 			return err
@@ -302,12 +451,18 @@ func createMaterial(material MaterialJSON, db *sql.DB) error {
 
 	// Remove the material from incoming
 	shippingId, _ := strconv.Atoi(material.MaterialID)
-	err = deleteIncomingMaterial(db, shippingId)
+	err = deleteIncomingMaterial(tx, shippingId)
 	if err != nil {
 		return err
 	}
 
-	qty, _ := strconv.Atoi(material.Qty)
+	if serialized {
+		err = receiveSerials(tx, incomingMaterial.StockID, materialId, material.SerialNumbers, serialReceived, material.Notes)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = addTranscation(&TransactionInfo{
 		materialId: materialId,
 		stockId:    incomingMaterial.StockID,
@@ -315,15 +470,16 @@ func createMaterial(material MaterialJSON, db *sql.DB) error {
 		notes:      material.Notes,
 		updatedAt:  time.Now(),
 		cost:       incomingMaterial.Cost,
-	}, db)
+		trxType:    trxReceipt,
+	}, tx)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func deleteIncomingMaterial(db *sql.DB, shippingId int) error {
+func deleteIncomingMaterial(db dbExecutor, shippingId int) error {
 	if _, err := db.Exec(`
 			DELETE FROM incoming_materials WHERE shipping_id = $1;`,
 		shippingId); err != nil {
@@ -333,160 +489,162 @@ func deleteIncomingMaterial(db *sql.DB, shippingId int) error {
 	return nil
 }
 
-func addTranscation(trx *TransactionInfo, db *sql.DB) error {
-	if trx.quantity < 0 {
-		removingQty := int(math.Abs(float64(trx.quantity)))
-
-		emptyCost := []string{"0"}
-
-		for removingQty > 0 {
-			var transactionId int
-			var cost float64
-			var remainingQty int
-
-			// Find a last deduction
-			db.QueryRow(`
-				SELECT transaction_id, cost, remaining_quantity FROM transactions_log
-				WHERE material_id = $1 AND stock_id = $2 AND quantity_change < 0
-					AND cost NOT IN (`+strings.Join(emptyCost, ",")+`)
-				ORDER BY transaction_id DESC LIMIT 1;
-						`,
-				trx.materialId,
-				trx.stockId).Scan(&transactionId, &cost, &remainingQty)
-
-			// First deduction is NOT found
-			if transactionId == 0 {
-				db.QueryRow(`
-					SELECT transaction_id, cost, remaining_quantity FROM transactions_log
-					WHERE material_id = $1 AND stock_id = $2  AND quantity_change > 0
-						AND cost NOT IN (`+strings.Join(emptyCost, ",")+`)
-					ORDER BY transaction_id LIMIT 1;
-							`,
-					trx.materialId,
-					trx.stockId,
-				).Scan(&transactionId, &cost, &remainingQty)
-
-				// When neither positive nor negative calculations found
-				if transactionId == 0 {
-					return errors.New("no remains found")
-				}
-
-				// First deduction is found, but remains are zero
-			} else if transactionId != 0 && remainingQty == 0 {
-				emptyCost = append(emptyCost, strconv.FormatFloat(cost, 'f', -1, 64))
-				continue
-			}
+// Every positive entry which is not a restoration is a cost layer.
+// Its remaining quantity goes down as the stock is taken from it in FIFO order,
+// deductions keep the layer they were taken from
+func addTranscation(trx *TransactionInfo, db dbExecutor) error {
+	if trx.quantity > 0 {
+		return addLayer(trx, db)
+	}
 
-			// Deduct from the balance
-			if remainingQty < removingQty {
-				removingQty -= remainingQty
-
-				_, errInsert := db.Exec(
-					`INSERT INTO transactions_log
-							(material_id, stock_id, quantity_change, notes,
-							cost, job_ticket, updated_at, remaining_quantity)
-							 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-							 `, trx.materialId, trx.stockId, -remainingQty, trx.notes,
-					cost, trx.jobTicket, trx.updatedAt, 0)
-
-				if errInsert != nil {
-					log.Println("err1", errInsert)
-					return errInsert
-				}
-
-				emptyCost = append(emptyCost, strconv.FormatFloat(cost, 'f', -1, 64))
-
-				if trx.isMove {
-					addTranscation(&TransactionInfo{
-						materialId: trx.newMaterialId,
-						stockId:    trx.stockId,
-						quantity:   remainingQty,
-						notes:      trx.notes,
-						cost:       cost,
-						updatedAt:  trx.updatedAt,
-						jobTicket:  trx.jobTicket,
-					}, db)
-				}
-			} else if remainingQty >= removingQty {
-				remainingQty -= removingQty
-
-				_, errInsert := db.Exec(
-					`INSERT INTO transactions_log
-							(material_id, stock_id, quantity_change, notes,
-							cost, job_ticket, updated_at, remaining_quantity)
-							 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-							 `, trx.materialId, trx.stockId, -removingQty, trx.notes,
-					cost, trx.jobTicket, trx.updatedAt, remainingQty)
-
-				if errInsert != nil {
-					log.Println("err2", errInsert)
-					return errInsert
-				}
-
-				if trx.isMove {
-					addTranscation(&TransactionInfo{
-						materialId: trx.newMaterialId,
-						stockId:    trx.stockId,
-						quantity:   removingQty,
-						notes:      trx.notes,
-						cost:       cost,
-						updatedAt:  trx.updatedAt,
-						jobTicket:  trx.jobTicket,
-					}, db)
-				}
-
-				removingQty = 0
-			}
+	// Entries taken from further layers reference the first one,
+	// so the posting is reversed as a whole
+	referenceId := trx.referenceId
+	removingQty := -trx.quantity
+	for removingQty > 0 {
+		var layer costLayer
+		err := db.QueryRow(`
+			SELECT transaction_id, COALESCE(cost, 0), remaining_quantity FROM transactions_log
+			WHERE material_id = $1 AND stock_id = $2
+				AND quantity_change > 0 AND layer_id IS NULL
+				AND remaining_quantity > 0
+			ORDER BY transaction_id LIMIT 1;`,
+			trx.materialId, trx.stockId,
+		).Scan(&layer.transactionId, &layer.cost, &layer.remainingQty)
+		if err == sql.ErrNoRows {
+			return errors.New("no remains found")
 		}
-	} else {
-		// Check if an ID with the same cost exists
-		var transactionId int
-		db.QueryRow(`
-				SELECT transaction_id FROM transactions_log
-				WHERE
-					material_id = $1 AND
-					stock_id = $2 AND
-					quantity_change > 0 AND
-					cost = $3
-				ORDER BY transaction_id DESC LIMIT 1;
-						`,
-			trx.materialId, trx.stockId, trx.cost).Scan(&transactionId)
-
-		// If the ID exists then update it
-		if transactionId > 0 {
-			_, e := db.Query(`
-				UPDATE transactions_log
-				SET quantity_change = quantity_change + $2,
-					remaining_quantity = remaining_quantity + $2,
-					updated_at = NOW()
-				WHERE transaction_id = $1
-
-		`, transactionId, trx.quantity)
-
-			if e != nil {
-				return e
-			}
-		} else {
-			// If an ID doesn't exist then add a new one
-			_, e := db.Exec(
-				`INSERT INTO transactions_log
-			(material_id, stock_id, quantity_change, notes,
-			cost, job_ticket, updated_at, remaining_quantity)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			 `, trx.materialId, trx.stockId, trx.quantity, trx.notes,
-				trx.cost, trx.jobTicket, trx.updatedAt, trx.quantity)
-
-			if e != nil {
-				return e
-			}
+		if err != nil {
+			return err
+		}
+
+		deductingQty := min(layer.remainingQty, removingQty)
+		first := len(trx.trxIds)
+		if err := deductLayer(trx, layer, deductingQty, db); err != nil {
+			return err
+		}
+		if trx.referenceId == 0 {
+			trx.referenceId = trx.trxIds[first]
+		}
+		removingQty -= deductingQty
+	}
+	trx.referenceId = referenceId
+
+	return nil
+}
+
+func addLayer(trx *TransactionInfo, db dbExecutor) error {
+	var transactionId int
+	err := db.QueryRow(`
+		INSERT INTO transactions_log
+			(material_id, stock_id, quantity_change, notes, cost, job_ticket,
+			updated_at, remaining_quantity, transaction_type, reference_id, reason_code)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $3, $8, NULLIF($9, 0), NULLIF($10, ''))
+		RETURNING transaction_id;`,
+		trx.materialId, trx.stockId, trx.quantity, trx.notes, trx.cost, trx.jobTicket,
+		trx.updatedAt, trx.trxType, trx.referenceId, trx.reasonCode,
+	).Scan(&transactionId)
+	if err != nil {
+		return err
+	}
+	trx.trxIds = append(trx.trxIds, transactionId)
+
+	return nil
+}
+
+// Takes the quantity from the layer.
+// Moved stock becomes a new layer of the destination material at the same cost
+func deductLayer(trx *TransactionInfo, layer costLayer, quantity int, db dbExecutor) error {
+	if layer.remainingQty < quantity {
+		return errors.New(`Only ` + strconv.Itoa(layer.remainingQty) +
+			` remain in the cost layer ` + strconv.Itoa(layer.transactionId))
+	}
+
+	_, err := db.Exec(`
+		UPDATE transactions_log SET remaining_quantity = remaining_quantity - $1
+		WHERE transaction_id = $2;`,
+		quantity, layer.transactionId)
+	if err != nil {
+		return err
+	}
+
+	var insertedId int
+	err = db.QueryRow(`
+		INSERT INTO transactions_log
+			(material_id, stock_id, quantity_change, notes, cost, job_ticket,
+			updated_at, remaining_quantity, transaction_type, layer_id, reference_id, reason_code)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, 0), NULLIF($12, ''))
+		RETURNING transaction_id;`,
+		trx.materialId, trx.stockId, -quantity, trx.notes, layer.cost, trx.jobTicket,
+		trx.updatedAt, layer.remainingQty-quantity, trx.trxType, layer.transactionId, trx.referenceId,
+		trx.reasonCode,
+	).Scan(&insertedId)
+	if err != nil {
+		return err
+	}
+	trx.trxIds = append(trx.trxIds, insertedId)
+
+	if trx.isMove {
+		moveIn := &TransactionInfo{
+			materialId:  trx.newMaterialId,
+			stockId:     trx.stockId,
+			quantity:    quantity,
+			notes:       trx.notes,
+			cost:        layer.cost,
+			updatedAt:   trx.updatedAt,
+			jobTicket:   trx.jobTicket,
+			trxType:     trxMoveIn,
+			referenceId: insertedId,
+		}
+		if err := addLayer(moveIn, db); err != nil {
+			return err
 		}
+		trx.trxIds = append(trx.trxIds, moveIn.trxIds...)
 	}
+
 	return nil
 }
 
-func getMaterialById(materialId int, db *sql.DB) (MaterialDB, error) {
+// Puts the quantity back to the layer it was taken from
+func restoreLayer(trx *TransactionInfo, layerId int, db dbExecutor) error {
+	var layer costLayer
+	err := db.QueryRow(`
+		UPDATE transactions_log SET remaining_quantity = remaining_quantity + $1
+		WHERE transaction_id = $2
+		RETURNING transaction_id, COALESCE(cost, 0), remaining_quantity;`,
+		trx.quantity, layerId,
+	).Scan(&layer.transactionId, &layer.cost, &layer.remainingQty)
+	if err != nil {
+		return err
+	}
+
+	var insertedId int
+	err = db.QueryRow(`
+		INSERT INTO transactions_log
+			(material_id, stock_id, quantity_change, notes, cost, job_ticket,
+			updated_at, remaining_quantity, transaction_type, layer_id, reference_id, reason_code)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, 0), NULLIF($12, ''))
+		RETURNING transaction_id;`,
+		trx.materialId, trx.stockId, trx.quantity, trx.notes, layer.cost, trx.jobTicket,
+		trx.updatedAt, layer.remainingQty, trx.trxType, layer.transactionId, trx.referenceId,
+		trx.reasonCode,
+	).Scan(&insertedId)
+	if err != nil {
+		return err
+	}
+	trx.trxIds = append(trx.trxIds, insertedId)
+
+	return nil
+}
+
+func getMaterialById(materialId int, db dbExecutor) (MaterialDB, error) {
 	var currMaterial MaterialDB
-	err := db.QueryRow(`SELECT * FROM materials WHERE material_id = $1`, materialId).
+	err := db.QueryRow(`
+		SELECT material_id, stock_id, location_id, customer_id, material_type,
+			description, notes, quantity, cost, min_required_quantity,
+			max_required_quantity, updated_at, is_active, owner, status,
+			lot_number, COALESCE(TO_CHAR(expiration_date, 'YYYY-MM-DD'), '')
+		FROM materials WHERE material_id = $1`, materialId).
 		Scan(
 			&currMaterial.MaterialID,
 			&currMaterial.StockID,
@@ -502,6 +660,9 @@ func getMaterialById(materialId int, db *sql.DB) (MaterialDB, error) {
 			&currMaterial.UpdatedAt,
 			&currMaterial.IsActive,
 			&currMaterial.Owner,
+			&currMaterial.Status,
+			&currMaterial.LotNumber,
+			&currMaterial.ExpirationDate,
 		)
 	if err != nil {
 		return MaterialDB{}, err
@@ -510,11 +671,28 @@ func getMaterialById(materialId int, db *sql.DB) (MaterialDB, error) {
 	return currMaterial, nil
 }
 
-func moveMaterial(material MaterialJSON, db *sql.DB) error {
+// Stock in transit is moved only by its transfer
+func moveMaterial(material MaterialJSON, db dbExecutor) ([]int, error) {
 	materialId, _ := strconv.Atoi(material.MaterialID)
 	currMaterial, err := getMaterialById(materialId, db)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	locationId, _ := strconv.Atoi(material.LocationID)
+	for _, id := range []int{currMaterial.LocationID, locationId} {
+		if err := checkNotInTransit(db, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return moveStock(material, db)
+}
+
+func moveStock(material MaterialJSON, db dbExecutor) ([]int, error) {
+	materialId, _ := strconv.Atoi(material.MaterialID)
+	currMaterial, err := getMaterialById(materialId, db)
+	if err != nil {
+		return nil, err
 	}
 
 	newLocationId := material.LocationID
@@ -526,12 +704,53 @@ func moveMaterial(material MaterialJSON, db *sql.DB) error {
 	stockId := currMaterial.StockID
 	owner := currMaterial.Owner
 
+	if quantity <= 0 {
+		return nil, errors.New("Quantity must be positive")
+	}
+
+	locationId, _ := strconv.Atoi(newLocationId)
+	for _, id := range []int{currentLocationId, locationId} {
+		if err := checkWarehouseFrozen(db, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkLocationActive(db, locationId); err != nil {
+		return nil, err
+	}
+	if err := checkStorageRule(db, locationId, stockId, currMaterial.CustomerID); err != nil {
+		return nil, err
+	}
+	if locationId != currentLocationId {
+		if err := checkCapacity(db, locationId, stockId, quantity); err != nil {
+			return nil, err
+		}
+	}
+
 	// Check whether remaining quantity exists
 	if actualQuantity < quantity {
-		return errors.New(
+		return nil, errors.New(
 			`The moving quantity (` + strconv.Itoa(quantity) + `) is more than the actual one (` + strconv.Itoa(actualQuantity) + `)`)
 	}
 
+	if !material.Override {
+		if err := checkReservations(db, currMaterial, quantity, "", true); err != nil {
+			return nil, err
+		}
+	}
+
+	serialized, err := isSerializedStock(db, stockId)
+	if err != nil {
+		return nil, err
+	}
+	if serialized {
+		if err := validateSerials(material.SerialNumbers, quantity); err != nil {
+			return nil, err
+		}
+		if err := checkSerialsInMaterial(db, currMaterialId, material.SerialNumbers); err != nil {
+			return nil, err
+		}
+	}
+
 	// Update material in the current location
 	err = db.QueryRow(`
 			UPDATE materials
@@ -540,7 +759,8 @@ func moveMaterial(material MaterialJSON, db *sql.DB) error {
 			WHERE material_id = $3 AND location_id = $4
 			RETURNING material_id, stock_id, location_id, customer_id, material_type,
 					description, notes, quantity, updated_at, is_active, cost,
-					min_required_quantity, max_required_quantity, owner;
+					min_required_quantity, max_required_quantity, owner, status,
+					lot_number, COALESCE(TO_CHAR(expiration_date, 'YYYY-MM-DD'), '');
 			`, quantity, notes, currMaterialId, currentLocationId,
 	).Scan(
 		&currMaterial.MaterialID,
@@ -557,9 +777,12 @@ func moveMaterial(material MaterialJSON, db *sql.DB) error {
 		&currMaterial.MinQty,
 		&currMaterial.MaxQty,
 		&currMaterial.Owner,
+		&currMaterial.Status,
+		&currMaterial.LotNumber,
+		&currMaterial.ExpirationDate,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Update material in the new location
@@ -569,19 +792,22 @@ func moveMaterial(material MaterialJSON, db *sql.DB) error {
 		WHERE
 			stock_id = $2 AND
 			location_id = $3 AND
-			owner = $4
+			owner = $4 AND
+			status = $5 AND
+			lot_number = $6
 		RETURNING material_id;
-			`, quantity, stockId, newLocationId, owner,
+			`, quantity, stockId, newLocationId, owner, currMaterial.Status,
+		currMaterial.LotNumber,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var newMaterialId int
 	for rows.Next() {
 		err := rows.Scan(&newMaterialId)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -592,41 +818,104 @@ func moveMaterial(material MaterialJSON, db *sql.DB) error {
 			INSERT INTO materials
 				(stock_id, location_id,
 				customer_id, material_type, description, notes, quantity, updated_at,
-				cost, is_active, min_required_quantity, max_required_quantity, owner)
-				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13)
+				cost, is_active, min_required_quantity, max_required_quantity, owner, status,
+				lot_number, expiration_date)
+				VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,NULLIF($16, '')::DATE)
 				RETURNING material_id;`,
 			stockId, newLocationId,
 			currMaterial.CustomerID, currMaterial.MaterialType, currMaterial.Description,
 			currMaterial.Notes, quantity, time.Now(), currMaterial.Cost, currMaterial.IsActive,
-			currMaterial.MinQty, currMaterial.MaxQty, currMaterial.Owner).
+			currMaterial.MinQty, currMaterial.MaxQty, currMaterial.Owner, currMaterial.Status,
+			currMaterial.LotNumber, currMaterial.ExpirationDate).
 			Scan(&newMaterialId)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	err = addTranscation(&TransactionInfo{
+	if serialized {
+		err = moveSerials(db, currMaterialId, newMaterialId, material.SerialNumbers, notes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	trx := &TransactionInfo{
 		materialId:    currMaterial.MaterialID,
 		stockId:       stockId,
 		quantity:      -quantity,
 		notes:         notes,
 		cost:          currMaterial.Cost,
 		updatedAt:     time.Now(),
+		trxType:       trxMoveOut,
 		isMove:        true,
 		newMaterialId: newMaterialId,
-	}, db)
+	}
+	err = addTranscation(trx, db)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return trx.trxIds, nil
 }
 
-func removeMaterial(material MaterialToRemoveJSON, db *sql.DB) error {
+// Finds the row of the same stock, owner, status and lot in the location
+// or adds an empty one for it
+func findOrCreateMaterial(db dbExecutor, template MaterialDB, locationId int) (int, error) {
+	var materialId int
+	err := db.QueryRow(`
+		SELECT material_id FROM materials
+		WHERE
+			stock_id = $1 AND
+			location_id = $2 AND
+			owner = $3 AND
+			status = $4 AND
+			lot_number = $5
+		LIMIT 1;`,
+		template.StockID, locationId, template.Owner, template.Status, template.LotNumber,
+	).Scan(&materialId)
+	if err != sql.ErrNoRows {
+		return materialId, err
+	}
+
+	if err := checkLocationActive(db, locationId); err != nil {
+		return 0, err
+	}
+	if err := checkStorageRule(db, locationId, template.StockID, template.CustomerID); err != nil {
+		return 0, err
+	}
+
+	err = db.QueryRow(`
+		INSERT INTO materials
+			(stock_id, location_id,
+			customer_id, material_type, description, notes, quantity, updated_at,
+			cost, is_active, min_required_quantity, max_required_quantity, owner, status,
+			lot_number, expiration_date)
+			VALUES ($1,$2,$3,$4,$5,$6,0,$7,$8,$9,$10,$11,$12,$13,$14,NULLIF($15, '')::DATE)
+			RETURNING material_id;`,
+		template.StockID, locationId,
+		template.CustomerID, template.MaterialType, template.Description,
+		template.Notes, time.Now(), template.Cost, template.IsActive,
+		template.MinQty, template.MaxQty, template.Owner, template.Status,
+		template.LotNumber, template.ExpirationDate).
+		Scan(&materialId)
+	if err != nil {
+		return 0, err
+	}
+
+	return materialId, nil
+}
+
+func removeMaterial(material MaterialToRemoveJSON, db dbExecutor) ([]int, error) {
+	return removeMaterialAs(material, trxRemoval, db)
+}
+
+// Stock leaving the warehouse is logged with the type of the operation
+func removeMaterialAs(material MaterialToRemoveJSON, trxType string, db dbExecutor) ([]int, error) {
 	materialId, _ := strconv.Atoi(material.MaterialID)
 	currMaterial, err := getMaterialById(materialId, db)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	quantity, _ := strconv.Atoi(material.Qty)
@@ -635,8 +924,46 @@ func removeMaterial(material MaterialToRemoveJSON, db *sql.DB) error {
 	notes := currMaterial.Notes
 	jobTicket := material.JobTicket
 
+	if quantity <= 0 {
+		return nil, errors.New("Quantity must be positive")
+	}
+
+	if currMaterial.Status != statusAvailable {
+		return nil, errors.New(`The material is not available for removal (status: ` + currMaterial.Status + `)`)
+	}
+
+	if err := checkWarehouseFrozen(db, currMaterial.LocationID); err != nil {
+		return nil, err
+	}
+	if err := checkNotInTransit(db, currMaterial.LocationID); err != nil {
+		return nil, err
+	}
+
 	if actualQuantity < quantity {
-		return errors.New(`The removing quantity (` + strconv.Itoa(quantity) + `) is more than the actual one (` + strconv.Itoa(actualQuantity) + `)`)
+		return nil, errors.New(`The removing quantity (` + strconv.Itoa(quantity) + `) is more than the actual one (` + strconv.Itoa(actualQuantity) + `)`)
+	}
+
+	if err := validateJobIssue(db, jobTicket, stockId, quantity); err != nil {
+		return nil, err
+	}
+
+	if !material.Override {
+		if err := checkReservations(db, currMaterial, quantity, jobTicket, false); err != nil {
+			return nil, err
+		}
+	}
+
+	serialized, err := isSerializedStock(db, stockId)
+	if err != nil {
+		return nil, err
+	}
+	if serialized {
+		if err := validateSerials(material.SerialNumbers, quantity); err != nil {
+			return nil, err
+		}
+		if err := checkSerialsInMaterial(db, materialId, material.SerialNumbers); err != nil {
+			return nil, err
+		}
 	}
 
 	// Update the material quantity
@@ -648,20 +975,172 @@ func removeMaterial(material MaterialToRemoveJSON, db *sql.DB) error {
 	)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = addTranscation(&TransactionInfo{
+	if serialized {
+		err = consumeSerials(db, materialId, material.SerialNumbers, serialConsumed, jobTicket, notes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = consumeReservations(db, jobTicket, currMaterial, quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	trx := &TransactionInfo{
 		materialId: materialId,
 		stockId:    stockId,
 		quantity:   -quantity,
 		notes:      notes,
 		jobTicket:  jobTicket,
 		updatedAt:  time.Now(),
-	}, db)
+		trxType:    trxType,
+	}
+	err = addTranscation(trx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return trx.trxIds, nil
+}
+
+// Releases held material to available stock
+func releaseMaterial(material MaterialStatusJSON, db *sql.DB) error {
+	return changeMaterialStatus(material, statusAvailable,
+		[]string{statusQCHold, statusQuarantined}, db)
+}
+
+// Rejects held material. It is quarantined unless marked as damaged
+func rejectMaterial(material MaterialStatusJSON, db *sql.DB) error {
+	status := material.Status
+	if status == "" {
+		status = statusQuarantined
+	}
+	if status != statusQuarantined && status != statusDamaged {
+		return errors.New(`The material can only be rejected as ` + statusQuarantined + ` or ` + statusDamaged)
+	}
+
+	return changeMaterialStatus(material, status, []string{statusQCHold}, db)
+}
+
+// The quantity goes to the row of the new status in the same location, so a row
+// keeps its status and its log entries stay under the status they were posted in
+func changeMaterialStatus(material MaterialStatusJSON, status string, allowedFrom []string, db *sql.DB) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	materialId, _ := strconv.Atoi(material.MaterialID)
+	currMaterial, err := getMaterialById(materialId, tx)
+	if err != nil {
+		return err
+	}
+
+	allowed := false
+	for _, from := range allowedFrom {
+		if currMaterial.Status == from {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return errors.New(`The material status cannot be changed from ` + currMaterial.Status + ` to ` + status)
+	}
+
+	quantity := currMaterial.Quantity
+	if material.Qty != "" {
+		quantity, _ = strconv.Atoi(material.Qty)
+	}
+	if quantity <= 0 || quantity > currMaterial.Quantity {
+		return errors.New(`The quantity must be from 1 to ` + strconv.Itoa(currMaterial.Quantity))
+	}
+	if err := checkWarehouseFrozen(tx, currMaterial.LocationID); err != nil {
+		return err
+	}
+	if err := checkNotInTransit(tx, currMaterial.LocationID); err != nil {
+		return err
+	}
+
+	notes := currMaterial.Notes
+	if material.Notes != "" {
+		notes = material.Notes
+	}
+
+	serials := material.SerialNumbers
+	serialized, err := isSerializedStock(tx, currMaterial.StockID)
+	if err != nil {
+		return err
+	}
+	if serialized {
+		if len(serials) == 0 && quantity == currMaterial.Quantity {
+			serials, err = materialSerials(tx, materialId)
+			if err != nil {
+				return err
+			}
+		}
+		if err := validateSerials(serials, quantity); err != nil {
+			return err
+		}
+		if err := checkSerialsInMaterial(tx, materialId, serials); err != nil {
+			return err
+		}
+	}
+
+	template := currMaterial
+	template.Status = status
+	template.Notes = notes
+	newMaterialId, err := findOrCreateMaterial(tx, template, currMaterial.LocationID)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range []struct {
+		materialId int
+		quantity   int
+	}{{materialId, -quantity}, {newMaterialId, quantity}} {
+		_, err = tx.Exec(`
+			UPDATE materials SET quantity = quantity + $1, notes = $2
+			WHERE material_id = $3;`,
+			change.quantity, notes, change.materialId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if serialized {
+		if err := moveSerials(tx, materialId, newMaterialId, serials, notes); err != nil {
+			return err
+		}
+	}
+
+	// Reservations follow the row when all of it changes status
+	if quantity == currMaterial.Quantity {
+		_, err = tx.Exec(`
+			UPDATE reservations SET material_id = $1 WHERE material_id = $2;`,
+			newMaterialId, materialId)
+		if err != nil {
+			return err
+		}
+	}
+
+	trx := &TransactionInfo{
+		materialId:    materialId,
+		stockId:       currMaterial.StockID,
+		quantity:      -quantity,
+		notes:         notes,
+		cost:          currMaterial.Cost,
+		updatedAt:     time.Now(),
+		trxType:       trxMoveOut,
+		isMove:        true,
+		newMaterialId: newMaterialId,
+	}
+	if err := addTranscation(trx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
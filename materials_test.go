@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The tests run on a database given by TEST_DATABASE_URL. The schema in
+// db.sql is recreated in it, so it must be one kept for testing
+func openTestDB(t *testing.T) *sql.DB {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := os.ReadFile("db.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The database itself is made by whoever runs the tests
+	_, err = db.Exec(strings.Replace(string(schema), "CREATE DATABASE tag_db;", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func createTestLocation(t *testing.T, db *sql.DB) int {
+	var warehouseId, locationId int
+	err := db.QueryRow(`
+		INSERT INTO warehouses (name) VALUES ('Main') RETURNING warehouse_id;`).
+		Scan(&warehouseId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(`
+		INSERT INTO locations (name, warehouse_id) VALUES ('A-01', $1) RETURNING location_id;`,
+		warehouseId).Scan(&locationId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO customers (name) VALUES ('Acme');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return locationId
+}
+
+// Receives the stock at the cost and returns the material row it went to.
+// Serialized stock is received with its serials
+func receiveTestStock(t *testing.T, db *sql.DB, locationId int, quantity int, cost string, serials ...string) int {
+	var shippingId int
+	err := db.QueryRow(`
+		INSERT INTO incoming_materials (customer_id, stock_id, cost, quantity, is_active, type, owner)
+		VALUES ((SELECT customer_id FROM customers WHERE name = 'Acme'), 'STK-1', $1, $2, TRUE, 'LABELS', 'Customer')
+		RETURNING shipping_id;`,
+		cost, quantity).Scan(&shippingId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = createMaterial(MaterialJSON{
+		MaterialID:    strconv.Itoa(shippingId),
+		LocationID:    strconv.Itoa(locationId),
+		Qty:           strconv.Itoa(quantity),
+		SerialNumbers: serials,
+	}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var materialId int
+	err = db.QueryRow(`
+		SELECT material_id FROM materials WHERE stock_id = 'STK-1' AND location_id = $1;`,
+		locationId).Scan(&materialId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return materialId
+}
+
+func layerRemainders(t *testing.T, db *sql.DB, materialId int) []int {
+	rows, err := db.Query(`
+		SELECT remaining_quantity FROM transactions_log
+		WHERE material_id = $1 AND quantity_change > 0 AND layer_id IS NULL
+		ORDER BY transaction_id;`,
+		materialId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	remainders := []int{}
+	for rows.Next() {
+		var remaining int
+		if err := rows.Scan(&remaining); err != nil {
+			t.Fatal(err)
+		}
+		remainders = append(remainders, remaining)
+	}
+	return remainders
+}
+
+// Costs of the deductions posted by the transactions, in their order
+func deductedCosts(t *testing.T, db *sql.DB, trxIds []int) []string {
+	costs := []string{}
+	for _, trxId := range trxIds {
+		var quantity int
+		var cost float64
+		err := db.QueryRow(`
+			SELECT -quantity_change, cost FROM transactions_log WHERE transaction_id = $1;`,
+			trxId).Scan(&quantity, &cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		costs = append(costs, strconv.Itoa(quantity)+"@"+strconv.FormatFloat(cost, 'f', 2, 64))
+	}
+	return costs
+}
+
+func TestReceiveRemoveReturn(t *testing.T) {
+	db := openTestDB(t)
+	locationId := createTestLocation(t, db)
+
+	materialId := receiveTestStock(t, db, locationId, 10, "1.00")
+	if receiveTestStock(t, db, locationId, 5, "2.00") != materialId {
+		t.Fatal("The second receipt went to another row")
+	}
+	if got := layerRemainders(t, db, materialId); !reflect.DeepEqual(got, []int{10, 5}) {
+		t.Fatalf("layers after receipts = %v, want [10 5]", got)
+	}
+
+	trxIds, err := removeMaterial(MaterialToRemoveJSON{MaterialID: strconv.Itoa(materialId), Qty: "12"}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deductedCosts(t, db, trxIds); !reflect.DeepEqual(got, []string{"10@1.00", "2@2.00"}) {
+		t.Fatalf("removal = %v, want [10@1.00 2@2.00]", got)
+	}
+	if got := layerRemainders(t, db, materialId); !reflect.DeepEqual(got, []int{0, 3}) {
+		t.Fatalf("layers after removal = %v, want [0 3]", got)
+	}
+
+	// Each deduction is returned into the layer it came from
+	_, err = returnMaterial(ReturnJSON{TransactionID: strconv.Itoa(trxIds[1]), Qty: "2"}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = returnMaterial(ReturnJSON{TransactionID: strconv.Itoa(trxIds[0]), Qty: "4"}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := layerRemainders(t, db, materialId); !reflect.DeepEqual(got, []int{4, 5}) {
+		t.Fatalf("layers after returns = %v, want [4 5]", got)
+	}
+
+	var quantity int
+	var value float64
+	err = db.QueryRow(`
+		SELECT m.quantity, (SELECT SUM(quantity_change * cost) FROM transactions_log WHERE material_id = $1)
+		FROM materials m WHERE m.material_id = $1;`,
+		materialId).Scan(&quantity, &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quantity != 9 || value != 14 {
+		t.Fatalf("quantity %d valued at %v, want 9 valued at 14", quantity, value)
+	}
+}
+
+func TestDeductionAcrossLayers(t *testing.T) {
+	db := openTestDB(t)
+	locationId := createTestLocation(t, db)
+
+	materialId := receiveTestStock(t, db, locationId, 3, "1.00")
+	receiveTestStock(t, db, locationId, 4, "2.00")
+	receiveTestStock(t, db, locationId, 5, "3.00")
+
+	trxIds, err := removeMaterial(MaterialToRemoveJSON{MaterialID: strconv.Itoa(materialId), Qty: "9"}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deductedCosts(t, db, trxIds); !reflect.DeepEqual(got, []string{"3@1.00", "4@2.00", "2@3.00"}) {
+		t.Fatalf("removal = %v, want [3@1.00 4@2.00 2@3.00]", got)
+	}
+	if got := layerRemainders(t, db, materialId); !reflect.DeepEqual(got, []int{0, 0, 3}) {
+		t.Fatalf("layers after removal = %v, want [0 0 3]", got)
+	}
+
+	trxIds, err = removeMaterial(MaterialToRemoveJSON{MaterialID: strconv.Itoa(materialId), Qty: "3"}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deductedCosts(t, db, trxIds); !reflect.DeepEqual(got, []string{"3@3.00"}) {
+		t.Fatalf("removal = %v, want [3@3.00]", got)
+	}
+	if got := layerRemainders(t, db, materialId); !reflect.DeepEqual(got, []int{0, 0, 0}) {
+		t.Fatalf("layers after removal = %v, want [0 0 0]", got)
+	}
+
+	_, err = removeMaterial(MaterialToRemoveJSON{MaterialID: strconv.Itoa(materialId), Qty: "1"}, db)
+	if err == nil {
+		t.Fatal("Removing from an empty row succeeded")
+	}
+}
@@ -0,0 +1,293 @@
+-- Upgrades a database made by the first version of db.sql to the schema in
+-- db.sql without losing its stock. Run it once, in one transaction, so a
+-- failure leaves the database as it was
+BEGIN;
+
+CREATE TYPE location_level AS ENUM ('zone', 'aisle', 'rack', 'shelf', 'bin');
+
+CREATE TYPE location_type AS ENUM ('storage', 'receiving_dock', 'staging', 'quarantine', 'in_transit');
+
+CREATE TYPE storage_rule AS ENUM ('single_sku', 'single_customer', 'mixed');
+
+CREATE TYPE capacity_type AS ENUM ('units', 'pallets', 'volume', 'weight');
+
+CREATE TYPE capacity_enforcement AS ENUM ('reject', 'warn');
+
+CREATE TYPE stock_status AS ENUM ('available', 'qc_hold', 'quarantined', 'damaged');
+
+ALTER TABLE warehouses
+	ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT TRUE;
+
+ALTER TABLE locations
+	ADD COLUMN IF NOT EXISTS parent_id INT REFERENCES locations (location_id),
+	ADD COLUMN IF NOT EXISTS level LOCATION_LEVEL,
+	ADD COLUMN IF NOT EXISTS code VARCHAR(50),
+	ADD COLUMN IF NOT EXISTS location_type LOCATION_TYPE NOT NULL DEFAULT 'storage',
+	ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT TRUE,
+	ADD COLUMN IF NOT EXISTS storage_rule STORAGE_RULE NOT NULL DEFAULT 'mixed',
+	ADD COLUMN IF NOT EXISTS zone VARCHAR(50),
+	ADD COLUMN IF NOT EXISTS pick_sequence INT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS capacity DECIMAL,
+	ADD COLUMN IF NOT EXISTS capacity_type CAPACITY_TYPE NOT NULL DEFAULT 'units',
+	ADD COLUMN IF NOT EXISTS capacity_enforcement CAPACITY_ENFORCEMENT NOT NULL DEFAULT 'reject';
+
+CREATE TABLE IF NOT EXISTS customer_warehouses (
+	customer_id INT REFERENCES customers (customer_id),
+	warehouse_id INT REFERENCES warehouses (warehouse_id),
+	priority INT NOT NULL DEFAULT 1,
+	PRIMARY KEY (customer_id, warehouse_id)
+);
+
+CREATE TABLE IF NOT EXISTS putaway_zone_rules (
+	material_type MATERIAL_TYPE NOT NULL,
+	zone VARCHAR(50) NOT NULL,
+	PRIMARY KEY (material_type, zone)
+);
+
+-- A location holds several materials now
+ALTER TABLE materials DROP CONSTRAINT IF EXISTS materials_location_id_key;
+
+ALTER TABLE materials
+	ADD COLUMN IF NOT EXISTS status STOCK_STATUS NOT NULL DEFAULT 'available',
+	ADD COLUMN IF NOT EXISTS lot_number VARCHAR(100) NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS expiration_date DATE;
+
+ALTER TABLE incoming_materials
+	ADD COLUMN IF NOT EXISTS requires_inspection BOOLEAN NOT NULL DEFAULT FALSE,
+	ADD COLUMN IF NOT EXISTS lot_number VARCHAR(100) NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS expiration_date DATE;
+
+CREATE TYPE transaction_type AS ENUM (
+	'receipt',
+	'move_out',
+	'move_in',
+	'removal',
+	'return',
+	'reversal',
+	'shipment',
+	'assembly',
+	'disassembly',
+	'adjustment'
+);
+
+CREATE TYPE adjustment_direction AS ENUM ('increase', 'decrease');
+
+CREATE TYPE cost_source AS ENUM ('last_cost', 'average', 'manual');
+
+CREATE TABLE IF NOT EXISTS adjustment_reasons (
+	reason_code VARCHAR(50) PRIMARY KEY,
+	description TEXT,
+	direction ADJUSTMENT_DIRECTION NOT NULL,
+	cost_source COST_SOURCE NOT NULL DEFAULT 'last_cost'
+);
+
+INSERT INTO adjustment_reasons (reason_code, description, direction) VALUES
+	('damaged', 'Damaged stock written off', 'decrease'),
+	('obsolete', 'Obsolete stock written off', 'decrease'),
+	('lost', 'Stock not found', 'decrease'),
+	('found', 'Stock found', 'increase'),
+	('count_gain', 'Cycle count surplus', 'increase'),
+	('count_loss', 'Cycle count shortage', 'decrease'),
+	('transit_loss', 'Transfer short received', 'decrease');
+
+ALTER TABLE transactions_log
+	ADD COLUMN IF NOT EXISTS transaction_type TRANSACTION_TYPE NOT NULL DEFAULT 'receipt',
+	ADD COLUMN IF NOT EXISTS layer_id INT REFERENCES transactions_log (transaction_id),
+	ADD COLUMN IF NOT EXISTS reference_id INT REFERENCES transactions_log (transaction_id),
+	ADD COLUMN IF NOT EXISTS reason_code VARCHAR(50) REFERENCES adjustment_reasons (reason_code),
+	ADD COLUMN IF NOT EXISTS assembly_id INT REFERENCES transactions_log (transaction_id);
+
+-- The old entries were receipts and removals
+UPDATE transactions_log SET transaction_type = 'removal' WHERE quantity_change < 0;
+
+CREATE TABLE IF NOT EXISTS reservations (
+	reservation_id SERIAL PRIMARY KEY,
+	material_id INT REFERENCES materials (material_id),
+	stock_id VARCHAR(100) NOT NULL,
+	customer_id INT REFERENCES customers (customer_id),
+	job_ticket VARCHAR(100),
+	quantity INT NOT NULL,
+	expires_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	job_id SERIAL PRIMARY KEY,
+	job_ticket VARCHAR(100) NOT NULL UNIQUE,
+	customer_id INT REFERENCES customers (customer_id),
+	due_date DATE,
+	notes TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS job_lines (
+	job_line_id SERIAL PRIMARY KEY,
+	job_id INT REFERENCES jobs (job_id) ON DELETE CASCADE,
+	stock_id VARCHAR(100) NOT NULL,
+	quantity INT NOT NULL,
+	CONSTRAINT unique_job_id_stock_id UNIQUE (job_id, stock_id)
+);
+
+CREATE TYPE shipment_status AS ENUM ('draft', 'picking', 'packed', 'shipped');
+
+CREATE TABLE IF NOT EXISTS shipments (
+	shipment_id SERIAL PRIMARY KEY,
+	customer_id INT REFERENCES customers (customer_id),
+	ship_to_name VARCHAR(100) NOT NULL,
+	ship_to_address TEXT NOT NULL,
+	status SHIPMENT_STATUS NOT NULL DEFAULT 'draft',
+	notes TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	shipped_at TIMESTAMP,
+	transaction_id INT REFERENCES transactions_log (transaction_id)
+);
+
+CREATE TABLE IF NOT EXISTS shipment_lines (
+	shipment_line_id SERIAL PRIMARY KEY,
+	shipment_id INT REFERENCES shipments (shipment_id) ON DELETE CASCADE,
+	material_id INT REFERENCES materials (material_id),
+	stock_id VARCHAR(100) NOT NULL,
+	quantity INT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS kits (
+	kit_id SERIAL PRIMARY KEY,
+	stock_id VARCHAR(100) NOT NULL UNIQUE,
+	customer_id INT REFERENCES customers (customer_id),
+	material_type MATERIAL_TYPE NOT NULL,
+	description TEXT,
+	owner OWNER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS kit_components (
+	kit_id INT REFERENCES kits (kit_id) ON DELETE CASCADE,
+	stock_id VARCHAR(100) NOT NULL,
+	quantity INT NOT NULL,
+	PRIMARY KEY (kit_id, stock_id)
+);
+
+CREATE TABLE IF NOT EXISTS stock_profiles (
+	stock_id VARCHAR(100) PRIMARY KEY,
+	is_serialized BOOLEAN NOT NULL DEFAULT FALSE,
+	abc_class CHAR(1) CHECK (abc_class IN ('A', 'B', 'C')),
+	unit_volume DECIMAL,
+	unit_weight DECIMAL,
+	units_per_pallet INT
+);
+
+CREATE TYPE serial_status AS ENUM ('in_stock', 'consumed');
+
+CREATE TABLE IF NOT EXISTS serial_numbers (
+	serial_id SERIAL PRIMARY KEY,
+	stock_id VARCHAR(100) NOT NULL,
+	serial_number VARCHAR(100) NOT NULL,
+	material_id INT REFERENCES materials (material_id),
+	status SERIAL_STATUS NOT NULL DEFAULT 'in_stock',
+	CONSTRAINT unique_serial_number_stock_id UNIQUE (serial_number, stock_id)
+);
+
+CREATE TABLE IF NOT EXISTS serial_history (
+	history_id SERIAL PRIMARY KEY,
+	serial_id INT REFERENCES serial_numbers (serial_id),
+	material_id INT REFERENCES materials (material_id),
+	location_id INT REFERENCES locations (location_id),
+	action VARCHAR(50) NOT NULL,
+	job_ticket VARCHAR(100),
+	notes TEXT,
+	updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TYPE count_status AS ENUM ('open', 'counted', 'approved', 'rejected');
+
+CREATE TABLE IF NOT EXISTS count_tasks (
+	count_task_id SERIAL PRIMARY KEY,
+	material_id INT REFERENCES materials (material_id) NOT NULL,
+	is_blind BOOLEAN NOT NULL DEFAULT FALSE,
+	status COUNT_STATUS NOT NULL DEFAULT 'open',
+	system_quantity INT,
+	counted_quantity INT,
+	last_transaction_id INT REFERENCES transactions_log (transaction_id),
+	counted_by VARCHAR(100),
+	notes TEXT,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	counted_at TIMESTAMP,
+	closed_at TIMESTAMP
+);
+
+CREATE TYPE inventory_event_status AS ENUM ('open', 'closed');
+
+CREATE TABLE IF NOT EXISTS inventory_events (
+	event_id SERIAL PRIMARY KEY,
+	warehouse_id INT REFERENCES warehouses (warehouse_id) NOT NULL,
+	status INVENTORY_EVENT_STATUS NOT NULL DEFAULT 'open',
+	notes TEXT,
+	started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	closed_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_open_inventory_event
+	ON inventory_events (warehouse_id) WHERE status = 'open';
+
+CREATE TABLE IF NOT EXISTS inventory_event_lines (
+	event_line_id SERIAL PRIMARY KEY,
+	event_id INT REFERENCES inventory_events (event_id) ON DELETE CASCADE,
+	location_id INT REFERENCES locations (location_id) NOT NULL,
+	material_id INT REFERENCES materials (material_id),
+	stock_id VARCHAR(100) NOT NULL,
+	lot_number VARCHAR(100) NOT NULL DEFAULT '',
+	expected_quantity INT NOT NULL DEFAULT 0,
+	counted_quantity INT,
+	unit_cost DECIMAL NOT NULL DEFAULT 0,
+	variance_value DECIMAL,
+	counted_by VARCHAR(100),
+	counted_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS inventory_event_serials (
+	event_line_id INT REFERENCES inventory_event_lines (event_line_id) ON DELETE CASCADE,
+	serial_number VARCHAR(100) NOT NULL,
+	is_missing BOOLEAN NOT NULL,
+	PRIMARY KEY (event_line_id, serial_number)
+);
+
+CREATE TYPE transfer_status AS ENUM ('in_transit', 'received');
+
+CREATE TABLE IF NOT EXISTS transfers (
+	transfer_id SERIAL PRIMARY KEY,
+	source_warehouse_id INT REFERENCES warehouses (warehouse_id) NOT NULL,
+	destination_warehouse_id INT REFERENCES warehouses (warehouse_id) NOT NULL,
+	status TRANSFER_STATUS NOT NULL DEFAULT 'in_transit',
+	notes TEXT,
+	shipped_at TIMESTAMP NOT NULL DEFAULT NOW(),
+	received_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS transfer_lines (
+	transfer_line_id SERIAL PRIMARY KEY,
+	transfer_id INT REFERENCES transfers (transfer_id) ON DELETE CASCADE,
+	source_material_id INT REFERENCES materials (material_id) NOT NULL,
+	transit_material_id INT REFERENCES materials (material_id) NOT NULL,
+	destination_material_id INT REFERENCES materials (material_id),
+	stock_id VARCHAR(100) NOT NULL,
+	lot_number VARCHAR(100) NOT NULL DEFAULT '',
+	shipped_quantity INT NOT NULL,
+	received_quantity INT,
+	reason_code VARCHAR(50) REFERENCES adjustment_reasons (reason_code)
+);
+
+-- The old layers hold the received quantity in remaining_quantity. What is
+-- left of each material is put back into its newest layers, as FIFO leaves it
+UPDATE transactions_log tl
+SET remaining_quantity = GREATEST(LEAST(tl.quantity_change, b.balance - b.newer), 0)
+FROM (
+	SELECT l.transaction_id,
+		(SELECT SUM(quantity_change) FROM transactions_log WHERE material_id = l.material_id) AS "balance",
+		COALESCE(SUM(l.quantity_change) OVER (
+			PARTITION BY l.material_id ORDER BY l.transaction_id DESC
+			ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING), 0) AS "newer"
+	FROM transactions_log l
+	WHERE l.quantity_change > 0 AND l.layer_id IS NULL
+) b
+WHERE tl.transaction_id = b.transaction_id;
+
+COMMIT;
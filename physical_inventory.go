@@ -0,0 +1,688 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Physical inventory event statuses
+const (
+	eventOpen   = "open"
+	eventClosed = "closed"
+)
+
+type InventoryEventJSON struct {
+	WarehouseID string `json:"warehouseId"`
+	Notes       string `json:"notes"`
+}
+
+// A count of a snapshot line or of stock found in the location.
+// Counts of serialized stock name the serials found or missing
+type InventoryCountJSON struct {
+	EventLineID          string   `json:"eventLineId"`
+	LocationID           string   `json:"locationId"`
+	StockID              string   `json:"stockId"`
+	LotNumber            string   `json:"lotNumber"`
+	CountedQty           string   `json:"countedQuantity"`
+	CountedBy            string   `json:"countedBy"`
+	FoundSerialNumbers   []string `json:"foundSerialNumbers"`
+	MissingSerialNumbers []string `json:"missingSerialNumbers"`
+}
+
+// Lines not counted are either rejected or counted as zero
+type InventoryCloseJSON struct {
+	MissingAsZero bool `json:"missingAsZero"`
+}
+
+type InventoryEventDB struct {
+	EventID       int       `field:"event_id"`
+	WarehouseID   int       `field:"warehouse_id"`
+	WarehouseName string    `field:"warehouse_name"`
+	Status        string    `field:"status"`
+	Notes         string    `field:"notes"`
+	StartedAt     time.Time `field:"started_at"`
+	ClosedAt      string    `field:"closed_at"`
+	Lines         []InventoryEventLineDB
+}
+
+type InventoryEventLineDB struct {
+	EventLineID          int      `field:"event_line_id"`
+	LocationID           int      `field:"location_id"`
+	LocationName         string   `field:"location_name"`
+	MaterialID           int      `field:"material_id"`
+	StockID              string   `field:"stock_id"`
+	LotNumber            string   `field:"lot_number"`
+	ExpectedQty          int      `field:"expected_quantity"`
+	CountedQty           *int     `field:"counted_quantity"`
+	VarianceQty          *int     // derived
+	UnitCost             float64  `field:"unit_cost"`
+	VarianceValue        float64  `field:"variance_value"`
+	CountedBy            string   `field:"counted_by"`
+	FoundSerialNumbers   []string // from inventory_event_serials
+	MissingSerialNumbers []string // from inventory_event_serials
+}
+
+type InventoryReport struct {
+	EventID            int
+	WarehouseName      string
+	Status             string
+	Lines              []InventoryReportLine
+	ExpectedQty        string
+	CountedQty         string
+	VarianceQty        string
+	VarianceValue      string
+	UncountedLineCount int
+}
+
+type InventoryReportLine struct {
+	LocationName  string
+	StockID       string
+	LotNumber     string
+	ExpectedQty   string
+	CountedQty    string
+	VarianceQty   string
+	UnitCost      string
+	VarianceValue string
+}
+
+// Stock cannot change in a warehouse being counted. Every posting checks
+// the locations it changes, the closing of the count itself excepted
+func checkWarehouseFrozen(db dbExecutor, locationId int) error {
+	var eventId int
+	err := db.QueryRow(`
+		SELECT e.event_id FROM inventory_events e
+		LEFT JOIN locations l ON l.warehouse_id = e.warehouse_id
+		WHERE l.location_id = $1 AND e.status = 'open';`, locationId).Scan(&eventId)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return errors.New("The warehouse is frozen by the physical inventory " + strconv.Itoa(eventId))
+}
+
+// Freezes the warehouse and takes the expected quantities of its rows
+func startInventoryEvent(event InventoryEventJSON, db *sql.DB) (int, error) {
+	warehouseId, _ := strconv.Atoi(event.WarehouseID)
+	if warehouseId == 0 {
+		return 0, errors.New("Warehouse is required")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var openEventId int
+	err = tx.QueryRow(`
+		SELECT event_id FROM inventory_events
+		WHERE warehouse_id = $1 AND status = 'open';`, warehouseId).Scan(&openEventId)
+	if err == nil {
+		return 0, errors.New("The physical inventory " + strconv.Itoa(openEventId) + " of the warehouse is still open")
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var eventId int
+	err = tx.QueryRow(`
+		INSERT INTO inventory_events (warehouse_id, notes) VALUES ($1, $2)
+		RETURNING event_id;`, warehouseId, event.Notes).Scan(&eventId)
+	if err != nil {
+		return 0, err
+	}
+
+	// Unit cost of a row is the average of its remaining cost layers
+	_, err = tx.Exec(`
+		INSERT INTO inventory_event_lines
+			(event_id, location_id, material_id, stock_id, lot_number, expected_quantity, unit_cost)
+		SELECT $1, m.location_id, m.material_id, m.stock_id, m.lot_number, m.quantity,
+			COALESCE((
+				SELECT SUM(tl.remaining_quantity * tl.cost) / NULLIF(SUM(tl.remaining_quantity), 0)
+				FROM transactions_log tl
+				WHERE tl.material_id = m.material_id AND tl.quantity_change > 0
+					AND tl.layer_id IS NULL AND tl.remaining_quantity > 0
+			), m.cost)
+		FROM materials m
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		WHERE l.warehouse_id = $2 AND m.quantity > 0;`,
+		eventId, warehouseId)
+	if err != nil {
+		return 0, err
+	}
+
+	return eventId, tx.Commit()
+}
+
+func fetchInventoryEvents(db *sql.DB) ([]InventoryEventDB, error) {
+	return queryInventoryEvents(db, 0)
+}
+
+func fetchInventoryEvent(db dbExecutor, eventId int) (InventoryEventDB, error) {
+	events, err := queryInventoryEvents(db, eventId)
+	if err != nil {
+		return InventoryEventDB{}, err
+	}
+	if len(events) == 0 {
+		return InventoryEventDB{}, errors.New("Physical inventory " + strconv.Itoa(eventId) + " is not found")
+	}
+
+	return events[0], nil
+}
+
+func queryInventoryEvents(db dbExecutor, eventId int) ([]InventoryEventDB, error) {
+	rows, err := db.Query(`
+		SELECT e.event_id, e.warehouse_id, COALESCE(w.name, ''), e.status,
+			COALESCE(e.notes, ''), e.started_at,
+			COALESCE(TO_CHAR(e.closed_at, 'YYYY-MM-DD HH24:MI'), '')
+		FROM inventory_events e
+		LEFT JOIN warehouses w ON w.warehouse_id = e.warehouse_id
+		WHERE ($1 = 0 OR e.event_id = $1)
+		ORDER BY e.event_id;`, eventId)
+	if err != nil {
+		log.Println("Error queryInventoryEvents1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []InventoryEventDB{}
+	for rows.Next() {
+		var event InventoryEventDB
+		if err := rows.Scan(
+			&event.EventID,
+			&event.WarehouseID,
+			&event.WarehouseName,
+			&event.Status,
+			&event.Notes,
+			&event.StartedAt,
+			&event.ClosedAt,
+		); err != nil {
+			log.Println("Error queryInventoryEvents2: ", err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range events {
+		lines, err := fetchInventoryEventLines(db, events[i].EventID)
+		if err != nil {
+			return nil, err
+		}
+		events[i].Lines = lines
+	}
+
+	return events, nil
+}
+
+func fetchInventoryEventLines(db dbExecutor, eventId int) ([]InventoryEventLineDB, error) {
+	rows, err := db.Query(`
+		SELECT el.event_line_id, el.location_id, COALESCE(l.name, ''), COALESCE(el.material_id, 0),
+			el.stock_id, el.lot_number, el.expected_quantity, el.counted_quantity,
+			el.unit_cost, el.variance_value, COALESCE(el.counted_by, '')
+		FROM inventory_event_lines el
+		LEFT JOIN locations l ON l.location_id = el.location_id
+		WHERE el.event_id = $1
+		ORDER BY l.pick_sequence, l.name, el.stock_id, el.event_line_id;`, eventId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying physical inventory lines: %w", err)
+	}
+	defer rows.Close()
+
+	lines := []InventoryEventLineDB{}
+	for rows.Next() {
+		var line InventoryEventLineDB
+		var countedQty sql.NullInt64
+		var varianceValue sql.NullFloat64
+		if err := rows.Scan(
+			&line.EventLineID,
+			&line.LocationID,
+			&line.LocationName,
+			&line.MaterialID,
+			&line.StockID,
+			&line.LotNumber,
+			&line.ExpectedQty,
+			&countedQty,
+			&line.UnitCost,
+			&varianceValue,
+			&line.CountedBy,
+		); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+
+		if countedQty.Valid {
+			counted := int(countedQty.Int64)
+			variance := counted - line.ExpectedQty
+			line.CountedQty = &counted
+			line.VarianceQty = &variance
+			line.VarianceValue = float64(variance) * line.UnitCost
+		}
+		// Closed events keep the value posted by the costing engine
+		if varianceValue.Valid {
+			line.VarianceValue = varianceValue.Float64
+		}
+		line.FoundSerialNumbers = []string{}
+		line.MissingSerialNumbers = []string{}
+		lines = append(lines, line)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	serialRows, err := db.Query(`
+		SELECT es.event_line_id, es.serial_number, es.is_missing
+		FROM inventory_event_serials es
+		LEFT JOIN inventory_event_lines el ON el.event_line_id = es.event_line_id
+		WHERE el.event_id = $1
+		ORDER BY es.serial_number;`, eventId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying physical inventory serials: %w", err)
+	}
+	defer serialRows.Close()
+
+	lineIndexes := make(map[int]int)
+	for i, line := range lines {
+		lineIndexes[line.EventLineID] = i
+	}
+	for serialRows.Next() {
+		var lineId int
+		var serial string
+		var isMissing bool
+		if err := serialRows.Scan(&lineId, &serial, &isMissing); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+		line := &lines[lineIndexes[lineId]]
+		if isMissing {
+			line.MissingSerialNumbers = append(line.MissingSerialNumbers, serial)
+		} else {
+			line.FoundSerialNumbers = append(line.FoundSerialNumbers, serial)
+		}
+	}
+
+	return lines, serialRows.Err()
+}
+
+// Stock not in the snapshot gets a line of its own with nothing expected
+func submitInventoryCount(eventId int, count InventoryCountJSON, db *sql.DB) error {
+	countedQty, err := strconv.Atoi(count.CountedQty)
+	if err != nil || countedQty < 0 {
+		return errors.New("Counted quantity must be zero or more")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var warehouseId int
+	var status string
+	err = tx.QueryRow(`
+		SELECT warehouse_id, status FROM inventory_events WHERE event_id = $1;`,
+		eventId).Scan(&warehouseId, &status)
+	if err == sql.ErrNoRows {
+		return errors.New("Physical inventory " + strconv.Itoa(eventId) + " is not found")
+	}
+	if err != nil {
+		return err
+	}
+	if status != eventOpen {
+		return errors.New("Physical inventory " + strconv.Itoa(eventId) + " is closed")
+	}
+
+	lineId, _ := strconv.Atoi(count.EventLineID)
+	if lineId == 0 {
+		lineId, err = findInventoryLine(tx, eventId, warehouseId, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec(`
+		UPDATE inventory_event_lines
+		SET counted_quantity = $1, counted_by = $2, counted_at = NOW()
+		WHERE event_line_id = $3 AND event_id = $4;`,
+		countedQty, count.CountedBy, lineId, eventId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Line " + strconv.Itoa(lineId) + " is not in the physical inventory")
+	}
+
+	if err := recordInventorySerials(tx, lineId, countedQty, count); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The serials of serialized stock account for the variance of the line.
+// A recount replaces them
+func recordInventorySerials(db dbExecutor, lineId int, countedQty int, count InventoryCountJSON) error {
+	var stockId string
+	var expectedQty int
+	err := db.QueryRow(`
+		SELECT stock_id, expected_quantity FROM inventory_event_lines WHERE event_line_id = $1;`,
+		lineId).Scan(&stockId, &expectedQty)
+	if err != nil {
+		return err
+	}
+
+	serialized, err := isSerializedStock(db, stockId)
+	if err != nil || !serialized {
+		return err
+	}
+
+	variance := countedQty - expectedQty
+	if err := validateSerials(count.FoundSerialNumbers, max(variance, 0)); err != nil {
+		return fmt.Errorf("Found serials: %w", err)
+	}
+	if err := validateSerials(count.MissingSerialNumbers, max(-variance, 0)); err != nil {
+		return fmt.Errorf("Missing serials: %w", err)
+	}
+
+	_, err = db.Exec(`DELETE FROM inventory_event_serials WHERE event_line_id = $1;`, lineId)
+	if err != nil {
+		return err
+	}
+	for i, serials := range [][]string{count.FoundSerialNumbers, count.MissingSerialNumbers} {
+		isMissing := i == 1
+		for _, serial := range serials {
+			_, err := db.Exec(`
+				INSERT INTO inventory_event_serials (event_line_id, serial_number, is_missing)
+				VALUES ($1, $2, $3);`,
+				lineId, serial, isMissing)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func findInventoryLine(db dbExecutor, eventId int, warehouseId int, count InventoryCountJSON) (int, error) {
+	locationId, _ := strconv.Atoi(count.LocationID)
+	if locationId == 0 || count.StockID == "" {
+		return 0, errors.New("Either event line ID or location and stock ID are required")
+	}
+
+	var locationWarehouseId int
+	err := db.QueryRow(`
+		SELECT COALESCE(warehouse_id, 0) FROM locations WHERE location_id = $1;`,
+		locationId).Scan(&locationWarehouseId)
+	if err == sql.ErrNoRows || locationWarehouseId != warehouseId {
+		return 0, errors.New("Location " + count.LocationID + " is not in the counted warehouse")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var lineId int
+	err = db.QueryRow(`
+		SELECT event_line_id FROM inventory_event_lines
+		WHERE event_id = $1 AND location_id = $2 AND stock_id = $3 AND lot_number = $4
+		ORDER BY event_line_id LIMIT 1;`,
+		eventId, locationId, count.StockID, count.LotNumber).Scan(&lineId)
+	if err != sql.ErrNoRows {
+		return lineId, err
+	}
+
+	err = db.QueryRow(`
+		INSERT INTO inventory_event_lines (event_id, location_id, material_id, stock_id, lot_number)
+		VALUES ($1, $2, (
+			SELECT material_id FROM materials
+			WHERE location_id = $2 AND stock_id = $3 AND lot_number = $4
+			ORDER BY material_id LIMIT 1
+		), $3, $4)
+		RETURNING event_line_id;`,
+		eventId, locationId, count.StockID, count.LotNumber).Scan(&lineId)
+	if err != nil {
+		return 0, err
+	}
+
+	return lineId, nil
+}
+
+// Posts every variance of the event in one database transaction
+// and unfreezes the warehouse
+func closeInventoryEvent(eventId int, closing InventoryCloseJSON, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	event, err := fetchInventoryEvent(tx, eventId)
+	if err != nil {
+		return nil, err
+	}
+	if event.Status != eventOpen {
+		return nil, errors.New("Physical inventory " + strconv.Itoa(eventId) + " is already closed")
+	}
+
+	uncounted := 0
+	for _, line := range event.Lines {
+		if line.CountedQty == nil {
+			uncounted++
+		}
+	}
+	if uncounted > 0 && !closing.MissingAsZero {
+		return nil, errors.New(strconv.Itoa(uncounted) + " lines are not counted. Count them or close with missing lines as zero")
+	}
+
+	// Closed first, so the variances can be posted to the frozen warehouse
+	_, err = tx.Exec(`
+		UPDATE inventory_events SET status = 'closed', closed_at = NOW() WHERE event_id = $1;`,
+		eventId)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := "Physical inventory " + strconv.Itoa(eventId)
+	trxIds := []int{}
+	for _, line := range event.Lines {
+		variance := -line.ExpectedQty
+		if line.CountedQty != nil {
+			variance = *line.VarianceQty
+		}
+		if variance == 0 {
+			continue
+		}
+
+		adjustment := AdjustmentJSON{
+			Qty:           strconv.Itoa(max(variance, -variance)),
+			ReasonCode:    reasonCountGain,
+			Notes:         notes,
+			SerialNumbers: line.FoundSerialNumbers,
+		}
+		if variance < 0 {
+			adjustment.ReasonCode = reasonCountLoss
+			adjustment.SerialNumbers = line.MissingSerialNumbers
+		}
+		// Every serial of a line not counted is missing
+		if line.CountedQty == nil {
+			adjustment.SerialNumbers, err = materialSerials(tx, line.MaterialID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if line.MaterialID != 0 {
+			adjustment.MaterialID = strconv.Itoa(line.MaterialID)
+		} else {
+			adjustment.StockID = line.StockID
+			adjustment.LocationID = strconv.Itoa(line.LocationID)
+			adjustment.LotNumber = line.LotNumber
+		}
+
+		ids, err := postAdjustment(adjustment, tx)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d (stock %s): %w", line.EventLineID, line.StockID, err)
+		}
+
+		var varianceValue float64
+		var materialId int
+		for _, transactionId := range ids {
+			var value float64
+			err := tx.QueryRow(`
+				SELECT quantity_change * COALESCE(cost, 0), material_id FROM transactions_log
+				WHERE transaction_id = $1;`, transactionId).Scan(&value, &materialId)
+			if err != nil {
+				return nil, err
+			}
+			varianceValue += value
+		}
+
+		_, err = tx.Exec(`
+			UPDATE inventory_event_lines
+			SET variance_value = $1, material_id = $2
+			WHERE event_line_id = $3;`,
+			varianceValue, materialId, line.EventLineID)
+		if err != nil {
+			return nil, err
+		}
+		trxIds = append(trxIds, ids...)
+	}
+
+	return trxIds, tx.Commit()
+}
+
+func fetchInventoryReport(db *sql.DB, eventId int) (InventoryReport, error) {
+	event, err := fetchInventoryEvent(db, eventId)
+	if err != nil {
+		return InventoryReport{}, err
+	}
+
+	report := InventoryReport{
+		EventID:       event.EventID,
+		WarehouseName: event.WarehouseName,
+		Status:        event.Status,
+		Lines:         []InventoryReportLine{},
+	}
+
+	var expectedQty, countedQty, varianceQty int
+	var varianceValue float64
+	for _, line := range event.Lines {
+		expectedQty += line.ExpectedQty
+
+		reportLine := InventoryReportLine{
+			LocationName: line.LocationName,
+			StockID:      line.StockID,
+			LotNumber:    line.LotNumber,
+			ExpectedQty:  strconv.Itoa(line.ExpectedQty),
+			UnitCost:     accLib.FormatMoney(line.UnitCost),
+		}
+		if line.CountedQty == nil {
+			report.UncountedLineCount++
+		} else {
+			countedQty += *line.CountedQty
+			varianceQty += *line.VarianceQty
+			varianceValue += line.VarianceValue
+
+			reportLine.CountedQty = strconv.Itoa(*line.CountedQty)
+			reportLine.VarianceQty = strconv.Itoa(*line.VarianceQty)
+			reportLine.VarianceValue = accLib.FormatMoney(line.VarianceValue)
+		}
+		report.Lines = append(report.Lines, reportLine)
+	}
+
+	report.ExpectedQty = strconv.Itoa(expectedQty)
+	report.CountedQty = strconv.Itoa(countedQty)
+	report.VarianceQty = strconv.Itoa(varianceQty)
+	report.VarianceValue = accLib.FormatMoney(varianceValue)
+
+	return report, nil
+}
+
+// Every location of the warehouse is on the count sheet,
+// the empty ones too, so that unexpected stock can be written down
+type countSheet struct {
+	Event        InventoryEventDB
+	ShowExpected bool
+	Locations    []countSheetLocation
+}
+
+type countSheetLocation struct {
+	LocationName string
+	Lines        []InventoryEventLineDB
+}
+
+func fetchCountSheet(db *sql.DB, eventId int, showExpected bool) (countSheet, error) {
+	event, err := fetchInventoryEvent(db, eventId)
+	if err != nil {
+		return countSheet{}, err
+	}
+
+	rows, err := db.Query(`
+		SELECT location_id, name FROM locations
+		WHERE warehouse_id = $1
+		ORDER BY pick_sequence, name;`, event.WarehouseID)
+	if err != nil {
+		return countSheet{}, err
+	}
+	defer rows.Close()
+
+	sheet := countSheet{Event: event, ShowExpected: showExpected}
+	for rows.Next() {
+		var locationId int
+		var location countSheetLocation
+		if err := rows.Scan(&locationId, &location.LocationName); err != nil {
+			return countSheet{}, err
+		}
+		for _, line := range event.Lines {
+			if line.LocationID == locationId {
+				location.Lines = append(location.Lines, line)
+			}
+		}
+		sheet.Locations = append(sheet.Locations, location)
+	}
+
+	return sheet, rows.Err()
+}
+
+var countSheetTemplate = template.Must(template.New("countSheet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Count sheet #{{.Event.EventID}}</title>
+	<style>
+		body { font-family: sans-serif; margin: 2em; }
+		table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+		th, td { border: 1px solid #999; padding: 4px 8px; text-align: left; }
+		td.count { width: 8em; }
+		h2 { page-break-after: avoid; }
+	</style>
+</head>
+<body>
+	<h1>Count sheet #{{.Event.EventID}} &mdash; {{.Event.WarehouseName}}</h1>
+	<p>Started: {{.Event.StartedAt.Format "2006-01-02 15:04"}}</p>
+	<table>
+		<tr><th>Location</th><th>Line</th><th>Stock ID</th><th>Lot</th>{{if .ShowExpected}}<th>Expected</th>{{end}}<th>Counted</th></tr>
+		{{range .Locations}}
+		{{$location := .LocationName}}
+		{{range .Lines}}
+		<tr><td>{{$location}}</td><td>{{.EventLineID}}</td><td>{{.StockID}}</td><td>{{.LotNumber}}</td>{{if $.ShowExpected}}<td>{{.ExpectedQty}}</td>{{end}}<td class="count"></td></tr>
+		{{end}}
+		<tr><td>{{$location}}</td><td></td><td></td><td></td>{{if $.ShowExpected}}<td></td>{{end}}<td class="count"></td></tr>
+		{{end}}
+	</table>
+	<p>Counted by: ______________________</p>
+</body>
+</html>
+`))
+
+func renderCountSheet(w io.Writer, sheet countSheet) error {
+	return countSheetTemplate.Execute(w, sheet)
+}
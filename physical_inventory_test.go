@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestInventorySerializedVariance(t *testing.T) {
+	db := openTestDB(t)
+	locationId := createTestLocation(t, db)
+
+	_, err := db.Exec(`INSERT INTO stock_profiles (stock_id, is_serialized) VALUES ('STK-1', TRUE);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	materialId := receiveTestStock(t, db, locationId, 3, "1.00", "SN-1", "SN-2", "SN-3")
+
+	var warehouseId int
+	err = db.QueryRow(`SELECT warehouse_id FROM locations WHERE location_id = $1;`, locationId).
+		Scan(&warehouseId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventId, err := startInventoryEvent(InventoryEventJSON{WarehouseID: strconv.Itoa(warehouseId)}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := InventoryCountJSON{
+		LocationID: strconv.Itoa(locationId),
+		StockID:    "STK-1",
+		CountedQty: "2",
+	}
+	if err := submitInventoryCount(eventId, count, db); err == nil {
+		t.Fatal("A shortage of serialized stock was counted without its serials")
+	}
+	count.MissingSerialNumbers = []string{"SN-2"}
+	if err := submitInventoryCount(eventId, count, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := closeInventoryEvent(eventId, InventoryCloseJSON{}, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWarehouseFrozen(db, locationId); err != nil {
+		t.Fatal(err)
+	}
+
+	material, err := getMaterialById(materialId, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if material.Quantity != 2 {
+		t.Fatalf("quantity after the count = %d, want 2", material.Quantity)
+	}
+	serials, err := materialSerials(db, materialId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(serials, []string{"SN-1", "SN-3"}) {
+		t.Fatalf("serials after the count = %v, want [SN-1 SN-3]", serials)
+	}
+}
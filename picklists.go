@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Allocation strategies of a pick list
+const (
+	pickFIFO = "fifo"
+	pickFEFO = "fefo"
+)
+
+type PickRequestJSON struct {
+	Strategy  string                `json:"strategy"`
+	JobTicket string                `json:"jobTicket"`
+	Lines     []PickRequestLineJSON `json:"lines"`
+}
+
+type PickRequestLineJSON struct {
+	StockID string `json:"stockId"`
+	Owner   string `json:"owner"`
+	Qty     string `json:"quantity"`
+}
+
+type PickConfirmJSON struct {
+	JobTicket string                `json:"jobTicket"`
+	Override  bool                  `json:"override"`
+	Picks     []PickConfirmLineJSON `json:"picks"`
+}
+
+type PickConfirmLineJSON struct {
+	MaterialID    string   `json:"materialId"`
+	Qty           string   `json:"quantity"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+type PickListDB struct {
+	Strategy string
+	Lines    []PickLineDB
+	Picks    []PickDB
+}
+
+type PickLineDB struct {
+	StockID      string
+	Owner        string
+	RequestedQty int
+	AllocatedQty int
+	ShortQty     int
+}
+
+type PickDB struct {
+	MaterialID     int       `field:"material_id"`
+	StockID        string    `field:"stock_id"`
+	CustomerID     int       `field:"customer_id"`
+	Owner          string    `field:"owner"`
+	WarehouseName  string    `field:"warehouse_name"`
+	LocationName   string    `field:"location_name"`
+	LotNumber      string    `field:"lot_number"`
+	ExpirationDate string    `field:"expiration_date"`
+	ReceivedAt     time.Time `field:"received_at"`
+	Qty            int       `field:"quantity"`
+	freeQty        int
+}
+
+// Allocates the requested stocks over the material rows holding them
+// and returns the picks in warehouse/location order
+func generatePickList(db *sql.DB, request PickRequestJSON) (PickListDB, error) {
+	strategy := request.Strategy
+	if strategy == "" {
+		strategy = pickFIFO
+	}
+	if strategy != pickFIFO && strategy != pickFEFO {
+		return PickListDB{}, errors.New("Pick strategy must be either " + pickFIFO + " or " + pickFEFO)
+	}
+
+	pickList := PickListDB{Strategy: strategy, Lines: []PickLineDB{}, Picks: []PickDB{}}
+	allocated := make(map[int]int)
+
+	for _, line := range request.Lines {
+		qty, _ := strconv.Atoi(line.Qty)
+		if line.StockID == "" || qty <= 0 {
+			return PickListDB{}, errors.New("Every pick line needs a stock ID and a positive quantity")
+		}
+
+		candidates, err := fetchPickCandidates(db, line.StockID, 0, line.Owner, request.JobTicket, strategy)
+		if err != nil {
+			return PickListDB{}, err
+		}
+
+		remaining := qty
+		for _, candidate := range candidates {
+			if remaining == 0 {
+				break
+			}
+
+			// The same row can be allocated to several lines
+			free := candidate.freeQty - allocated[candidate.MaterialID]
+			if free <= 0 {
+				continue
+			}
+
+			take := min(free, remaining)
+			allocated[candidate.MaterialID] += take
+			remaining -= take
+
+			candidate.Qty = take
+			pickList.Picks = append(pickList.Picks, candidate)
+		}
+
+		pickList.Lines = append(pickList.Lines, PickLineDB{
+			StockID:      line.StockID,
+			Owner:        line.Owner,
+			RequestedQty: qty,
+			AllocatedQty: qty - remaining,
+			ShortQty:     remaining,
+		})
+	}
+
+	sort.SliceStable(pickList.Picks, func(i, j int) bool {
+		a, b := pickList.Picks[i], pickList.Picks[j]
+		if a.WarehouseName != b.WarehouseName {
+			return a.WarehouseName < b.WarehouseName
+		}
+		return a.LocationName < b.LocationName
+	})
+
+	return pickList, nil
+}
+
+// Candidates are limited to the customer and owner when they are given
+func fetchPickCandidates(db dbExecutor, stockId string, customerId int, owner string, jobTicket string, strategy string) ([]PickDB, error) {
+	order := `received_at, m.material_id`
+	if strategy == pickFEFO {
+		order = `m.expiration_date NULLS LAST, received_at, m.material_id`
+	}
+
+	rows, err := db.Query(`
+		SELECT m.material_id, m.stock_id, COALESCE(m.customer_id, 0), m.owner,
+			COALESCE(w.name, ''), COALESCE(l.name, ''),
+			m.lot_number, COALESCE(TO_CHAR(m.expiration_date, 'YYYY-MM-DD'), ''),
+			COALESCE((
+				SELECT MIN(tl.updated_at) FROM transactions_log tl
+				WHERE tl.material_id = m.material_id AND tl.quantity_change > 0
+			), m.updated_at, CURRENT_DATE) AS "received_at",
+			m.quantity - (
+				SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+				WHERE r.material_id = m.material_id
+					AND ($3 = '' OR COALESCE(r.job_ticket, '') <> $3)
+					AND `+activeReservation+`
+			) AS "free_quantity"
+		FROM materials m
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		WHERE m.stock_id = $1
+			AND ($2 = '' OR m.owner::TEXT = $2)
+			AND ($4 = 0 OR m.customer_id = $4)
+			AND m.status = 'available'
+			AND m.quantity > 0
+			AND l.location_type <> 'in_transit'
+		ORDER BY `+order+`;`,
+		stockId, owner, jobTicket, customerId)
+	if err != nil {
+		log.Println("Error fetchPickCandidates1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []PickDB
+	for rows.Next() {
+		var candidate PickDB
+		if err := rows.Scan(
+			&candidate.MaterialID,
+			&candidate.StockID,
+			&candidate.CustomerID,
+			&candidate.Owner,
+			&candidate.WarehouseName,
+			&candidate.LocationName,
+			&candidate.LotNumber,
+			&candidate.ExpirationDate,
+			&candidate.ReceivedAt,
+			&candidate.freeQty,
+		); err != nil {
+			log.Println("Error fetchPickCandidates2: ", err)
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	return candidates, holdStockReservations(db, candidates, stockId, jobTicket)
+}
+
+// Reservations of the stock rather than of a row hold back the candidates
+// of their customer, or of any customer when they have none. The candidates
+// picked last are held first
+func holdStockReservations(db dbExecutor, candidates []PickDB, stockId string, jobTicket string) error {
+	rows, err := db.Query(`
+		SELECT COALESCE(r.customer_id, 0), SUM(r.quantity) FROM reservations r
+		WHERE r.stock_id = $1
+			AND r.material_id IS NULL
+			AND ($2 = '' OR COALESCE(r.job_ticket, '') <> $2)
+			AND `+activeReservation+`
+		GROUP BY COALESCE(r.customer_id, 0)
+		ORDER BY COALESCE(r.customer_id, 0) DESC;`,
+		stockId, jobTicket)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var customerId, reserved int
+		if err := rows.Scan(&customerId, &reserved); err != nil {
+			return err
+		}
+
+		for i := len(candidates) - 1; i >= 0 && reserved > 0; i-- {
+			if customerId != 0 && candidates[i].CustomerID != customerId {
+				continue
+			}
+			held := min(max(candidates[i].freeQty, 0), reserved)
+			candidates[i].freeQty -= held
+			reserved -= held
+		}
+	}
+
+	return rows.Err()
+}
+
+// Posts every pick of the list as a removal. Either all of them succeed or none
+func confirmPickList(db *sql.DB, confirm PickConfirmJSON) error {
+	if len(confirm.Picks) == 0 {
+		return errors.New("Pick list is empty")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, pick := range confirm.Picks {
+		_, err := removeMaterial(MaterialToRemoveJSON{
+			MaterialID:    pick.MaterialID,
+			Qty:           pick.Qty,
+			JobTicket:     confirm.JobTicket,
+			SerialNumbers: pick.SerialNumbers,
+			Override:      confirm.Override,
+		}, tx)
+		if err != nil {
+			return fmt.Errorf("Pick %d (material %s): %w", i+1, pick.MaterialID, err)
+		}
+	}
+
+	return tx.Commit()
+}
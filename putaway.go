@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// Scores used to rank put-away locations
+const (
+	consolidationScore   = 50
+	preferredZoneScore   = 20
+	preferredWhScore     = 30
+	preferredWhStep      = 5
+	capacityFitScore     = 10
+	maxDistanceScore     = 10
+	distanceScoreDivisor = 10
+)
+
+type PutawayZoneRuleJSON struct {
+	MaterialType string `json:"type"`
+	Zone         string `json:"zone"`
+}
+
+type SuggestionFilter struct {
+	shippingId string
+	quantity   string
+	limit      int
+}
+
+type LocationSuggestion struct {
+	LocationID    int
+	LocationName  string
+	WarehouseID   int
+	WarehouseName string
+	Zone          string
+	Score         int
+	Reasons       []string
+}
+
+type locationCandidate struct {
+	locationId    int
+	locationName  string
+	warehouseId   int
+	warehouseName string
+	zone          string
+	pickSequence  int
+	capacity      float64
+	capacityType  string
+	enforcement   string
+	measured      bool    // whether the capacity measures the incoming stock
+	projectedUse  float64 // in the capacity measure, the put-away quantity included
+	storedQty     int
+	sameStockQty  int
+	whPriority    int
+}
+
+func createPutawayZoneRule(rule PutawayZoneRuleJSON, db *sql.DB) error {
+	_, err := db.Exec(`
+		INSERT INTO putaway_zone_rules (material_type, zone) VALUES ($1,$2)
+		ON CONFLICT DO NOTHING;`,
+		rule.MaterialType, rule.Zone)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func fetchPreferredZones(db *sql.DB, materialType string) (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT zone FROM putaway_zone_rules WHERE material_type::TEXT = $1;`,
+		materialType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := make(map[string]bool)
+	for rows.Next() {
+		var zone string
+		if err := rows.Scan(&zone); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+		zones[zone] = true
+	}
+
+	return zones, rows.Err()
+}
+
+// Ranks the locations an incoming material can be put to.
+// Only active storage locations whose storage rules let the stock in
+// are taken into account
+func suggestLocations(db *sql.DB, opts SuggestionFilter) ([]LocationSuggestion, error) {
+	var incomingMaterial IncomingMaterialDB
+
+	err := db.QueryRow(`
+		SELECT customer_id, stock_id, quantity, type, owner, requires_inspection,
+			lot_number
+		FROM incoming_materials
+		WHERE shipping_id = $1`, opts.shippingId).
+		Scan(
+			&incomingMaterial.CustomerID,
+			&incomingMaterial.StockID,
+			&incomingMaterial.Quantity,
+			&incomingMaterial.MaterialType,
+			&incomingMaterial.Owner,
+			&incomingMaterial.RequiresInspection,
+			&incomingMaterial.LotNumber,
+		)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("incoming material " + opts.shippingId + " is not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := statusAvailable
+	if incomingMaterial.RequiresInspection {
+		status = statusQCHold
+	}
+
+	quantity := incomingMaterial.Quantity
+	if qty, _ := strconv.Atoi(opts.quantity); qty > 0 {
+		quantity = qty
+	}
+
+	zones, err := fetchPreferredZones(db, incomingMaterial.MaterialType)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT l.location_id, l.name, w.warehouse_id, w.name,
+			COALESCE(l.zone, ''), l.pick_sequence, COALESCE(l.capacity, 0), l.capacity_type,
+			l.capacity_enforcement,
+			(
+				SELECT COALESCE(SUM(`+capacityUsage("l.capacity_type::TEXT", "s.quantity")+`), 0)
+				FROM (
+					SELECT stock_id, SUM(quantity) AS quantity FROM (
+						SELECT stock_id, quantity FROM materials
+						WHERE location_id = l.location_id AND quantity > 0
+						UNION ALL
+						SELECT $1::VARCHAR, $6::INT
+					) st GROUP BY stock_id
+				) s
+				LEFT JOIN stock_profiles sp ON sp.stock_id = s.stock_id
+			) AS "projected_usage",
+			COALESCE(SUM(m.quantity), 0) AS "stored_quantity",
+			COALESCE(SUM(m.quantity) FILTER (
+				WHERE m.stock_id = $1 AND m.owner::TEXT = $2
+					AND m.status::TEXT = $4 AND m.lot_number = $5), 0) AS "same_stock_quantity",
+			COALESCE(MIN(cw.priority), 0) AS "warehouse_priority"
+		FROM locations l
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		LEFT JOIN materials m ON m.location_id = l.location_id
+		LEFT JOIN customer_warehouses cw
+			ON cw.warehouse_id = l.warehouse_id AND cw.customer_id = $3
+		WHERE l.is_active AND w.is_active AND l.location_type = 'storage'
+		GROUP BY l.location_id, w.warehouse_id
+		HAVING l.storage_rule = 'mixed' OR COUNT(m.material_id) FILTER (
+			WHERE m.quantity > 0 AND (
+				(l.storage_rule = 'single_sku' AND m.stock_id <> $1) OR
+				(l.storage_rule = 'single_customer' AND m.customer_id IS DISTINCT FROM $3))) = 0;`,
+		incomingMaterial.StockID, incomingMaterial.Owner, incomingMaterial.CustomerID, status,
+		incomingMaterial.LotNumber, quantity)
+	if err != nil {
+		log.Println("Error suggestLocations1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []locationCandidate
+	for rows.Next() {
+		var c locationCandidate
+		if err := rows.Scan(
+			&c.locationId,
+			&c.locationName,
+			&c.warehouseId,
+			&c.warehouseName,
+			&c.zone,
+			&c.pickSequence,
+			&c.capacity,
+			&c.capacityType,
+			&c.enforcement,
+			&c.projectedUse,
+			&c.storedQty,
+			&c.sameStockQty,
+			&c.whPriority,
+		); err != nil {
+			log.Println("Error suggestLocations2: ", err)
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The projected usage leaves out stock the capacity cannot measure
+	measured := make(map[string]bool)
+	for i, c := range candidates {
+		if _, ok := measured[c.capacityType]; !ok {
+			measured[c.capacityType], err = isMeasured(db, c.capacityType, incomingMaterial.StockID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		candidates[i].measured = measured[c.capacityType]
+	}
+
+	suggestions := []LocationSuggestion{}
+	for _, c := range candidates {
+		suggestion, ok := scoreLocation(c, quantity, incomingMaterial, zones)
+		if ok {
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Score > suggestions[j].Score
+	})
+
+	if opts.limit > 0 && len(suggestions) > opts.limit {
+		suggestions = suggestions[:opts.limit]
+	}
+
+	return suggestions, nil
+}
+
+func scoreLocation(c locationCandidate, quantity int,
+	material IncomingMaterialDB, zones map[string]bool) (LocationSuggestion, bool) {
+	suggestion := LocationSuggestion{
+		LocationID:    c.locationId,
+		LocationName:  c.locationName,
+		WarehouseID:   c.warehouseId,
+		WarehouseName: c.warehouseName,
+		Zone:          c.zone,
+		Reasons:       []string{},
+	}
+
+	// Capacity is a hard rule, the rest only changes the ranking.
+	// Stock the capacity cannot measure is only let into locations which warn
+	if c.capacity > 0 && !c.measured {
+		if c.enforcement == enforceReject {
+			return suggestion, false
+		}
+		suggestion.Reasons = append(suggestion.Reasons,
+			fmt.Sprintf("Capacity in %s not checked, the %s of %s is not set",
+				c.capacityType, capacityDimension(c.capacityType), material.StockID))
+	} else if c.capacity > 0 {
+		if c.projectedUse > c.capacity {
+			return suggestion, false
+		}
+		suggestion.Score += capacityFitScore
+		suggestion.Reasons = append(suggestion.Reasons, capacityFitReason(c, quantity))
+	}
+
+	if c.sameStockQty > 0 {
+		suggestion.Score += consolidationScore
+		suggestion.Reasons = append(suggestion.Reasons,
+			fmt.Sprintf("Consolidates with %d units of %s already stored", c.sameStockQty, material.StockID))
+	} else if c.storedQty == 0 {
+		suggestion.Reasons = append(suggestion.Reasons, "Empty location")
+	}
+
+	if c.whPriority > 0 {
+		score := preferredWhScore - (c.whPriority-1)*preferredWhStep
+		if score < preferredWhStep {
+			score = preferredWhStep
+		}
+		suggestion.Score += score
+		suggestion.Reasons = append(suggestion.Reasons,
+			fmt.Sprintf("Preferred warehouse of the customer (priority %d)", c.whPriority))
+	}
+
+	if c.zone != "" && zones[c.zone] {
+		suggestion.Score += preferredZoneScore
+		suggestion.Reasons = append(suggestion.Reasons,
+			fmt.Sprintf("Zone %s is preferred for %s", c.zone, material.MaterialType))
+	}
+
+	// The closer to the dock the better
+	distanceScore := maxDistanceScore - c.pickSequence/distanceScoreDivisor
+	if distanceScore > 0 {
+		suggestion.Score += distanceScore
+		suggestion.Reasons = append(suggestion.Reasons,
+			fmt.Sprintf("Pick sequence %d from the dock", c.pickSequence))
+	}
+
+	return suggestion, true
+}
+
+func capacityFitReason(c locationCandidate, quantity int) string {
+	used, capacity := formatMeasure(c.projectedUse), formatMeasure(c.capacity)
+	switch c.capacityType {
+	case capacityPallets:
+		return fmt.Sprintf("Fits %d units on %s of %s pallets after put-away", quantity, used, capacity)
+	case capacityVolume:
+		return fmt.Sprintf("Fits in the volume, %s of %s used after put-away", used, capacity)
+	case capacityWeight:
+		return fmt.Sprintf("Within the weight limit, %s of %s used after put-away", used, capacity)
+	}
+	return fmt.Sprintf("Fits %d units, %s of %s units used after put-away", quantity, used, capacity)
+}
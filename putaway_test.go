@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScoreLocation(t *testing.T) {
+	material := IncomingMaterialDB{StockID: "STK-1", MaterialType: "LABELS"}
+	zones := map[string]bool{"A": true}
+
+	tests := []struct {
+		name      string
+		candidate locationCandidate
+		ok        bool
+		score     int
+		reasons   []string
+	}{
+		{
+			name:      "empty location far from the dock",
+			candidate: locationCandidate{pickSequence: 100},
+			ok:        true,
+			score:     0,
+			reasons:   []string{"Empty location"},
+		},
+		{
+			name: "consolidation in a preferred zone and warehouse",
+			candidate: locationCandidate{
+				zone: "A", pickSequence: 20, storedQty: 5, sameStockQty: 5, whPriority: 2,
+			},
+			ok:    true,
+			score: consolidationScore + preferredWhScore - preferredWhStep + preferredZoneScore + 8,
+			reasons: []string{
+				"Consolidates with 5 units of STK-1 already stored",
+				"Preferred warehouse of the customer (priority 2)",
+				"Zone A is preferred for LABELS",
+				"Pick sequence 20 from the dock",
+			},
+		},
+		{
+			name: "low warehouse priority keeps the least score",
+			candidate: locationCandidate{
+				pickSequence: 100, storedQty: 1, whPriority: 9,
+			},
+			ok:      true,
+			score:   preferredWhStep,
+			reasons: []string{"Preferred warehouse of the customer (priority 9)"},
+		},
+		{
+			name: "fits the units",
+			candidate: locationCandidate{
+				pickSequence: 100, capacity: 100, capacityType: capacityUnits,
+				enforcement: enforceReject, measured: true, projectedUse: 40,
+			},
+			ok:    true,
+			score: capacityFitScore,
+			reasons: []string{
+				"Fits 10 units, 40 of 100 units used after put-away",
+				"Empty location",
+			},
+		},
+		{
+			name: "fits on the pallets",
+			candidate: locationCandidate{
+				pickSequence: 100, capacity: 4, capacityType: capacityPallets,
+				enforcement: enforceReject, measured: true, projectedUse: 2.5,
+			},
+			ok:    true,
+			score: capacityFitScore,
+			reasons: []string{
+				"Fits 10 units on 2.5 of 4 pallets after put-away",
+				"Empty location",
+			},
+		},
+		{
+			name: "over the capacity",
+			candidate: locationCandidate{
+				capacity: 100, capacityType: capacityUnits,
+				enforcement: enforceWarn, measured: true, projectedUse: 101,
+			},
+			ok: false,
+		},
+		{
+			name: "unmeasured stock in a rejecting location",
+			candidate: locationCandidate{
+				capacity: 10, capacityType: capacityWeight, enforcement: enforceReject,
+			},
+			ok: false,
+		},
+		{
+			name: "unmeasured stock in a warning location",
+			candidate: locationCandidate{
+				pickSequence: 100, capacity: 10, capacityType: capacityWeight, enforcement: enforceWarn,
+			},
+			ok:    true,
+			score: 0,
+			reasons: []string{
+				"Capacity in weight not checked, the unit weight of STK-1 is not set",
+				"Empty location",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suggestion, ok := scoreLocation(tt.candidate, 10, material, zones)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if suggestion.Score != tt.score {
+				t.Errorf("score = %d, want %d", suggestion.Score, tt.score)
+			}
+			if !reflect.DeepEqual(suggestion.Reasons, tt.reasons) {
+				t.Errorf("reasons = %q, want %q", suggestion.Reasons, tt.reasons)
+			}
+		})
+	}
+}
@@ -9,22 +9,33 @@ import (
 )
 
 type Transaction struct {
-	StockID      string    `field:"stock_id"`
-	LocationName string    `field:"location_name"`
-	MaterialType string    `field:"material_type"`
-	Qty          int       `field:"quantity"`
-	UnitCost     float64   `field:"unit_cost"`
-	Cost         float64   `field:"cost"`
-	UpdatedAt    time.Time `field:"updated_at"`
-	TotalValue   float64   `field:"total_value"`
+	TransactionID  int       `field:"transaction_id"`
+	Type           string    `field:"transaction_type"`
+	StockID        string    `field:"stock_id"`
+	LocationName   string    `field:"location_name"`
+	MaterialType   string    `field:"material_type"`
+	LotNumber      string    `field:"lot_number"`
+	ExpirationDate string    `field:"expiration_date"`
+	Qty            int       `field:"quantity"`
+	UnitCost       float64   `field:"unit_cost"`
+	Cost           float64   `field:"cost"`
+	UpdatedAt      time.Time `field:"updated_at"`
+	TotalValue     float64   `field:"total_value"`
 }
 
 type SearchQuery struct {
-	customerId   int
-	materialType string
-	dateFrom     string
-	dateTo       string
-	dateAsOf     string
+	customerId    int
+	materialType  string
+	dateFrom      string
+	dateTo        string
+	dateAsOf      string
+	lotNumber     string
+	expiresBefore string
+	reasonCode    string
+	locationId    int
+	rollUpLevel   string
+	warehouseId   int
+	owner         string
 }
 
 type Report struct {
@@ -41,27 +52,101 @@ type BalanceReport struct {
 	blcFilter SearchQuery
 }
 
+type ShrinkageReport struct {
+	Report
+	shrFilter SearchQuery
+}
+
+type OccupancyReport struct {
+	Report
+	occFilter SearchQuery
+}
+
 type TransactionRep struct {
-	StockID      string
-	MaterialType string
-	Qty          string
-	UnitCost     string
-	Cost         string
-	Date         string
+	TransactionID string
+	Type          string
+	StockID       string
+	MaterialType  string
+	LotNumber     string
+	Qty           string
+	UnitCost      string
+	Cost          string
+	Date          string
 }
 
 type BalanceRep struct {
-	StockID      string
-	LocationName string
-	MaterialType string
+	StockID        string
+	LocationName   string
+	MaterialType   string
+	LotNumber      string
+	ExpirationDate string
+	Qty            string
+	AvailableQty   string
+	QCHoldQty      string
+	QuarantinedQty string
+	DamagedQty     string
+	ReservedQty    string
+	UnreservedQty  string
+	TotalValue     string
+}
+
+type ShrinkageRep struct {
+	ReasonCode   string
+	CustomerName string
+	Period       string
 	Qty          string
 	TotalValue   string
 }
 
+// Zones of a warehouse are listed under its totals
+type OccupancyRep struct {
+	WarehouseName string
+	Zone          string
+	Locations     string
+	Occupied      string
+	Empty         string
+	MixedSku      string // locations holding several stocks
+	Qty           string
+	TotalValue    string
+	Utilization   []UtilizationRep
+	Zones         []OccupancyRep `json:",omitempty"`
+}
+
+type UtilizationRep struct {
+	CapacityType string
+	Capacity     string
+	Used         string
+	Percent      string
+}
+
+type occupancy struct {
+	warehouseName string
+	zone          string
+	locations     int
+	occupied      int
+	empty         int
+	mixedSku      int
+	qty           int
+	value         float64
+	capacityTypes []string
+	capacity      map[string]float64
+	used          map[string]float64
+}
+
+type BalanceByStatus struct {
+	AvailableQty   int `field:"available_quantity"`
+	QCHoldQty      int `field:"qc_hold_quantity"`
+	QuarantinedQty int `field:"quarantined_quantity"`
+	DamagedQty     int `field:"damaged_quantity"`
+	ReservedQty    int `field:"reserved_quantity"`
+}
+
 var accLib accounting.Accounting = accounting.Accounting{Symbol: "$", Precision: 2}
 
 func (t TransactionReport) getReportList() ([]TransactionRep, error) {
-	rows, err := t.db.Query(`SELECT tl.stock_id, m.material_type,
+	rows, err := t.db.Query(`WITH RECURSIVE `+locationAncestors+`
+							 SELECT tl.transaction_id, tl.transaction_type,
+								tl.stock_id, m.material_type, m.lot_number,
 								tl.quantity_change as "quantity",
 								tl.cost as "unit_cost",
 								(tl.quantity_change * tl.cost) as "cost",
@@ -73,9 +158,14 @@ func (t TransactionReport) getReportList() ([]TransactionRep, error) {
 								($1 = 0 OR m.customer_id = $1) AND
 								($2 = '' OR m.material_type::TEXT = $2) AND
 								($3 = '' OR tl.updated_at::TEXT >= $3) AND
-								($4 = '' OR tl.updated_at::TEXT <= $4)
+								($4 = '' OR tl.updated_at::TEXT <= $4) AND
+								($5 = '' OR m.lot_number = $5) AND
+								($6 = '' OR m.expiration_date::TEXT <= $6) AND
+								($7 = 0 OR m.location_id IN (
+									SELECT location_id FROM location_ancestors WHERE ancestor_id = $7))
 							 ORDER BY transaction_id;`,
-		t.trxFilter.customerId, t.trxFilter.materialType, t.trxFilter.dateFrom, t.trxFilter.dateTo)
+		t.trxFilter.customerId, t.trxFilter.materialType, t.trxFilter.dateFrom, t.trxFilter.dateTo,
+		t.trxFilter.lotNumber, t.trxFilter.expiresBefore, t.trxFilter.locationId)
 	if err != nil {
 		return []TransactionRep{}, err
 	}
@@ -86,8 +176,11 @@ func (t TransactionReport) getReportList() ([]TransactionRep, error) {
 		trx := Transaction{}
 
 		err := rows.Scan(
+			&trx.TransactionID,
+			&trx.Type,
 			&trx.StockID,
 			&trx.MaterialType,
+			&trx.LotNumber,
 			&trx.Qty,
 			&trx.UnitCost,
 			&trx.Cost,
@@ -105,12 +198,15 @@ func (t TransactionReport) getReportList() ([]TransactionRep, error) {
 		cost := accLib.FormatMoney(trx.Cost)
 
 		trxList = append(trxList, TransactionRep{
-			StockID:      trx.StockID,
-			MaterialType: trx.MaterialType,
-			Qty:          strconv.Itoa(trx.Qty),
-			UnitCost:     unitCost,
-			Cost:         cost,
-			Date:         strDate,
+			TransactionID: strconv.Itoa(trx.TransactionID),
+			Type:          trx.Type,
+			StockID:       trx.StockID,
+			MaterialType:  trx.MaterialType,
+			LotNumber:     trx.LotNumber,
+			Qty:           strconv.Itoa(trx.Qty),
+			UnitCost:      unitCost,
+			Cost:          cost,
+			Date:          strDate,
 		})
 	}
 
@@ -118,22 +214,46 @@ func (t TransactionReport) getReportList() ([]TransactionRep, error) {
 }
 
 func (b BalanceReport) getReportList() ([]BalanceRep, error) {
+	// Locations below the roll-up level are reported as their ancestor at that level.
+	// Status changes move stock between rows, so the status of a row holds as of any date
 	rows, err := b.db.Query(`
+	WITH RECURSIVE `+locationAncestors+`
 	SELECT m.stock_id,
 		   l.name as "location_name",
 		   m.material_type,
+		   m.lot_number,
+		   COALESCE(TO_CHAR(m.expiration_date, 'YYYY-MM-DD'), '') AS "expiration_date",
 		   SUM(tl.quantity_change) AS "quantity",
+		   SUM(tl.quantity_change) FILTER (WHERE m.status = 'available') AS "available_quantity",
+		   SUM(tl.quantity_change) FILTER (WHERE m.status = 'qc_hold') AS "qc_hold_quantity",
+		   SUM(tl.quantity_change) FILTER (WHERE m.status = 'quarantined') AS "quarantined_quantity",
+		   SUM(tl.quantity_change) FILTER (WHERE m.status = 'damaged') AS "damaged_quantity",
+		   (
+				SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+				WHERE r.material_id = ANY(ARRAY_AGG(DISTINCT m.material_id))
+					AND `+activeReservation+`
+		   ) AS "reserved_quantity",
 		   SUM(tl.quantity_change * tl.cost) AS "total_value"
 	FROM transactions_log tl
 	LEFT JOIN materials m ON m.material_id = tl.material_id
-	LEFT JOIN locations l ON l.location_id = m.location_id
+	LEFT JOIN locations l ON l.location_id = COALESCE((
+		SELECT la.ancestor_id FROM location_ancestors la
+		JOIN locations a ON a.location_id = la.ancestor_id
+		WHERE la.location_id = m.location_id AND a.level::TEXT = $7
+	), m.location_id)
 	WHERE
 		($1 = 0 OR m.customer_id = $1) AND
 		($2 = '' OR m.material_type::TEXT = $2) AND
-		($3 = '' OR tl.updated_at::TEXT <= $3)
-	GROUP BY m.stock_id, l.name, m.material_type
+		($3 = '' OR tl.updated_at::TEXT <= $3) AND
+		($4 = '' OR m.lot_number = $4) AND
+		($5 = '' OR m.expiration_date::TEXT <= $5) AND
+		($6 = 0 OR m.location_id IN (
+			SELECT location_id FROM location_ancestors WHERE ancestor_id = $6))
+	GROUP BY m.stock_id, l.name, m.material_type, m.lot_number, m.expiration_date
 `,
 		b.blcFilter.customerId, b.blcFilter.materialType, b.blcFilter.dateAsOf,
+		b.blcFilter.lotNumber, b.blcFilter.expiresBefore, b.blcFilter.locationId,
+		b.blcFilter.rollUpLevel,
 	)
 	if err != nil {
 		return []BalanceRep{}, err
@@ -143,28 +263,265 @@ func (b BalanceReport) getReportList() ([]BalanceRep, error) {
 
 	for rows.Next() {
 		balance := Transaction{}
+		var byStatus [4]sql.NullInt64
+		var reservedQty int
 
 		err := rows.Scan(
 			&balance.StockID,
 			&balance.LocationName,
 			&balance.MaterialType,
+			&balance.LotNumber,
+			&balance.ExpirationDate,
 			&balance.Qty,
+			&byStatus[0],
+			&byStatus[1],
+			&byStatus[2],
+			&byStatus[3],
+			&reservedQty,
 			&balance.TotalValue,
 		)
 		if err != nil {
 			return []BalanceRep{}, err
 		}
 
+		statusQty := BalanceByStatus{
+			AvailableQty:   int(byStatus[0].Int64),
+			QCHoldQty:      int(byStatus[1].Int64),
+			QuarantinedQty: int(byStatus[2].Int64),
+			DamagedQty:     int(byStatus[3].Int64),
+			ReservedQty:    reservedQty,
+		}
+
 		totalValue := accLib.FormatMoney(balance.TotalValue)
 		blcList = append(blcList, BalanceRep{
-			StockID:      balance.StockID,
-			LocationName: balance.LocationName,
-			MaterialType: balance.MaterialType,
-			Qty:          strconv.Itoa(balance.Qty),
-			TotalValue:   totalValue,
+			StockID:        balance.StockID,
+			LocationName:   balance.LocationName,
+			MaterialType:   balance.MaterialType,
+			LotNumber:      balance.LotNumber,
+			ExpirationDate: balance.ExpirationDate,
+			Qty:            strconv.Itoa(balance.Qty),
+			AvailableQty:   strconv.Itoa(statusQty.AvailableQty),
+			QCHoldQty:      strconv.Itoa(statusQty.QCHoldQty),
+			QuarantinedQty: strconv.Itoa(statusQty.QuarantinedQty),
+			DamagedQty:     strconv.Itoa(statusQty.DamagedQty),
+			ReservedQty:    strconv.Itoa(statusQty.ReservedQty),
+			UnreservedQty:  strconv.Itoa(max(statusQty.AvailableQty-statusQty.ReservedQty, 0)),
+			TotalValue:     totalValue,
 		})
 	}
 
 	return blcList, err
 
 }
+
+// Adjustments by reason, customer and month. Reversed adjustments net out
+func (s ShrinkageReport) getReportList() ([]ShrinkageRep, error) {
+	rows, err := s.db.Query(`
+	SELECT tl.reason_code,
+		   COALESCE(c.name, '') AS "customer_name",
+		   TO_CHAR(tl.updated_at, 'YYYY-MM') AS "period",
+		   SUM(tl.quantity_change) AS "quantity",
+		   SUM(tl.quantity_change * tl.cost) AS "total_value"
+	FROM transactions_log tl
+	LEFT JOIN materials m ON m.material_id = tl.material_id
+	LEFT JOIN customers c ON c.customer_id = m.customer_id
+	WHERE
+		tl.reason_code IS NOT NULL AND
+		($1 = 0 OR m.customer_id = $1) AND
+		($2 = '' OR tl.updated_at::TEXT >= $2) AND
+		($3 = '' OR tl.updated_at::TEXT <= $3) AND
+		($4 = '' OR tl.reason_code = $4)
+	GROUP BY tl.reason_code, c.name, TO_CHAR(tl.updated_at, 'YYYY-MM')
+	ORDER BY "period", tl.reason_code, c.name;`,
+		s.shrFilter.customerId, s.shrFilter.dateFrom, s.shrFilter.dateTo, s.shrFilter.reasonCode,
+	)
+	if err != nil {
+		return []ShrinkageRep{}, err
+	}
+	defer rows.Close()
+
+	shrList := []ShrinkageRep{}
+	for rows.Next() {
+		var reasonCode, customerName, period string
+		var qty int
+		var totalValue float64
+
+		err := rows.Scan(&reasonCode, &customerName, &period, &qty, &totalValue)
+		if err != nil {
+			return []ShrinkageRep{}, err
+		}
+
+		shrList = append(shrList, ShrinkageRep{
+			ReasonCode:   reasonCode,
+			CustomerName: customerName,
+			Period:       period,
+			Qty:          strconv.Itoa(qty),
+			TotalValue:   accLib.FormatMoney(totalValue),
+		})
+	}
+
+	return shrList, rows.Err()
+}
+
+// Counts the locations stock can be put in: the ones without children and
+// any holding stock. Occupancy, quantity, value and usage are of the stock of
+// the customer and owner filtered, a location is empty when it holds no stock at all
+func (o OccupancyReport) getReportList() ([]OccupancyRep, error) {
+	usage := capacityUsage("p.capacity_type::TEXT", "s.quantity")
+	rows, err := o.db.Query(`
+	WITH stored AS (
+		SELECT m.location_id, m.stock_id, SUM(m.quantity) AS "quantity",
+			SUM(COALESCE((
+				SELECT SUM(tl.quantity_change * tl.cost) FROM transactions_log tl
+				WHERE tl.material_id = m.material_id
+			), 0)) AS "value"
+		FROM materials m
+		WHERE
+			m.quantity > 0 AND
+			($1 = 0 OR m.customer_id = $1) AND
+			($2 = '' OR m.owner::TEXT = $2)
+		GROUP BY m.location_id, m.stock_id
+	),
+	stocked AS (
+		SELECT DISTINCT location_id FROM materials WHERE quantity > 0
+	),
+	per_location AS (
+		SELECT p.location_id, p.warehouse_id, COALESCE(p.zone, '') AS "zone",
+			p.capacity_type, COALESCE(p.capacity, 0) AS "capacity",
+			COUNT(s.stock_id) AS "stocks",
+			COALESCE(SUM(s.quantity), 0) AS "quantity",
+			COALESCE(SUM(s.value), 0) AS "value",
+			COALESCE(SUM(`+usage+`), 0) AS "used",
+			p.location_id IN (SELECT location_id FROM stocked) AS "has_stock"
+		FROM locations p
+		LEFT JOIN stored s ON s.location_id = p.location_id
+		LEFT JOIN stock_profiles sp ON sp.stock_id = s.stock_id
+		WHERE
+			p.is_active AND
+			p.warehouse_id IS NOT NULL AND
+			($3 = 0 OR p.warehouse_id = $3) AND (
+				NOT EXISTS (SELECT 1 FROM locations ch WHERE ch.parent_id = p.location_id) OR
+				p.location_id IN (SELECT location_id FROM stocked))
+		GROUP BY p.location_id
+	)
+	SELECT w.name, pl.zone, pl.capacity_type,
+		COUNT(*) AS "locations",
+		COUNT(*) FILTER (WHERE pl.stocks > 0) AS "occupied",
+		COUNT(*) FILTER (WHERE NOT pl.has_stock) AS "empty",
+		COUNT(*) FILTER (WHERE pl.stocks > 1) AS "mixed_sku",
+		SUM(pl.quantity) AS "quantity",
+		SUM(pl.value) AS "total_value",
+		SUM(pl.capacity) AS "capacity",
+		SUM(pl.used) FILTER (WHERE pl.capacity > 0) AS "used"
+	FROM per_location pl
+	LEFT JOIN warehouses w ON w.warehouse_id = pl.warehouse_id
+	WHERE w.is_active
+	GROUP BY w.warehouse_id, w.name, pl.zone, pl.capacity_type
+	ORDER BY w.name, w.warehouse_id, pl.zone, pl.capacity_type;`,
+		o.occFilter.customerId, o.occFilter.owner, o.occFilter.warehouseId,
+	)
+	if err != nil {
+		return []OccupancyRep{}, err
+	}
+	defer rows.Close()
+
+	warehouses := []*occupancy{}
+	zones := make(map[*occupancy][]*occupancy)
+	for rows.Next() {
+		row := occupancy{}
+		var capacityType string
+		var capacity float64
+		var used sql.NullFloat64
+
+		err := rows.Scan(
+			&row.warehouseName,
+			&row.zone,
+			&capacityType,
+			&row.locations,
+			&row.occupied,
+			&row.empty,
+			&row.mixedSku,
+			&row.qty,
+			&row.value,
+			&capacity,
+			&used,
+		)
+		if err != nil {
+			return []OccupancyRep{}, err
+		}
+
+		if len(warehouses) == 0 || warehouses[len(warehouses)-1].warehouseName != row.warehouseName {
+			warehouses = append(warehouses, &occupancy{warehouseName: row.warehouseName})
+		}
+		warehouse := warehouses[len(warehouses)-1]
+		warehouseZones := zones[warehouse]
+		if len(warehouseZones) == 0 || warehouseZones[len(warehouseZones)-1].zone != row.zone {
+			zones[warehouse] = append(warehouseZones, &occupancy{warehouseName: row.warehouseName, zone: row.zone})
+		}
+		zone := zones[warehouse][len(zones[warehouse])-1]
+
+		for _, group := range []*occupancy{warehouse, zone} {
+			group.add(row, capacityType, capacity, used.Float64)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return []OccupancyRep{}, err
+	}
+
+	occList := []OccupancyRep{}
+	for _, warehouse := range warehouses {
+		rep := warehouse.rep()
+		for _, zone := range zones[warehouse] {
+			rep.Zones = append(rep.Zones, zone.rep())
+		}
+		occList = append(occList, rep)
+	}
+
+	return occList, nil
+}
+
+func (o *occupancy) add(row occupancy, capacityType string, capacity float64, used float64) {
+	o.locations += row.locations
+	o.occupied += row.occupied
+	o.empty += row.empty
+	o.mixedSku += row.mixedSku
+	o.qty += row.qty
+	o.value += row.value
+
+	if capacity <= 0 {
+		return
+	}
+	if o.capacity == nil {
+		o.capacity = make(map[string]float64)
+		o.used = make(map[string]float64)
+	}
+	if _, ok := o.capacity[capacityType]; !ok {
+		o.capacityTypes = append(o.capacityTypes, capacityType)
+	}
+	o.capacity[capacityType] += capacity
+	o.used[capacityType] += used
+}
+
+func (o *occupancy) rep() OccupancyRep {
+	rep := OccupancyRep{
+		WarehouseName: o.warehouseName,
+		Zone:          o.zone,
+		Locations:     strconv.Itoa(o.locations),
+		Occupied:      strconv.Itoa(o.occupied),
+		Empty:         strconv.Itoa(o.empty),
+		MixedSku:      strconv.Itoa(o.mixedSku),
+		Qty:           strconv.Itoa(o.qty),
+		TotalValue:    accLib.FormatMoney(o.value),
+		Utilization:   []UtilizationRep{},
+	}
+	for _, capacityType := range o.capacityTypes {
+		capacity, used := o.capacity[capacityType], o.used[capacityType]
+		rep.Utilization = append(rep.Utilization, UtilizationRep{
+			CapacityType: capacityType,
+			Capacity:     formatMeasure(capacity),
+			Used:         formatMeasure(used),
+			Percent:      formatMeasure(utilizationPercent(used, capacity)) + "%",
+		})
+	}
+	return rep
+}
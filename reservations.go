@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Expired and fully consumed reservations do not hold any stock
+const activeReservation = `r.quantity > 0 AND (r.expires_at IS NULL OR r.expires_at > NOW())`
+
+type ReservationJSON struct {
+	MaterialID string `json:"materialId"`
+	StockID    string `json:"stockId"`
+	CustomerID string `json:"customerId"`
+	JobTicket  string `json:"jobTicket"`
+	Qty        string `json:"quantity"`
+	ExpiresAt  string `json:"expiresAt"`
+}
+
+type ReservationDB struct {
+	ReservationID int       `field:"reservation_id"`
+	MaterialID    int       `field:"material_id"`
+	StockID       string    `field:"stock_id"`
+	CustomerID    int       `field:"customer_id"`
+	CustomerName  string    `field:"customer_name"`
+	JobTicket     string    `field:"job_ticket"`
+	Quantity      int       `field:"quantity"`
+	ExpiresAt     string    `field:"expires_at"`
+	CreatedAt     time.Time `field:"created_at"`
+}
+
+// Available-to-promise quantity of a stock
+type StockAvailability struct {
+	StockID      string
+	CustomerID   int
+	CustomerName string
+	OnHandQty    int
+	ReservedQty  int
+	AvailableQty int
+}
+
+func createReservation(reservation ReservationJSON, db *sql.DB) (int, error) {
+	qty, _ := strconv.Atoi(reservation.Qty)
+	if qty <= 0 {
+		return 0, errors.New("Reservation quantity must be positive")
+	}
+
+	materialId, _ := strconv.Atoi(reservation.MaterialID)
+	stockId := reservation.StockID
+	customerId, _ := strconv.Atoi(reservation.CustomerID)
+
+	if materialId != 0 {
+		// Reservation against a material row
+		currMaterial, err := getMaterialById(materialId, db)
+		if err != nil {
+			return 0, err
+		}
+		if currMaterial.Status != statusAvailable {
+			return 0, errors.New(`The material is not available for reservation (status: ` + currMaterial.Status + `)`)
+		}
+		if err := checkNotInTransit(db, currMaterial.LocationID); err != nil {
+			return 0, err
+		}
+
+		reserved, err := reservedForMaterial(db, materialId, "")
+		if err != nil {
+			return 0, err
+		}
+		if currMaterial.Quantity-reserved < qty {
+			return 0, errors.New(`The reserving quantity (` + strconv.Itoa(qty) +
+				`) is more than the unreserved one (` + strconv.Itoa(currMaterial.Quantity-reserved) + `)`)
+		}
+
+		stockId = currMaterial.StockID
+		customerId = currMaterial.CustomerID
+	} else {
+		// Reservation against a stock anywhere in the warehouses
+		if stockId == "" {
+			return 0, errors.New("Either material ID or stock ID is required")
+		}
+
+		availability, err := fetchStockAvailability(db, stockId, customerId, "")
+		if err != nil {
+			return 0, err
+		}
+		if availability.AvailableQty < qty {
+			return 0, errors.New(`The reserving quantity (` + strconv.Itoa(qty) +
+				`) is more than the available one (` + strconv.Itoa(availability.AvailableQty) + `)`)
+		}
+	}
+
+	var reservationId int
+	err := db.QueryRow(`
+		INSERT INTO reservations
+			(material_id, stock_id, customer_id, job_ticket, quantity, expires_at)
+		VALUES (NULLIF($1, 0), $2, NULLIF($3, 0), $4, $5, NULLIF($6, '')::TIMESTAMP)
+		RETURNING reservation_id;`,
+		materialId, stockId, customerId, reservation.JobTicket, qty, reservation.ExpiresAt,
+	).Scan(&reservationId)
+	if err != nil {
+		return 0, err
+	}
+
+	return reservationId, nil
+}
+
+func fetchReservations(db *sql.DB) ([]ReservationDB, error) {
+	rows, err := db.Query(`
+		SELECT r.reservation_id, COALESCE(r.material_id, 0), r.stock_id,
+			COALESCE(r.customer_id, 0), COALESCE(c.name, ''), COALESCE(r.job_ticket, ''),
+			r.quantity, COALESCE(TO_CHAR(r.expires_at, 'YYYY-MM-DD HH24:MI'), ''), r.created_at
+		FROM reservations r
+		LEFT JOIN customers c ON c.customer_id = r.customer_id
+		WHERE ` + activeReservation + `
+		ORDER BY r.reservation_id;`)
+	if err != nil {
+		log.Println("Error fetchReservations1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []ReservationDB{}
+	for rows.Next() {
+		var reservation ReservationDB
+		if err := rows.Scan(
+			&reservation.ReservationID,
+			&reservation.MaterialID,
+			&reservation.StockID,
+			&reservation.CustomerID,
+			&reservation.CustomerName,
+			&reservation.JobTicket,
+			&reservation.Quantity,
+			&reservation.ExpiresAt,
+			&reservation.CreatedAt,
+		); err != nil {
+			log.Println("Error fetchReservations2: ", err)
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, rows.Err()
+}
+
+func deleteReservation(db *sql.DB, reservationId int) error {
+	res, err := db.Exec(`DELETE FROM reservations WHERE reservation_id = $1;`, reservationId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Reservation " + strconv.Itoa(reservationId) + " is not found")
+	}
+
+	return nil
+}
+
+// Quantity of the material row reserved by anyone but the given job
+func reservedForMaterial(db dbExecutor, materialId int, exceptJobTicket string) (int, error) {
+	var reserved int
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+		WHERE r.material_id = $1
+			AND ($2 = '' OR COALESCE(r.job_ticket, '') <> $2)
+			AND `+activeReservation+`;`,
+		materialId, exceptJobTicket).Scan(&reserved)
+	if err != nil {
+		return 0, err
+	}
+
+	return reserved, nil
+}
+
+// Stock in transit between warehouses is neither on hand nor available
+func fetchStockAvailability(db dbExecutor, stockId string, customerId int, exceptJobTicket string) (StockAvailability, error) {
+	availability := StockAvailability{StockID: stockId, CustomerID: customerId}
+
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(m.quantity), 0) FROM materials m
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		WHERE m.stock_id = $1
+			AND m.status = 'available'
+			AND l.location_type <> 'in_transit'
+			AND ($2 = 0 OR m.customer_id = $2);`,
+		stockId, customerId).Scan(&availability.OnHandQty)
+	if err != nil {
+		return availability, err
+	}
+
+	// Both the reservations of material rows and of the stock itself
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+		LEFT JOIN materials m ON m.material_id = r.material_id
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		WHERE r.stock_id = $1
+			AND (r.material_id IS NULL OR (m.status = 'available' AND l.location_type <> 'in_transit'))
+			AND ($2 = 0 OR COALESCE(m.customer_id, r.customer_id, $2) = $2)
+			AND ($3 = '' OR COALESCE(r.job_ticket, '') <> $3)
+			AND `+activeReservation+`;`,
+		stockId, customerId, exceptJobTicket).Scan(&availability.ReservedQty)
+	if err != nil {
+		return availability, err
+	}
+
+	availability.AvailableQty = max(availability.OnHandQty-availability.ReservedQty, 0)
+
+	return availability, nil
+}
+
+func fetchStockAvailabilities(db *sql.DB, stockId string) ([]StockAvailability, error) {
+	rows, err := db.Query(`
+		SELECT m.stock_id, m.customer_id, COALESCE(c.name, '')
+		FROM materials m
+		LEFT JOIN customers c ON c.customer_id = m.customer_id
+		WHERE ($1 = '' OR m.stock_id = $1)
+		GROUP BY m.stock_id, m.customer_id, c.name
+		ORDER BY m.stock_id, c.name;`, stockId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying stock availability: %w", err)
+	}
+	defer rows.Close()
+
+	var stocks []StockAvailability
+	for rows.Next() {
+		var stock StockAvailability
+		if err := rows.Scan(&stock.StockID, &stock.CustomerID, &stock.CustomerName); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+		stocks = append(stocks, stock)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	availabilities := []StockAvailability{}
+	for _, stock := range stocks {
+		availability, err := fetchStockAvailability(db, stock.StockID, stock.CustomerID, "")
+		if err != nil {
+			return nil, err
+		}
+		availability.CustomerName = stock.CustomerName
+		availabilities = append(availabilities, availability)
+	}
+
+	return availabilities, nil
+}
+
+// Makes sure the quantity taken from the material is not reserved by others.
+// Moves keep the stock in the warehouse, so only the material row is checked
+func checkReservations(db dbExecutor, material MaterialDB, quantity int, jobTicket string, isMove bool) error {
+	reserved, err := reservedForMaterial(db, material.MaterialID, jobTicket)
+	if err != nil {
+		return err
+	}
+	if material.Quantity-reserved < quantity {
+		return errors.New(`Only ` + strconv.Itoa(max(material.Quantity-reserved, 0)) +
+			` of the material are not reserved. Override the reservations to proceed`)
+	}
+
+	if isMove {
+		return nil
+	}
+
+	availability, err := fetchStockAvailability(db, material.StockID, material.CustomerID, jobTicket)
+	if err != nil {
+		return err
+	}
+	if availability.AvailableQty < quantity {
+		return errors.New(`Only ` + strconv.Itoa(availability.AvailableQty) + ` of the stock ` + material.StockID +
+			` are not reserved. Override the reservations to proceed`)
+	}
+
+	return nil
+}
+
+// Removals for a job use up its reservations, the ones of the material row first
+func consumeReservations(db dbExecutor, jobTicket string, material MaterialDB, quantity int) error {
+	if jobTicket == "" {
+		return nil
+	}
+
+	rows, err := db.Query(`
+		SELECT r.reservation_id, r.quantity FROM reservations r
+		WHERE r.job_ticket = $1
+			AND (r.material_id = $2 OR (r.material_id IS NULL AND r.stock_id = $3))
+			AND `+activeReservation+`
+		ORDER BY r.material_id NULLS LAST, r.reservation_id;`,
+		jobTicket, material.MaterialID, material.StockID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	consumed := make(map[int]int)
+	var order []int
+	for rows.Next() && quantity > 0 {
+		var reservationId, reservedQty int
+		if err := rows.Scan(&reservationId, &reservedQty); err != nil {
+			return err
+		}
+		take := min(reservedQty, quantity)
+		consumed[reservationId] = take
+		order = append(order, reservationId)
+		quantity -= take
+	}
+	rows.Close()
+
+	for _, reservationId := range order {
+		_, err := db.Exec(`
+			UPDATE reservations SET quantity = quantity - $1 WHERE reservation_id = $2;`,
+			consumed[reservationId], reservationId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
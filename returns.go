@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Return removed material to the stock
+type ReturnJSON struct {
+	TransactionID string   `json:"transactionId"`
+	JobTicket     string   `json:"jobTicket"`
+	StockID       string   `json:"stockId"`
+	LocationID    string   `json:"locationId"`
+	Qty           string   `json:"quantity"`
+	Notes         string   `json:"notes"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+// Removal log entry and the quantity of it not returned yet
+type returnableRemoval struct {
+	transactionId int
+	materialId    int
+	stockId       string
+	layerId       int
+	cost          float64
+	jobTicket     string
+	returnableQty int
+}
+
+// Returns the quantity of a removal or of the removals of a job.
+// The latest removals are returned first, each to the cost layer it was taken from
+func returnMaterial(ret ReturnJSON, db *sql.DB) ([]int, error) {
+	quantity, _ := strconv.Atoi(ret.Qty)
+	if quantity <= 0 {
+		return nil, errors.New("Quantity must be positive")
+	}
+
+	transactionId, _ := strconv.Atoi(ret.TransactionID)
+	if transactionId == 0 && ret.JobTicket == "" {
+		return nil, errors.New("Either transaction ID or job ticket is required")
+	}
+	locationId, _ := strconv.Atoi(ret.LocationID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	removals, err := fetchReturnableRemovals(tx, transactionId, ret.JobTicket, ret.StockID)
+	if err != nil {
+		return nil, err
+	}
+	if len(removals) == 0 {
+		return nil, errors.New("No removals found to return")
+	}
+
+	stockId := removals[0].stockId
+	returnableQty := 0
+	for _, removal := range removals {
+		if removal.stockId != stockId {
+			return nil, errors.New("The job " + ret.JobTicket + " has removals of several stocks. Specify the stock ID")
+		}
+		returnableQty += removal.returnableQty
+	}
+	if returnableQty < quantity {
+		return nil, errors.New(`The returning quantity (` + strconv.Itoa(quantity) +
+			`) is more than the returnable one (` + strconv.Itoa(returnableQty) + `)`)
+	}
+
+	// Serials go back to the rows they were consumed from
+	serialized, err := isSerializedStock(tx, stockId)
+	if err != nil {
+		return nil, err
+	}
+	var serialsByMaterial map[int][]string
+	var wanted map[int]int
+	if serialized {
+		if err := validateSerials(ret.SerialNumbers, quantity); err != nil {
+			return nil, err
+		}
+
+		serialsByMaterial = make(map[int][]string)
+		wanted = make(map[int]int)
+		for _, serial := range ret.SerialNumbers {
+			materialId, err := findConsumedSerial(tx, stockId, serial)
+			if err != nil {
+				return nil, err
+			}
+			serialsByMaterial[materialId] = append(serialsByMaterial[materialId], serial)
+			wanted[materialId]++
+		}
+	}
+
+	var trxIds []int
+	destinations := make(map[int]int)
+	left := quantity
+	for _, removal := range removals {
+		if left == 0 {
+			break
+		}
+
+		returningQty := min(removal.returnableQty, left)
+		if wanted != nil {
+			returningQty = min(returningQty, wanted[removal.materialId])
+			wanted[removal.materialId] -= returningQty
+		}
+		if returningQty == 0 {
+			continue
+		}
+
+		destinationId, ok := destinations[removal.materialId]
+		if !ok {
+			destinationId, err = returnDestination(tx, removal.materialId, locationId)
+			if err != nil {
+				return nil, err
+			}
+			destinations[removal.materialId] = destinationId
+		}
+
+		_, err = tx.Exec(`
+			UPDATE materials SET quantity = quantity + $1 WHERE material_id = $2;`,
+			returningQty, destinationId)
+		if err != nil {
+			return nil, err
+		}
+
+		trx := &TransactionInfo{
+			materialId:  destinationId,
+			stockId:     stockId,
+			quantity:    returningQty,
+			notes:       ret.Notes,
+			cost:        removal.cost,
+			updatedAt:   time.Now(),
+			jobTicket:   removal.jobTicket,
+			trxType:     trxReturn,
+			referenceId: removal.transactionId,
+		}
+		// Returns to another row start a new layer at the consumed cost
+		if destinationId == removal.materialId && removal.layerId != 0 {
+			err = restoreLayer(trx, removal.layerId, tx)
+		} else {
+			err = addTranscation(trx, tx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		trxIds = append(trxIds, trx.trxIds...)
+
+		left -= returningQty
+	}
+
+	if left > 0 {
+		return nil, errors.New("The serial numbers do not match the returnable removals")
+	}
+
+	for materialId, serials := range serialsByMaterial {
+		err := receiveSerials(tx, stockId, destinations[materialId], serials, serialReturned, ret.Notes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trxIds, tx.Commit()
+}
+
+func fetchReturnableRemovals(db dbExecutor, transactionId int, jobTicket string, stockId string) ([]returnableRemoval, error) {
+	rows, err := db.Query(`
+		SELECT tl.transaction_id, tl.material_id, tl.stock_id, COALESCE(tl.layer_id, 0),
+			COALESCE(tl.cost, 0), COALESCE(tl.job_ticket, ''),
+			-tl.quantity_change - COALESCE((
+				SELECT SUM(rt.quantity_change) FROM transactions_log rt
+				WHERE rt.reference_id = tl.transaction_id AND rt.transaction_type = 'return'
+					AND NOT EXISTS (SELECT 1 FROM transactions_log rv
+						WHERE rv.reference_id = rt.transaction_id AND rv.transaction_type = 'reversal')
+			), 0) AS "returnable_quantity"
+		FROM transactions_log tl
+		WHERE tl.transaction_type = 'removal'
+			AND NOT EXISTS (SELECT 1 FROM transactions_log rv
+				WHERE rv.reference_id = tl.transaction_id AND rv.transaction_type = 'reversal')
+			AND ($1 = 0 OR tl.transaction_id = $1)
+			AND ($2 = '' OR tl.job_ticket = $2)
+			AND ($3 = '' OR tl.stock_id = $3)
+		ORDER BY tl.transaction_id DESC;`,
+		transactionId, jobTicket, stockId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var removals []returnableRemoval
+	for rows.Next() {
+		var removal returnableRemoval
+		if err := rows.Scan(
+			&removal.transactionId,
+			&removal.materialId,
+			&removal.stockId,
+			&removal.layerId,
+			&removal.cost,
+			&removal.jobTicket,
+			&removal.returnableQty,
+		); err != nil {
+			return nil, err
+		}
+		if removal.returnableQty > 0 {
+			removals = append(removals, removal)
+		}
+	}
+
+	return removals, rows.Err()
+}
+
+// Returned stock is available again. It goes back to the row it was removed from
+// unless another location is given
+func returnDestination(db dbExecutor, materialId int, locationId int) (int, error) {
+	origin, err := getMaterialById(materialId, db)
+	if err != nil {
+		return 0, err
+	}
+
+	if locationId == 0 {
+		locationId = origin.LocationID
+	}
+	if err := checkWarehouseFrozen(db, locationId); err != nil {
+		return 0, err
+	}
+	if locationId == origin.LocationID && origin.Status == statusAvailable {
+		return origin.MaterialID, nil
+	}
+
+	origin.Status = statusAvailable
+	return findOrCreateMaterial(db, origin, locationId)
+}
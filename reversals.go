@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+type ReversalJSON struct {
+	Notes         string   `json:"notes"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+type loggedTransaction struct {
+	transactionId int
+	materialId    int
+	stockId       string
+	quantity      int
+	jobTicket     string
+	trxType       string
+	layerId       int
+	referenceId   int
+	reasonCode    string
+}
+
+// Posts compensating entries for every entry of the posting the log entry belongs to.
+// Moves are reversed on both sides and shipments go back to packed.
+// The reversal entries reference the ones they reverse
+func reverseTransaction(transactionId int, reversal ReversalJSON, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	original, err := fetchLoggedTransaction(tx, transactionId)
+	if err != nil {
+		return nil, err
+	}
+
+	switch original.trxType {
+	case trxReversal:
+		return nil, errors.New("A reversal cannot be reversed")
+	case trxAssembly, trxDisassembly:
+		return nil, errors.New("Kit assemblies are reversed by disassembling the kits")
+	case trxMoveIn:
+		original, err = fetchLoggedTransaction(tx, original.referenceId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	posting, err := fetchPosting(tx, original)
+	if err != nil {
+		return nil, err
+	}
+
+	// Quantity is taken from the destination of a move before it is put back to the source
+	var entries []loggedTransaction
+	for _, entry := range posting {
+		if entry.trxType != trxMoveOut {
+			entries = append(entries, entry)
+			continue
+		}
+		moveIn, err := fetchMoveIn(tx, entry.transactionId)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, moveIn, entry)
+	}
+
+	for _, entry := range entries {
+		if err := checkReversible(tx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	var trxIds []int
+	for _, entry := range entries {
+		var ids []int
+		if entry.quantity > 0 {
+			ids, err = takeBack(tx, entry, reversal.Notes)
+		} else {
+			ids, err = putBack(tx, entry, trxReversal, reversal.Notes)
+		}
+		if err != nil {
+			return nil, err
+		}
+		trxIds = append(trxIds, ids...)
+	}
+
+	if err := reverseSerials(tx, entries, reversal); err != nil {
+		return nil, err
+	}
+
+	if posting[0].trxType == trxShipment {
+		_, err = tx.Exec(`
+			UPDATE shipments SET status = 'packed', shipped_at = NULL, transaction_id = NULL
+			WHERE transaction_id = $1;`,
+			posting[0].transactionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trxIds, tx.Commit()
+}
+
+// The entries posted together reference the first one and have its type
+func fetchPosting(db dbExecutor, entry loggedTransaction) ([]loggedTransaction, error) {
+	first := entry
+	if entry.referenceId != 0 {
+		referenced, err := fetchLoggedTransaction(db, entry.referenceId)
+		if err != nil {
+			return nil, err
+		}
+		if referenced.trxType == entry.trxType {
+			first = referenced
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT transaction_id FROM transactions_log
+		WHERE reference_id = $1 AND transaction_type = $2
+		ORDER BY transaction_id;`,
+		first.transactionId, first.trxType)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var transactionId int
+		if err := rows.Scan(&transactionId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, transactionId)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	posting := []loggedTransaction{first}
+	for _, transactionId := range ids {
+		entry, err := fetchLoggedTransaction(db, transactionId)
+		if err != nil {
+			return nil, err
+		}
+		posting = append(posting, entry)
+	}
+
+	return posting, nil
+}
+
+func fetchLoggedTransaction(db dbExecutor, transactionId int) (loggedTransaction, error) {
+	var entry loggedTransaction
+	err := db.QueryRow(`
+		SELECT transaction_id, material_id, stock_id, quantity_change,
+			COALESCE(job_ticket, ''), transaction_type,
+			COALESCE(layer_id, 0), COALESCE(reference_id, 0), COALESCE(reason_code, '')
+		FROM transactions_log WHERE transaction_id = $1;`, transactionId).
+		Scan(
+			&entry.transactionId,
+			&entry.materialId,
+			&entry.stockId,
+			&entry.quantity,
+			&entry.jobTicket,
+			&entry.trxType,
+			&entry.layerId,
+			&entry.referenceId,
+			&entry.reasonCode,
+		)
+	if err == sql.ErrNoRows {
+		return entry, errors.New("Transaction " + strconv.Itoa(transactionId) + " is not found")
+	}
+
+	return entry, err
+}
+
+func fetchMoveIn(db dbExecutor, moveOutId int) (loggedTransaction, error) {
+	var moveInId int
+	err := db.QueryRow(`
+		SELECT transaction_id FROM transactions_log
+		WHERE reference_id = $1 AND transaction_type = 'move_in';`, moveOutId).Scan(&moveInId)
+	if err == sql.ErrNoRows {
+		return loggedTransaction{}, errors.New("The destination of the move " +
+			strconv.Itoa(moveOutId) + " is not found")
+	}
+	if err != nil {
+		return loggedTransaction{}, err
+	}
+
+	return fetchLoggedTransaction(db, moveInId)
+}
+
+func checkReversible(db dbExecutor, entry loggedTransaction) error {
+	var reversed, returned bool
+	err := db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM transactions_log
+				WHERE reference_id = $1 AND transaction_type = 'reversal'),
+			EXISTS (SELECT 1 FROM transactions_log rt
+				WHERE rt.reference_id = $1 AND rt.transaction_type = 'return'
+					AND NOT EXISTS (SELECT 1 FROM transactions_log rv
+						WHERE rv.reference_id = rt.transaction_id AND rv.transaction_type = 'reversal'));`,
+		entry.transactionId).Scan(&reversed, &returned)
+	if err != nil {
+		return err
+	}
+
+	if reversed {
+		return errors.New("Transaction " + strconv.Itoa(entry.transactionId) + " is already reversed")
+	}
+	if returned {
+		return errors.New("Transaction " + strconv.Itoa(entry.transactionId) +
+			" has returns. Reverse the returns first")
+	}
+	if entry.quantity < 0 && entry.layerId == 0 {
+		return errors.New("Transaction " + strconv.Itoa(entry.transactionId) +
+			" does not keep its cost layer and cannot be reversed")
+	}
+
+	return nil
+}
+
+// Takes the posted quantity out again. It must still be in the material and its layer
+func takeBack(db dbExecutor, entry loggedTransaction, notes string) ([]int, error) {
+	layerId := entry.layerId
+	if layerId == 0 {
+		layerId = entry.transactionId
+	}
+
+	var layer costLayer
+	err := db.QueryRow(`
+		SELECT transaction_id, COALESCE(cost, 0), remaining_quantity FROM transactions_log
+		WHERE transaction_id = $1;`, layerId,
+	).Scan(&layer.transactionId, &layer.cost, &layer.remainingQty)
+	if err != nil {
+		return nil, err
+	}
+
+	material, err := getMaterialById(entry.materialId, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWarehouseFrozen(db, material.LocationID); err != nil {
+		return nil, err
+	}
+	if err := checkNotInTransit(db, material.LocationID); err != nil {
+		return nil, err
+	}
+
+	if layer.remainingQty < entry.quantity || material.Quantity < entry.quantity {
+		return nil, errors.New("The quantity of the transaction " + strconv.Itoa(entry.transactionId) +
+			" has been used since. Reverse the later transactions first")
+	}
+
+	_, err = db.Exec(`
+		UPDATE materials SET quantity = quantity - $1 WHERE material_id = $2;`,
+		entry.quantity, entry.materialId)
+	if err != nil {
+		return nil, err
+	}
+
+	trx := &TransactionInfo{
+		materialId:  entry.materialId,
+		stockId:     entry.stockId,
+		quantity:    -entry.quantity,
+		notes:       notes,
+		updatedAt:   time.Now(),
+		jobTicket:   entry.jobTicket,
+		trxType:     trxReversal,
+		referenceId: entry.transactionId,
+		reasonCode:  entry.reasonCode,
+	}
+	if err := deductLayer(trx, layer, entry.quantity, db); err != nil {
+		return nil, err
+	}
+
+	return trx.trxIds, nil
+}
+
+// Puts the taken quantity back to the material and the layer it was taken from
+func putBack(db dbExecutor, entry loggedTransaction, trxType string, notes string) ([]int, error) {
+	quantity := -entry.quantity
+
+	material, err := getMaterialById(entry.materialId, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWarehouseFrozen(db, material.LocationID); err != nil {
+		return nil, err
+	}
+	if err := checkNotInTransit(db, material.LocationID); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		UPDATE materials SET quantity = quantity + $1 WHERE material_id = $2;`,
+		quantity, entry.materialId)
+	if err != nil {
+		return nil, err
+	}
+
+	trx := &TransactionInfo{
+		materialId:  entry.materialId,
+		stockId:     entry.stockId,
+		quantity:    quantity,
+		notes:       notes,
+		updatedAt:   time.Now(),
+		jobTicket:   entry.jobTicket,
+		trxType:     trxType,
+		referenceId: entry.transactionId,
+		reasonCode:  entry.reasonCode,
+	}
+	if err := restoreLayer(trx, entry.layerId, db); err != nil {
+		return nil, err
+	}
+
+	return trx.trxIds, nil
+}
+
+// Only the entries of serialized stock carry serials. A shipment can hold several stocks
+func reverseSerials(db dbExecutor, entries []loggedTransaction, reversal ReversalJSON) error {
+	serialized := make(map[string]bool)
+	var serialEntries []loggedTransaction
+	for _, entry := range entries {
+		isSerialized, ok := serialized[entry.stockId]
+		if !ok {
+			var err error
+			isSerialized, err = isSerializedStock(db, entry.stockId)
+			if err != nil {
+				return err
+			}
+			serialized[entry.stockId] = isSerialized
+		}
+		if isSerialized {
+			serialEntries = append(serialEntries, entry)
+		}
+	}
+	if len(serialEntries) == 0 {
+		return nil
+	}
+
+	// Moves count once, by their destination side
+	quantity := 0
+	consumed := make(map[int]int)
+	for _, entry := range serialEntries {
+		switch {
+		case entry.trxType == trxMoveOut:
+		case entry.quantity < 0:
+			quantity -= entry.quantity
+			consumed[entry.materialId] -= entry.quantity
+		default:
+			quantity += entry.quantity
+		}
+	}
+	if err := validateSerials(reversal.SerialNumbers, quantity); err != nil {
+		return err
+	}
+
+	original := serialEntries[0]
+	switch {
+	case original.trxType == trxMoveIn:
+		return moveSerials(db, original.materialId, serialEntries[1].materialId, reversal.SerialNumbers, reversal.Notes)
+	case original.quantity < 0:
+		// Removals, shipments and write-offs consumed the serials.
+		// They go back to the rows they were consumed from
+		for _, serial := range reversal.SerialNumbers {
+			found := false
+			for _, entry := range serialEntries {
+				materialId, err := findConsumedSerial(db, entry.stockId, serial)
+				if err != nil || materialId != entry.materialId || consumed[materialId] == 0 {
+					continue
+				}
+				err = receiveSerials(db, entry.stockId, materialId, []string{serial}, serialReversed, reversal.Notes)
+				if err != nil {
+					return err
+				}
+				consumed[materialId]--
+				found = true
+				break
+			}
+			if !found {
+				return errors.New("Serial number " + serial + " is not consumed by the transaction " +
+					strconv.Itoa(original.transactionId))
+			}
+		}
+		return nil
+	default:
+		return consumeSerials(db, original.materialId, reversal.SerialNumbers, serialReversed,
+			original.jobTicket, reversal.Notes)
+	}
+}
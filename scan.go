@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// What a scanned code is resolved to
+const (
+	scanLocation = "location"
+	scanMaterial = "material"
+	scanStock    = "stock"
+	scanLot      = "lot"
+	scanJob      = "job"
+)
+
+type ScanResult struct {
+	Code      string
+	Type      string
+	Location  *LocationDB  `json:",omitempty"`
+	Material  *MaterialDB  `json:",omitempty"`
+	Materials []MaterialDB `json:",omitempty"` // holding stock in the location, of the stock or of the lot
+	Job       *JobDB       `json:",omitempty"`
+}
+
+// Codes printed on labels are tried first, then location names as printed
+// under the barcodes, job tickets, stock IDs and lot numbers
+func resolveScan(db *sql.DB, code string) (ScanResult, error) {
+	code = strings.TrimSpace(code)
+	result := ScanResult{Code: code}
+
+	if locationId, ok := scannedId(code, locationCodePrefix); ok {
+		return scannedLocation(db, result, locationId)
+	}
+
+	if materialId, ok := scannedId(code, materialCodePrefix); ok {
+		materials, err := getMaterials(db, MaterialFilter{materialId: materialId})
+		if err != nil {
+			return result, err
+		}
+		if len(materials) == 0 {
+			return result, errors.New("Material " + strconv.Itoa(materialId) + " is not found")
+		}
+		result.Type = scanMaterial
+		result.Material = &materials[0]
+		return result, nil
+	}
+
+	var locationIds []int
+	rows, err := db.Query(`SELECT location_id FROM locations WHERE name = $1;`, code)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var locationId int
+		if err := rows.Scan(&locationId); err != nil {
+			return result, err
+		}
+		locationIds = append(locationIds, locationId)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+	if len(locationIds) == 1 {
+		return scannedLocation(db, result, locationIds[0])
+	}
+
+	job, found, err := fetchJobByTicket(db, code)
+	if err != nil {
+		return result, err
+	}
+	if found {
+		result.Type = scanJob
+		result.Job = &job
+		return result, nil
+	}
+
+	for _, opts := range []MaterialFilter{{stockId: code}, {lotNumber: code}} {
+		materials, err := getMaterials(db, opts)
+		if err != nil {
+			return result, err
+		}
+		if len(materials) == 0 {
+			continue
+		}
+
+		result.Type = scanStock
+		if opts.lotNumber != "" {
+			result.Type = scanLot
+		}
+		result.Materials = inStock(materials)
+		return result, nil
+	}
+
+	if len(locationIds) > 1 {
+		return result, errors.New("Code " + code + " names several locations. Scan the location label")
+	}
+	return result, errors.New("Code " + code + " is not recognized")
+}
+
+func scannedId(code string, prefix string) (int, bool) {
+	if !strings.HasPrefix(strings.ToUpper(code), prefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(code[len(prefix):])
+	return id, err == nil
+}
+
+func scannedLocation(db *sql.DB, result ScanResult, locationId int) (ScanResult, error) {
+	location, err := fetchLocation(db, locationId)
+	if err != nil {
+		return result, err
+	}
+
+	materials, err := getMaterials(db, MaterialFilter{locationId: locationId})
+	if err != nil {
+		return result, err
+	}
+
+	result.Type = scanLocation
+	result.Location = &location
+	result.Materials = inStock(materials)
+	return result, nil
+}
+
+func inStock(materials []MaterialDB) []MaterialDB {
+	stocked := []MaterialDB{}
+	for _, material := range materials {
+		if material.Quantity > 0 {
+			stocked = append(stocked, material)
+		}
+	}
+	return stocked
+}
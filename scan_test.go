@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestScannedId(t *testing.T) {
+	tests := []struct {
+		code   string
+		prefix string
+		id     int
+		ok     bool
+	}{
+		{code: "LOC-12", prefix: locationCodePrefix, id: 12, ok: true},
+		{code: "loc-12", prefix: locationCodePrefix, id: 12, ok: true},
+		{code: "MAT-7", prefix: materialCodePrefix, id: 7, ok: true},
+		{code: "MAT-7", prefix: locationCodePrefix, ok: false},
+		{code: "LOC-", prefix: locationCodePrefix, ok: false},
+		{code: "LOC-A1", prefix: locationCodePrefix, ok: false},
+		{code: "LOC", prefix: locationCodePrefix, ok: false},
+		{code: "STK-1", prefix: materialCodePrefix, ok: false},
+	}
+
+	for _, tt := range tests {
+		id, ok := scannedId(tt.code, tt.prefix)
+		if ok != tt.ok || (ok && id != tt.id) {
+			t.Errorf("scannedId(%q, %q) = %d, %v, want %d, %v", tt.code, tt.prefix, id, ok, tt.id, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Serial number actions kept in the history
+const (
+	serialReceived = "received"
+	serialMoved    = "moved"
+	serialConsumed = "consumed"
+	serialReturned = "returned"
+	serialReversed = "reversed"
+	serialAdjusted = "adjusted"
+)
+
+// Unit dimensions measure stock against location capacities
+type StockProfileJSON struct {
+	StockID        string `json:"stockId"`
+	IsSerialized   bool   `json:"isSerialized"`
+	AbcClass       string `json:"abcClass"`
+	UnitVolume     string `json:"unitVolume"`
+	UnitWeight     string `json:"unitWeight"`
+	UnitsPerPallet string `json:"unitsPerPallet"`
+}
+
+type StockProfileDB struct {
+	StockID        string  `field:"stock_id"`
+	IsSerialized   bool    `field:"is_serialized"`
+	AbcClass       string  `field:"abc_class"`
+	UnitVolume     float64 `field:"unit_volume"`
+	UnitWeight     float64 `field:"unit_weight"`
+	UnitsPerPallet int     `field:"units_per_pallet"`
+}
+
+type SerialHistoryDB struct {
+	SerialNumber  string    `field:"serial_number"`
+	StockID       string    `field:"stock_id"`
+	Status        string    `field:"status"`
+	Action        string    `field:"action"`
+	MaterialID    int       `field:"material_id"`
+	LocationName  string    `field:"location_name"`
+	WarehouseName string    `field:"warehouse_name"`
+	JobTicket     string    `field:"job_ticket"`
+	Notes         string    `field:"notes"`
+	UpdatedAt     time.Time `field:"updated_at"`
+}
+
+func setStockProfile(profile StockProfileJSON, db *sql.DB) error {
+	_, err := db.Exec(`
+		INSERT INTO stock_profiles
+			(stock_id, is_serialized, abc_class, unit_volume, unit_weight, units_per_pallet)
+		VALUES ($1,$2,NULLIF($3, ''),NULLIF($4, '')::DECIMAL,NULLIF($5, '')::DECIMAL,NULLIF($6, '')::INT)
+		ON CONFLICT (stock_id) DO UPDATE
+			SET is_serialized = $2, abc_class = NULLIF($3, ''),
+				unit_volume = NULLIF($4, '')::DECIMAL,
+				unit_weight = NULLIF($5, '')::DECIMAL,
+				units_per_pallet = NULLIF($6, '')::INT;`,
+		profile.StockID, profile.IsSerialized, profile.AbcClass,
+		profile.UnitVolume, profile.UnitWeight, profile.UnitsPerPallet)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func fetchStockProfiles(db *sql.DB) ([]StockProfileDB, error) {
+	rows, err := db.Query(`
+		SELECT stock_id, is_serialized, COALESCE(abc_class, ''),
+			COALESCE(unit_volume, 0), COALESCE(unit_weight, 0), COALESCE(units_per_pallet, 0)
+		FROM stock_profiles;`)
+	if err != nil {
+		log.Println("Error fetchStockProfiles1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var profiles []StockProfileDB
+	for rows.Next() {
+		var profile StockProfileDB
+		if err := rows.Scan(
+			&profile.StockID,
+			&profile.IsSerialized,
+			&profile.AbcClass,
+			&profile.UnitVolume,
+			&profile.UnitWeight,
+			&profile.UnitsPerPallet,
+		); err != nil {
+			log.Println("Error fetchStockProfiles2: ", err)
+			return profiles, err
+		}
+		profiles = append(profiles, profile)
+	}
+	if err = rows.Err(); err != nil {
+		return profiles, err
+	}
+
+	return profiles, nil
+}
+
+func isSerializedStock(db dbExecutor, stockId string) (bool, error) {
+	var isSerialized bool
+	err := db.QueryRow(`
+		SELECT is_serialized FROM stock_profiles WHERE stock_id = $1;`,
+		stockId).Scan(&isSerialized)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return isSerialized, nil
+}
+
+// Serialized stock must come with one unique serial number per unit
+func validateSerials(serials []string, quantity int) error {
+	if len(serials) != quantity {
+		return errors.New(`The number of serial numbers (` + strconv.Itoa(len(serials)) +
+			`) does not match the quantity (` + strconv.Itoa(quantity) + `)`)
+	}
+
+	seen := make(map[string]bool)
+	for _, serial := range serials {
+		if serial == "" {
+			return errors.New("Serial number cannot be empty")
+		}
+		if seen[serial] {
+			return errors.New("Serial number " + serial + " is duplicated")
+		}
+		seen[serial] = true
+	}
+
+	return nil
+}
+
+func receiveSerials(db dbExecutor, stockId string, materialId int, serials []string, action string, notes string) error {
+	for _, serial := range serials {
+		var serialId int
+
+		// Consumed serials can come back to the stock
+		err := db.QueryRow(`
+			INSERT INTO serial_numbers (stock_id, serial_number, material_id, status)
+			VALUES ($1,$2,$3,'in_stock')
+			ON CONFLICT (serial_number, stock_id) DO UPDATE
+				SET material_id = $3, status = 'in_stock'
+				WHERE serial_numbers.status = 'consumed'
+			RETURNING serial_id;`,
+			stockId, serial, materialId).Scan(&serialId)
+		if err == sql.ErrNoRows {
+			return errors.New("Serial number " + serial + " is already in stock")
+		}
+		if err != nil {
+			return err
+		}
+
+		err = addSerialHistory(db, serialId, materialId, action, "", notes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func moveSerials(db dbExecutor, fromMaterialId int, toMaterialId int, serials []string, notes string) error {
+	for _, serial := range serials {
+		serialId, err := findSerialInMaterial(db, fromMaterialId, serial)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec(`
+			UPDATE serial_numbers SET material_id = $1 WHERE serial_id = $2;`,
+			toMaterialId, serialId)
+		if err != nil {
+			return err
+		}
+
+		err = addSerialHistory(db, serialId, toMaterialId, serialMoved, "", notes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func consumeSerials(db dbExecutor, materialId int, serials []string, action string, jobTicket string, notes string) error {
+	for _, serial := range serials {
+		serialId, err := findSerialInMaterial(db, materialId, serial)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec(`
+			UPDATE serial_numbers SET status = 'consumed' WHERE serial_id = $1;`,
+			serialId)
+		if err != nil {
+			return err
+		}
+
+		err = addSerialHistory(db, serialId, materialId, action, jobTicket, notes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Serials in stock of the material
+func materialSerials(db dbExecutor, materialId int) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT serial_number FROM serial_numbers
+		WHERE material_id = $1 AND status = 'in_stock'
+		ORDER BY serial_number;`, materialId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	serials := []string{}
+	for rows.Next() {
+		var serial string
+		if err := rows.Scan(&serial); err != nil {
+			return nil, err
+		}
+		serials = append(serials, serial)
+	}
+
+	return serials, rows.Err()
+}
+
+// Checks that all the serials are in stock of the material
+// before anything is changed
+func checkSerialsInMaterial(db dbExecutor, materialId int, serials []string) error {
+	for _, serial := range serials {
+		if _, err := findSerialInMaterial(db, materialId, serial); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Material the serial was last consumed from
+func findConsumedSerial(db dbExecutor, stockId string, serial string) (int, error) {
+	var materialId int
+	err := db.QueryRow(`
+		SELECT sh.material_id FROM serial_numbers sn
+		LEFT JOIN serial_history sh ON sh.serial_id = sn.serial_id
+		WHERE sn.stock_id = $1 AND sn.serial_number = $2
+			AND sn.status = 'consumed'
+		ORDER BY sh.history_id DESC LIMIT 1;`,
+		stockId, serial).Scan(&materialId)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("Serial number " + serial + " is not consumed from the stock " + stockId)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return materialId, nil
+}
+
+func findSerialInMaterial(db dbExecutor, materialId int, serial string) (int, error) {
+	var serialId int
+	err := db.QueryRow(`
+		SELECT serial_id FROM serial_numbers
+		WHERE material_id = $1 AND serial_number = $2 AND status = 'in_stock';`,
+		materialId, serial).Scan(&serialId)
+	if err == sql.ErrNoRows {
+		return 0, errors.New("Serial number " + serial + " is not in stock of the material " +
+			strconv.Itoa(materialId))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return serialId, nil
+}
+
+func addSerialHistory(db dbExecutor, serialId int, materialId int, action string, jobTicket string, notes string) error {
+	_, err := db.Exec(`
+		INSERT INTO serial_history
+			(serial_id, material_id, location_id, action, job_ticket, notes, updated_at)
+		SELECT $1, m.material_id, m.location_id, $3, $4, $5, NOW()
+		FROM materials m WHERE m.material_id = $2;`,
+		serialId, materialId, action, jobTicket, notes)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func fetchSerialHistory(db *sql.DB, serialNumber string) ([]SerialHistoryDB, error) {
+	rows, err := db.Query(`
+		SELECT sn.serial_number, sn.stock_id, sn.status, sh.action, sh.material_id,
+			COALESCE(l.name, ''), COALESCE(w.name, ''),
+			COALESCE(sh.job_ticket, ''), COALESCE(sh.notes, ''), sh.updated_at
+		FROM serial_history sh
+		LEFT JOIN serial_numbers sn ON sn.serial_id = sh.serial_id
+		LEFT JOIN locations l ON l.location_id = sh.location_id
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		WHERE sn.serial_number = $1
+		ORDER BY sh.history_id;`, serialNumber)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying serial history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []SerialHistoryDB{}
+	for rows.Next() {
+		var entry SerialHistoryDB
+		if err := rows.Scan(
+			&entry.SerialNumber,
+			&entry.StockID,
+			&entry.Status,
+			&entry.Action,
+			&entry.MaterialID,
+			&entry.LocationName,
+			&entry.WarehouseName,
+			&entry.JobTicket,
+			&entry.Notes,
+			&entry.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+		history = append(history, entry)
+	}
+
+	if len(history) == 0 {
+		return nil, errors.New("Serial number " + serialNumber + " is not found")
+	}
+
+	return history, nil
+}
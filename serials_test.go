@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestValidateSerials(t *testing.T) {
+	tests := []struct {
+		name     string
+		serials  []string
+		quantity int
+		wantErr  bool
+	}{
+		{name: "one per unit", serials: []string{"SN-1", "SN-2"}, quantity: 2},
+		{name: "none for nothing", serials: nil, quantity: 0},
+		{name: "too few", serials: []string{"SN-1"}, quantity: 2, wantErr: true},
+		{name: "too many", serials: []string{"SN-1", "SN-2"}, quantity: 1, wantErr: true},
+		{name: "empty serial", serials: []string{"SN-1", ""}, quantity: 2, wantErr: true},
+		{name: "duplicated serial", serials: []string{"SN-1", "SN-1"}, quantity: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := validateSerials(tt.serials, tt.quantity)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateSerials(%q, %d) = %v, want error %v",
+				tt.name, tt.serials, tt.quantity, err, tt.wantErr)
+		}
+	}
+}
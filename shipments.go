@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Shipment statuses in the order they go
+const (
+	shipmentDraft   = "draft"
+	shipmentPicking = "picking"
+	shipmentPacked  = "packed"
+	shipmentShipped = "shipped"
+)
+
+type ShipmentJSON struct {
+	CustomerID    string             `json:"customerId"`
+	ShipToName    string             `json:"shipToName"`
+	ShipToAddress string             `json:"shipToAddress"`
+	Notes         string             `json:"notes"`
+	Lines         []ShipmentLineJSON `json:"lines"`
+}
+
+// Either a material row or a stock to be picked from any row
+type ShipmentLineJSON struct {
+	MaterialID string `json:"materialId"`
+	StockID    string `json:"stockId"`
+	Qty        string `json:"quantity"`
+}
+
+type ShipJSON struct {
+	Override bool           `json:"override"`
+	Lines    []ShipLineJSON `json:"lines"`
+}
+
+// Serial numbers shipped with a line
+type ShipLineJSON struct {
+	ShipmentLineID string   `json:"shipmentLineId"`
+	SerialNumbers  []string `json:"serialNumbers"`
+}
+
+type ShipmentDB struct {
+	ShipmentID    int       `field:"shipment_id"`
+	CustomerID    int       `field:"customer_id"`
+	CustomerName  string    `field:"customer_name"`
+	ShipToName    string    `field:"ship_to_name"`
+	ShipToAddress string    `field:"ship_to_address"`
+	Status        string    `field:"status"`
+	Notes         string    `field:"notes"`
+	CreatedAt     time.Time `field:"created_at"`
+	ShippedAt     string    `field:"shipped_at"`
+	Lines         []ShipmentLineDB
+}
+
+type ShipmentLineDB struct {
+	ShipmentLineID int    `field:"shipment_line_id"`
+	MaterialID     int    `field:"material_id"`
+	StockID        string `field:"stock_id"`
+	Description    string `field:"description"`
+	WarehouseName  string `field:"warehouse_name"`
+	LocationName   string `field:"location_name"`
+	LotNumber      string `field:"lot_number"`
+	Qty            int    `field:"quantity"`
+}
+
+func createShipment(shipment ShipmentJSON, db *sql.DB) (int, error) {
+	if shipment.ShipToName == "" || shipment.ShipToAddress == "" {
+		return 0, errors.New("Ship-to name and address are required")
+	}
+	if len(shipment.Lines) == 0 {
+		return 0, errors.New("Shipment must have at least one line")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var shipmentId int
+	err = tx.QueryRow(`
+		INSERT INTO shipments (customer_id, ship_to_name, ship_to_address, notes)
+		VALUES (NULLIF($1, '')::INT, $2, $3, $4)
+		RETURNING shipment_id;`,
+		shipment.CustomerID, shipment.ShipToName, shipment.ShipToAddress, shipment.Notes,
+	).Scan(&shipmentId)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range shipment.Lines {
+		qty, _ := strconv.Atoi(line.Qty)
+		if qty <= 0 {
+			return 0, errors.New("Every shipment line needs a positive quantity")
+		}
+
+		materialId, _ := strconv.Atoi(line.MaterialID)
+		stockId := line.StockID
+		if materialId != 0 {
+			material, err := getMaterialById(materialId, tx)
+			if err == sql.ErrNoRows {
+				return 0, errors.New("Material " + line.MaterialID + " is not found")
+			}
+			if err != nil {
+				return 0, err
+			}
+			stockId = material.StockID
+		}
+		if stockId == "" {
+			return 0, errors.New("Every shipment line needs a material or a stock ID")
+		}
+
+		if err := addShipmentLine(tx, shipmentId, materialId, stockId, qty); err != nil {
+			return 0, err
+		}
+	}
+
+	return shipmentId, tx.Commit()
+}
+
+func addShipmentLine(db dbExecutor, shipmentId int, materialId int, stockId string, quantity int) error {
+	_, err := db.Exec(`
+		INSERT INTO shipment_lines (shipment_id, material_id, stock_id, quantity)
+		VALUES ($1, NULLIF($2, 0), $3, $4);`,
+		shipmentId, materialId, stockId, quantity)
+	return err
+}
+
+func fetchShipments(db *sql.DB) ([]ShipmentDB, error) {
+	return queryShipments(db, 0)
+}
+
+func fetchShipment(db dbExecutor, shipmentId int) (ShipmentDB, error) {
+	shipments, err := queryShipments(db, shipmentId)
+	if err != nil {
+		return ShipmentDB{}, err
+	}
+	if len(shipments) == 0 {
+		return ShipmentDB{}, errors.New("Shipment " + strconv.Itoa(shipmentId) + " is not found")
+	}
+
+	return shipments[0], nil
+}
+
+func queryShipments(db dbExecutor, shipmentId int) ([]ShipmentDB, error) {
+	rows, err := db.Query(`
+		SELECT s.shipment_id, COALESCE(s.customer_id, 0), COALESCE(c.name, ''),
+			s.ship_to_name, s.ship_to_address, s.status, COALESCE(s.notes, ''), s.created_at,
+			COALESCE(TO_CHAR(s.shipped_at, 'YYYY-MM-DD HH24:MI'), '')
+		FROM shipments s
+		LEFT JOIN customers c ON c.customer_id = s.customer_id
+		WHERE ($1 = 0 OR s.shipment_id = $1)
+		ORDER BY s.shipment_id;`, shipmentId)
+	if err != nil {
+		log.Println("Error queryShipments1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	shipments := []ShipmentDB{}
+	for rows.Next() {
+		var shipment ShipmentDB
+		if err := rows.Scan(
+			&shipment.ShipmentID,
+			&shipment.CustomerID,
+			&shipment.CustomerName,
+			&shipment.ShipToName,
+			&shipment.ShipToAddress,
+			&shipment.Status,
+			&shipment.Notes,
+			&shipment.CreatedAt,
+			&shipment.ShippedAt,
+		); err != nil {
+			log.Println("Error queryShipments2: ", err)
+			return nil, err
+		}
+		shipments = append(shipments, shipment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range shipments {
+		lines, err := fetchShipmentLines(db, shipments[i].ShipmentID)
+		if err != nil {
+			return nil, err
+		}
+		shipments[i].Lines = lines
+	}
+
+	return shipments, nil
+}
+
+func fetchShipmentLines(db dbExecutor, shipmentId int) ([]ShipmentLineDB, error) {
+	rows, err := db.Query(`
+		SELECT sl.shipment_line_id, COALESCE(sl.material_id, 0), sl.stock_id,
+			COALESCE(m.description, (
+				SELECT sm.description FROM materials sm WHERE sm.stock_id = sl.stock_id LIMIT 1
+			), ''),
+			COALESCE(w.name, ''), COALESCE(l.name, ''), COALESCE(m.lot_number, ''), sl.quantity
+		FROM shipment_lines sl
+		LEFT JOIN materials m ON m.material_id = sl.material_id
+		LEFT JOIN locations l ON l.location_id = m.location_id
+		LEFT JOIN warehouses w ON w.warehouse_id = l.warehouse_id
+		WHERE sl.shipment_id = $1
+		ORDER BY sl.shipment_line_id;`, shipmentId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying shipment lines: %w", err)
+	}
+	defer rows.Close()
+
+	lines := []ShipmentLineDB{}
+	for rows.Next() {
+		var line ShipmentLineDB
+		if err := rows.Scan(
+			&line.ShipmentLineID,
+			&line.MaterialID,
+			&line.StockID,
+			&line.Description,
+			&line.WarehouseName,
+			&line.LocationName,
+			&line.LotNumber,
+			&line.Qty,
+		); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// Allocates the lines given by stock to material rows in FIFO order.
+// A line taken from several rows is split. Only the stock of the customer
+// it is shipped to is picked, or Tag's own stock for shipments without one
+func pickShipment(shipmentId int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	shipment, err := fetchShipment(tx, shipmentId)
+	if err != nil {
+		return err
+	}
+	if shipment.Status != shipmentDraft {
+		return errors.New("Only draft shipments can be picked (status: " + shipment.Status + ")")
+	}
+
+	owner := ownerTag
+	if shipment.CustomerID != 0 {
+		owner = ownerCustomer
+	}
+
+	allocated := make(map[int]int)
+	for _, line := range shipment.Lines {
+		if line.MaterialID != 0 {
+			allocated[line.MaterialID] += line.Qty
+		}
+	}
+
+	// Rows given on the lines are checked as they are now
+	for materialId, quantity := range allocated {
+		material, err := getMaterialById(materialId, tx)
+		if err != nil {
+			return err
+		}
+		if material.Owner != owner || (shipment.CustomerID != 0 && material.CustomerID != shipment.CustomerID) {
+			return errors.New("Material " + strconv.Itoa(materialId) + " is not the stock of the shipment's customer")
+		}
+		if material.Status != statusAvailable {
+			return errors.New("Material " + strconv.Itoa(materialId) + " is not available (status: " +
+				material.Status + ")")
+		}
+		if material.Quantity < quantity {
+			return errors.New(`Only ` + strconv.Itoa(material.Quantity) + ` of the material ` +
+				strconv.Itoa(materialId) + ` are in stock (` + strconv.Itoa(quantity) + ` requested)`)
+		}
+		if err := checkReservations(tx, material, quantity, "", false); err != nil {
+			return fmt.Errorf("Material %d: %w", materialId, err)
+		}
+	}
+
+	for _, line := range shipment.Lines {
+		if line.MaterialID != 0 {
+			continue
+		}
+
+		candidates, err := fetchPickCandidates(tx, line.StockID, shipment.CustomerID, owner, "", pickFIFO)
+		if err != nil {
+			return err
+		}
+
+		remaining := line.Qty
+		var picks []PickDB
+		for _, candidate := range candidates {
+			if remaining == 0 {
+				break
+			}
+			free := candidate.freeQty - allocated[candidate.MaterialID]
+			if free <= 0 {
+				continue
+			}
+
+			take := min(free, remaining)
+			allocated[candidate.MaterialID] += take
+			remaining -= take
+
+			candidate.Qty = take
+			picks = append(picks, candidate)
+		}
+		if remaining > 0 {
+			return errors.New(`Only ` + strconv.Itoa(line.Qty-remaining) + ` of the stock ` + line.StockID +
+				` are available to ship (` + strconv.Itoa(line.Qty) + ` requested)`)
+		}
+
+		_, err = tx.Exec(`DELETE FROM shipment_lines WHERE shipment_line_id = $1;`, line.ShipmentLineID)
+		if err != nil {
+			return err
+		}
+		for _, pick := range picks {
+			if err := addShipmentLine(tx, shipmentId, pick.MaterialID, pick.StockID, pick.Qty); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := setShipmentStatus(tx, shipmentId, shipmentPicking); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func packShipment(shipmentId int, db *sql.DB) error {
+	shipment, err := fetchShipment(db, shipmentId)
+	if err != nil {
+		return err
+	}
+	if shipment.Status != shipmentPicking {
+		return errors.New("Only picked shipments can be packed (status: " + shipment.Status + ")")
+	}
+
+	return setShipmentStatus(db, shipmentId, shipmentPacked)
+}
+
+// Removes every line of the shipment from the stock. Either all of them succeed or none
+func shipShipment(shipmentId int, ship ShipJSON, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	shipment, err := fetchShipment(tx, shipmentId)
+	if err != nil {
+		return nil, err
+	}
+	if shipment.Status != shipmentPacked {
+		return nil, errors.New("Only packed shipments can be shipped (status: " + shipment.Status + ")")
+	}
+
+	serials := make(map[int][]string)
+	for _, line := range ship.Lines {
+		lineId, _ := strconv.Atoi(line.ShipmentLineID)
+		serials[lineId] = line.SerialNumbers
+	}
+
+	var trxIds []int
+	for _, line := range shipment.Lines {
+		ids, err := removeMaterialAs(MaterialToRemoveJSON{
+			MaterialID:    strconv.Itoa(line.MaterialID),
+			Qty:           strconv.Itoa(line.Qty),
+			SerialNumbers: serials[line.ShipmentLineID],
+			Override:      ship.Override,
+		}, trxShipment, tx)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d (stock %s): %w", line.ShipmentLineID, line.StockID, err)
+		}
+		trxIds = append(trxIds, ids...)
+	}
+
+	// The entries of the other lines reference the first one,
+	// so the shipment is reversed as a whole
+	for _, transactionId := range trxIds[1:] {
+		_, err := tx.Exec(`
+			UPDATE transactions_log SET reference_id = $1 WHERE transaction_id = $2;`,
+			trxIds[0], transactionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE shipments SET status = 'shipped', shipped_at = NOW(), transaction_id = $2
+		WHERE shipment_id = $1;`,
+		shipmentId, trxIds[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return trxIds, tx.Commit()
+}
+
+func setShipmentStatus(db dbExecutor, shipmentId int, status string) error {
+	_, err := db.Exec(`
+		UPDATE shipments SET status = $1 WHERE shipment_id = $2;`,
+		status, shipmentId)
+	return err
+}
+
+var packingSlipTemplate = template.Must(template.New("packingSlip").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Packing slip #{{.ShipmentID}}</title>
+	<style>
+		body { font-family: sans-serif; margin: 2em; }
+		table { border-collapse: collapse; width: 100%; }
+		th, td { border: 1px solid #999; padding: 4px 8px; text-align: left; }
+		td.qty { text-align: right; }
+	</style>
+</head>
+<body>
+	<h1>Packing slip #{{.ShipmentID}}</h1>
+	<p>
+		<strong>Ship to:</strong><br>
+		{{.ShipToName}}<br>
+		{{.ShipToAddress}}
+	</p>
+	{{if .CustomerName}}<p><strong>Customer:</strong> {{.CustomerName}}</p>{{end}}
+	{{if .ShippedAt}}<p><strong>Shipped:</strong> {{.ShippedAt}}</p>{{end}}
+	<table>
+		<tr><th>Stock ID</th><th>Description</th><th>Lot</th><th>Quantity</th></tr>
+		{{range .Lines}}
+		<tr><td>{{.StockID}}</td><td>{{.Description}}</td><td>{{.LotNumber}}</td><td class="qty">{{.Qty}}</td></tr>
+		{{end}}
+	</table>
+	{{if .Notes}}<p>{{.Notes}}</p>{{end}}
+</body>
+</html>
+`))
+
+func renderPackingSlip(w io.Writer, shipment ShipmentDB) error {
+	return packingSlipTemplate.Execute(w, shipment)
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Transfer statuses
+const (
+	transferInTransit = "in_transit"
+	transferReceived  = "received"
+)
+
+// A transfer keeps the stock it ships in a location of its own, of no
+// warehouse, until it is received. Its rows are not merged with other transfers
+const (
+	inTransitName     = "IN-TRANSIT"
+	reasonTransitLoss = "transit_loss"
+)
+
+type TransferJSON struct {
+	DestinationWarehouseID string             `json:"destinationWarehouseId"`
+	Notes                  string             `json:"notes"`
+	Override               bool               `json:"override"`
+	Lines                  []TransferLineJSON `json:"lines"`
+}
+
+type TransferLineJSON struct {
+	MaterialID    string   `json:"materialId"`
+	Qty           string   `json:"quantity"`
+	SerialNumbers []string `json:"serialNumbers"`
+}
+
+type TransferReceiptJSON struct {
+	Notes string                    `json:"notes"`
+	Lines []TransferReceiptLineJSON `json:"lines"`
+}
+
+// The shipped quantity not received is written off with the reason,
+// transit loss by default
+type TransferReceiptLineJSON struct {
+	TransferLineID       string   `json:"transferLineId"`
+	LocationID           string   `json:"locationId"`
+	ReceivedQty          string   `json:"receivedQuantity"`
+	SerialNumbers        []string `json:"serialNumbers"`
+	MissingSerialNumbers []string `json:"missingSerialNumbers"`
+	ReasonCode           string   `json:"reasonCode"`
+}
+
+type TransferDB struct {
+	TransferID               int       `field:"transfer_id"`
+	SourceWarehouseID        int       `field:"source_warehouse_id"`
+	SourceWarehouseName      string    `field:"source_warehouse_name"`
+	DestinationWarehouseID   int       `field:"destination_warehouse_id"`
+	DestinationWarehouseName string    `field:"destination_warehouse_name"`
+	Status                   string    `field:"status"`
+	Notes                    string    `field:"notes"`
+	ShippedAt                time.Time `field:"shipped_at"`
+	ReceivedAt               string    `field:"received_at"`
+	Lines                    []TransferLineDB
+}
+
+type TransferLineDB struct {
+	TransferLineID        int    `field:"transfer_line_id"`
+	SourceMaterialID      int    `field:"source_material_id"`
+	TransitMaterialID     int    `field:"transit_material_id"`
+	DestinationMaterialID int    `field:"destination_material_id"`
+	StockID               string `field:"stock_id"`
+	LotNumber             string `field:"lot_number"`
+	ShippedQty            int    `field:"shipped_quantity"`
+	ReceivedQty           *int   `field:"received_quantity"`
+	DiscrepancyQty        *int   // derived
+	ReasonCode            string `field:"reason_code"`
+}
+
+type InTransitRep struct {
+	TransferID               int
+	SourceWarehouseName      string
+	DestinationWarehouseName string
+	StockID                  string
+	LotNumber                string
+	Qty                      int
+	Value                    string
+	ShippedAt                string
+	DaysInTransit            int
+}
+
+func createTransitLocation(db dbExecutor, transferId int) (int, error) {
+	var locationId int
+	err := db.QueryRow(`
+		INSERT INTO locations (name, location_type) VALUES ($1, 'in_transit')
+		RETURNING location_id;`, inTransitName+"-"+strconv.Itoa(transferId)).Scan(&locationId)
+
+	return locationId, err
+}
+
+// Stock in transit leaves it only when its transfer is received
+func checkNotInTransit(db dbExecutor, locationId int) error {
+	var locationType string
+	err := db.QueryRow(`
+		SELECT location_type FROM locations WHERE location_id = $1;`, locationId).Scan(&locationType)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if locationType == locationInTransit {
+		return errors.New("Location " + strconv.Itoa(locationId) + " holds stock in transit. " +
+			"It is moved by receiving the transfer")
+	}
+
+	return nil
+}
+
+// Moves the lines from the source warehouse to the in-transit location.
+// The moves keep the cost layers of the stock
+func shipTransfer(transfer TransferJSON, db *sql.DB) (int, error) {
+	destinationId, _ := strconv.Atoi(transfer.DestinationWarehouseID)
+	if destinationId == 0 {
+		return 0, errors.New("Destination warehouse is required")
+	}
+	if len(transfer.Lines) == 0 {
+		return 0, errors.New("Transfer must have at least one line")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	sourceId := 0
+	for i, line := range transfer.Lines {
+		materialId, _ := strconv.Atoi(line.MaterialID)
+		var warehouseId int
+		err := tx.QueryRow(`
+			SELECT COALESCE(l.warehouse_id, 0) FROM materials m
+			LEFT JOIN locations l ON l.location_id = m.location_id
+			WHERE m.material_id = $1;`, materialId).Scan(&warehouseId)
+		if err == sql.ErrNoRows {
+			return 0, errors.New("Material " + line.MaterialID + " is not found")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			sourceId = warehouseId
+		}
+		if warehouseId != sourceId {
+			return 0, errors.New("All lines of a transfer must be shipped from the same warehouse")
+		}
+	}
+	if sourceId == 0 || sourceId == destinationId {
+		return 0, errors.New("Transfers are shipped from one warehouse to another")
+	}
+
+	var transferId int
+	err = tx.QueryRow(`
+		INSERT INTO transfers (source_warehouse_id, destination_warehouse_id, notes)
+		VALUES ($1,$2,$3)
+		RETURNING transfer_id;`,
+		sourceId, destinationId, transfer.Notes).Scan(&transferId)
+	if err != nil {
+		return 0, err
+	}
+
+	transitId, err := createTransitLocation(tx, transferId)
+	if err != nil {
+		return 0, err
+	}
+
+	notes := transfer.Notes
+	if notes == "" {
+		notes = "Transfer " + strconv.Itoa(transferId)
+	}
+
+	for _, line := range transfer.Lines {
+		quantity, _ := strconv.Atoi(line.Qty)
+		if quantity <= 0 {
+			return 0, errors.New("Quantity must be positive")
+		}
+
+		trxIds, err := moveStock(MaterialJSON{
+			MaterialID:    line.MaterialID,
+			LocationID:    strconv.Itoa(transitId),
+			Qty:           line.Qty,
+			Notes:         notes,
+			SerialNumbers: line.SerialNumbers,
+			Override:      transfer.Override,
+		}, tx)
+		if err != nil {
+			return 0, fmt.Errorf("Material %s: %w", line.MaterialID, err)
+		}
+
+		transitMaterialId, err := movedToMaterial(tx, trxIds)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO transfer_lines
+				(transfer_id, source_material_id, transit_material_id, stock_id, lot_number, shipped_quantity)
+			SELECT $1, m.material_id, $2, m.stock_id, m.lot_number, $3
+			FROM materials m WHERE m.material_id = $4;`,
+			transferId, transitMaterialId, quantity, line.MaterialID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return transferId, tx.Commit()
+}
+
+// The destination row of a move is the one its move-in entries are posted to
+func movedToMaterial(db dbExecutor, trxIds []int) (int, error) {
+	for _, transactionId := range trxIds {
+		entry, err := fetchLoggedTransaction(db, transactionId)
+		if err != nil {
+			return 0, err
+		}
+		if entry.trxType == trxMoveIn {
+			return entry.materialId, nil
+		}
+	}
+
+	return 0, errors.New("The destination of the move is not found")
+}
+
+// Moves the received quantities to the destination locations
+// and writes off what did not arrive
+func receiveTransfer(transferId int, receipt TransferReceiptJSON, db *sql.DB) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	transfer, err := fetchTransfer(tx, transferId)
+	if err != nil {
+		return nil, err
+	}
+	if transfer.Status != transferInTransit {
+		return nil, errors.New("Transfer " + strconv.Itoa(transferId) + " is already received")
+	}
+
+	received := make(map[int]TransferReceiptLineJSON)
+	for _, line := range receipt.Lines {
+		lineId, _ := strconv.Atoi(line.TransferLineID)
+		received[lineId] = line
+	}
+
+	notes := receipt.Notes
+	if notes == "" {
+		notes = "Transfer " + strconv.Itoa(transferId)
+	}
+
+	trxIds := []int{}
+	for _, line := range transfer.Lines {
+		receiptLine, ok := received[line.TransferLineID]
+		if !ok {
+			return nil, errors.New("Line " + strconv.Itoa(line.TransferLineID) + " is not received")
+		}
+		receivedQty, err := strconv.Atoi(receiptLine.ReceivedQty)
+		if err != nil || receivedQty < 0 || receivedQty > line.ShippedQty {
+			return nil, fmt.Errorf("Line %d: received quantity must be from 0 to %d",
+				line.TransferLineID, line.ShippedQty)
+		}
+
+		destinationMaterialId := 0
+		if receivedQty > 0 {
+			locationId, _ := strconv.Atoi(receiptLine.LocationID)
+			var warehouseId int
+			err := tx.QueryRow(`
+				SELECT COALESCE(warehouse_id, 0) FROM locations WHERE location_id = $1;`,
+				locationId).Scan(&warehouseId)
+			if err == sql.ErrNoRows || warehouseId != transfer.DestinationWarehouseID {
+				return nil, fmt.Errorf("Line %d: location %s is not in the destination warehouse",
+					line.TransferLineID, receiptLine.LocationID)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			ids, err := moveStock(MaterialJSON{
+				MaterialID:    strconv.Itoa(line.TransitMaterialID),
+				LocationID:    receiptLine.LocationID,
+				Qty:           strconv.Itoa(receivedQty),
+				Notes:         notes,
+				SerialNumbers: receiptLine.SerialNumbers,
+				Override:      true,
+			}, tx)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %w", line.TransferLineID, err)
+			}
+			destinationMaterialId, err = movedToMaterial(tx, ids)
+			if err != nil {
+				return nil, err
+			}
+			trxIds = append(trxIds, ids...)
+		}
+
+		reasonCode := ""
+		if missing := line.ShippedQty - receivedQty; missing > 0 {
+			reasonCode = receiptLine.ReasonCode
+			if reasonCode == "" {
+				reasonCode = reasonTransitLoss
+			}
+			ids, err := postAdjustment(AdjustmentJSON{
+				MaterialID:    strconv.Itoa(line.TransitMaterialID),
+				Qty:           strconv.Itoa(missing),
+				ReasonCode:    reasonCode,
+				Notes:         notes,
+				SerialNumbers: receiptLine.MissingSerialNumbers,
+			}, tx)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %w", line.TransferLineID, err)
+			}
+			trxIds = append(trxIds, ids...)
+		}
+
+		_, err = tx.Exec(`
+			UPDATE transfer_lines
+			SET received_quantity = $1, destination_material_id = $2, reason_code = NULLIF($3, '')
+			WHERE transfer_line_id = $4;`,
+			receivedQty,
+			sql.NullInt64{Int64: int64(destinationMaterialId), Valid: destinationMaterialId != 0},
+			reasonCode, line.TransferLineID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE transfers SET status = 'received', received_at = NOW() WHERE transfer_id = $1;`,
+		transferId)
+	if err != nil {
+		return nil, err
+	}
+
+	return trxIds, tx.Commit()
+}
+
+func fetchTransfers(db *sql.DB, status string) ([]TransferDB, error) {
+	return queryTransfers(db, 0, status)
+}
+
+func fetchTransfer(db dbExecutor, transferId int) (TransferDB, error) {
+	transfers, err := queryTransfers(db, transferId, "")
+	if err != nil {
+		return TransferDB{}, err
+	}
+	if len(transfers) == 0 {
+		return TransferDB{}, errors.New("Transfer " + strconv.Itoa(transferId) + " is not found")
+	}
+
+	return transfers[0], nil
+}
+
+func queryTransfers(db dbExecutor, transferId int, status string) ([]TransferDB, error) {
+	rows, err := db.Query(`
+		SELECT t.transfer_id, t.source_warehouse_id, COALESCE(sw.name, ''),
+			t.destination_warehouse_id, COALESCE(dw.name, ''), t.status,
+			COALESCE(t.notes, ''), t.shipped_at,
+			COALESCE(TO_CHAR(t.received_at, 'YYYY-MM-DD HH24:MI'), '')
+		FROM transfers t
+		LEFT JOIN warehouses sw ON sw.warehouse_id = t.source_warehouse_id
+		LEFT JOIN warehouses dw ON dw.warehouse_id = t.destination_warehouse_id
+		WHERE
+			($1 = 0 OR t.transfer_id = $1) AND
+			($2 = '' OR t.status::TEXT = $2)
+		ORDER BY t.transfer_id;`, transferId, status)
+	if err != nil {
+		log.Println("Error queryTransfers1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []TransferDB{}
+	for rows.Next() {
+		var transfer TransferDB
+		if err := rows.Scan(
+			&transfer.TransferID,
+			&transfer.SourceWarehouseID,
+			&transfer.SourceWarehouseName,
+			&transfer.DestinationWarehouseID,
+			&transfer.DestinationWarehouseName,
+			&transfer.Status,
+			&transfer.Notes,
+			&transfer.ShippedAt,
+			&transfer.ReceivedAt,
+		); err != nil {
+			log.Println("Error queryTransfers2: ", err)
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range transfers {
+		lines, err := fetchTransferLines(db, transfers[i].TransferID)
+		if err != nil {
+			return nil, err
+		}
+		transfers[i].Lines = lines
+	}
+
+	return transfers, nil
+}
+
+func fetchTransferLines(db dbExecutor, transferId int) ([]TransferLineDB, error) {
+	rows, err := db.Query(`
+		SELECT transfer_line_id, source_material_id, transit_material_id,
+			COALESCE(destination_material_id, 0), stock_id, lot_number,
+			shipped_quantity, received_quantity, COALESCE(reason_code, '')
+		FROM transfer_lines
+		WHERE transfer_id = $1
+		ORDER BY transfer_line_id;`, transferId)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying transfer lines: %w", err)
+	}
+	defer rows.Close()
+
+	lines := []TransferLineDB{}
+	for rows.Next() {
+		var line TransferLineDB
+		var receivedQty sql.NullInt64
+		if err := rows.Scan(
+			&line.TransferLineID,
+			&line.SourceMaterialID,
+			&line.TransitMaterialID,
+			&line.DestinationMaterialID,
+			&line.StockID,
+			&line.LotNumber,
+			&line.ShippedQty,
+			&receivedQty,
+			&line.ReasonCode,
+		); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %w", err)
+		}
+
+		if receivedQty.Valid {
+			received := int(receivedQty.Int64)
+			discrepancy := received - line.ShippedQty
+			line.ReceivedQty = &received
+			line.DiscrepancyQty = &discrepancy
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// Lines of the transfers not received yet, valued at the cost of the stock
+// in the transit row of their transfer
+func fetchInTransitReport(db *sql.DB) ([]InTransitRep, error) {
+	rows, err := db.Query(`
+		SELECT t.transfer_id, COALESCE(sw.name, ''), COALESCE(dw.name, ''),
+			tl.stock_id, tl.lot_number, tl.shipped_quantity,
+			tl.shipped_quantity * COALESCE((
+				SELECT SUM(l.remaining_quantity * l.cost) / NULLIF(SUM(l.remaining_quantity), 0)
+				FROM transactions_log l
+				WHERE l.material_id = tl.transit_material_id AND l.quantity_change > 0
+					AND l.layer_id IS NULL AND l.remaining_quantity > 0
+			), m.cost),
+			t.shipped_at
+		FROM transfer_lines tl
+		LEFT JOIN transfers t ON t.transfer_id = tl.transfer_id
+		LEFT JOIN materials m ON m.material_id = tl.transit_material_id
+		LEFT JOIN warehouses sw ON sw.warehouse_id = t.source_warehouse_id
+		LEFT JOIN warehouses dw ON dw.warehouse_id = t.destination_warehouse_id
+		WHERE t.status = 'in_transit'
+		ORDER BY t.shipped_at, t.transfer_id, tl.transfer_line_id;`)
+	if err != nil {
+		log.Println("Error fetchInTransitReport1: ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []InTransitRep{}
+	for rows.Next() {
+		var rep InTransitRep
+		var value float64
+		var shippedAt time.Time
+		if err := rows.Scan(
+			&rep.TransferID,
+			&rep.SourceWarehouseName,
+			&rep.DestinationWarehouseName,
+			&rep.StockID,
+			&rep.LotNumber,
+			&rep.Qty,
+			&value,
+			&shippedAt,
+		); err != nil {
+			log.Println("Error fetchInTransitReport2: ", err)
+			return nil, err
+		}
+		rep.Value = accLib.FormatMoney(value)
+		rep.ShippedAt = shippedAt.Format("2006-01-02 15:04")
+		rep.DaysInTransit = int(time.Since(shippedAt).Hours() / 24)
+		report = append(report, rep)
+	}
+
+	return report, rows.Err()
+}
@@ -2,21 +2,38 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"strconv"
 )
 
 type WarehouseJSON struct {
 	WarehouseName string `json:"warehouseName"`
 	LocationName  string `json:"locationName"`
+	Zone          string `json:"zone"`
+	LocationType  string `json:"locationType"`
+	StorageRule   string `json:"storageRule"`
+	PickSequence  string `json:"pickSequence"`
+	Capacity      string `json:"capacity"`
+	CapacityType  string `json:"capacityType"`
+	Enforcement   string `json:"capacityEnforcement"`
+}
+
+type CustomerWarehouseJSON struct {
+	CustomerID  string `json:"customerId"`
+	WarehouseID string `json:"warehouseId"`
+	Priority    string `json:"priority"`
 }
 
 type WarehouseDB struct {
-	WarehouseID   int    `field:"warehouse_id"`
-	WarehouseName string `field:"name"`
+	WarehouseID   int          `field:"warehouse_id"`
+	WarehouseName string       `field:"name"`
+	IsActive      bool         `field:"is_active"`
+	Locations     []LocationDB `json:",omitempty"`
 }
 
-func fetchWarehouses(db *sql.DB) ([]WarehouseDB, error) {
-	rows, err := db.Query("SELECT * FROM warehouses;")
+func fetchWarehouses(db dbExecutor) ([]WarehouseDB, error) {
+	rows, err := db.Query("SELECT warehouse_id, name, is_active FROM warehouses ORDER BY name;")
 	if err != nil {
 		log.Println("Error fetchWarehouses1: ", err)
 		return nil, err
@@ -27,7 +44,7 @@ func fetchWarehouses(db *sql.DB) ([]WarehouseDB, error) {
 
 	for rows.Next() {
 		var warehouse WarehouseDB
-		if err := rows.Scan(&warehouse.WarehouseID, &warehouse.WarehouseName); err != nil {
+		if err := rows.Scan(&warehouse.WarehouseID, &warehouse.WarehouseName, &warehouse.IsActive); err != nil {
 			log.Println("Error fetchWarehouses2: ", err)
 			return warehouses, err
 		}
@@ -67,8 +84,162 @@ func createWarehouse(warehouse WarehouseJSON, db *sql.DB) error {
 		warehouseId = id
 	}
 
-	_, err = db.Exec("INSERT INTO locations(name, warehouse_id) VALUES ($1,$2);",
-		warehouse.LocationName, warehouseId)
+	pickSequence, _ := strconv.Atoi(warehouse.PickSequence)
+	capacity, _ := strconv.ParseFloat(warehouse.Capacity, 64)
+	if warehouse.CapacityType == "" {
+		warehouse.CapacityType = capacityUnits
+	}
+	if warehouse.Enforcement == "" {
+		warehouse.Enforcement = enforceReject
+	}
+	if err := validateCapacity(warehouse.CapacityType, warehouse.Enforcement); err != nil {
+		return err
+	}
+	if warehouse.StorageRule == "" {
+		warehouse.StorageRule = storageMixed
+	}
+	if err := validateStorageRule(warehouse.StorageRule); err != nil {
+		return err
+	}
+	if warehouse.LocationType == "" {
+		warehouse.LocationType = locationStorage
+	}
+	if err := validateLocationType(warehouse.LocationType); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO locations(name, warehouse_id, location_type, storage_rule, zone, pick_sequence,
+			capacity, capacity_type, capacity_enforcement)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9);`,
+		warehouse.LocationName, warehouseId, warehouse.LocationType, warehouse.StorageRule,
+		sql.NullString{String: warehouse.Zone, Valid: warehouse.Zone != ""},
+		pickSequence,
+		sql.NullFloat64{Float64: capacity, Valid: capacity > 0},
+		warehouse.CapacityType, warehouse.Enforcement,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func fetchWarehouse(db dbExecutor, warehouseId int) (WarehouseDB, error) {
+	var warehouse WarehouseDB
+	err := db.QueryRow(`
+		SELECT warehouse_id, name, is_active FROM warehouses WHERE warehouse_id = $1;`,
+		warehouseId).Scan(&warehouse.WarehouseID, &warehouse.WarehouseName, &warehouse.IsActive)
+	if err == sql.ErrNoRows {
+		return warehouse, errors.New("Warehouse " + strconv.Itoa(warehouseId) + " is not found")
+	}
+	if err != nil {
+		return warehouse, err
+	}
+
+	warehouse.Locations, err = fetchLocations(db, LocationTreeFilter{warehouseId: warehouseId})
+	return warehouse, err
+}
+
+func updateWarehouse(warehouseId int, warehouse WarehouseJSON, db *sql.DB) error {
+	if warehouse.WarehouseName == "" {
+		return errors.New("Warehouse name is required")
+	}
+
+	res, err := db.Exec(`
+		UPDATE warehouses SET name = $1 WHERE warehouse_id = $2;`,
+		warehouse.WarehouseName, warehouseId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Warehouse " + strconv.Itoa(warehouseId) + " is not found")
+	}
+
+	return nil
+}
+
+// Nothing is put in the locations of an inactive warehouse
+func setWarehouseActive(warehouseId int, isActive bool, db *sql.DB) error {
+	res, err := db.Exec(`
+		UPDATE warehouses SET is_active = $1 WHERE warehouse_id = $2;`,
+		isActive, warehouseId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Warehouse " + strconv.Itoa(warehouseId) + " is not found")
+	}
+
+	return nil
+}
+
+// Deletes the warehouse with its locations and customer preferences.
+// Warehouses holding stock or referenced by history are deactivated instead
+func deleteWarehouse(warehouseId int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hasStock, hasHistory bool
+	err = tx.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM materials m
+				LEFT JOIN locations l ON l.location_id = m.location_id
+				WHERE l.warehouse_id = $1 AND m.quantity > 0),
+			EXISTS (SELECT 1 FROM materials m
+				LEFT JOIN locations l ON l.location_id = m.location_id
+				WHERE l.warehouse_id = $1) OR
+			EXISTS (SELECT 1 FROM inventory_events WHERE warehouse_id = $1) OR
+			EXISTS (SELECT 1 FROM transfers
+				WHERE source_warehouse_id = $1 OR destination_warehouse_id = $1);`,
+		warehouseId).Scan(&hasStock, &hasHistory)
+	if err != nil {
+		return err
+	}
+	if hasStock {
+		return errors.New("Warehouse " + strconv.Itoa(warehouseId) + " holds stock")
+	}
+	if hasHistory {
+		return errors.New("Warehouse " + strconv.Itoa(warehouseId) +
+			" is referenced by transaction history. Deactivate it instead")
+	}
+
+	for _, query := range []string{
+		`DELETE FROM customer_warehouses WHERE warehouse_id = $1;`,
+		`DELETE FROM locations WHERE warehouse_id = $1;`,
+	} {
+		if _, err := tx.Exec(query, warehouseId); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec(`DELETE FROM warehouses WHERE warehouse_id = $1;`, warehouseId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Warehouse " + strconv.Itoa(warehouseId) + " is not found")
+	}
+
+	return tx.Commit()
+}
+
+// Warehouses a customer prefers to store its materials in.
+// Priority 1 is the most preferred one
+func setCustomerWarehouse(pref CustomerWarehouseJSON, db *sql.DB) error {
+	priority, _ := strconv.Atoi(pref.Priority)
+	if priority < 1 {
+		priority = 1
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO customer_warehouses (customer_id, warehouse_id, priority)
+		VALUES ($1,$2,$3)
+		ON CONFLICT (customer_id, warehouse_id) DO UPDATE SET priority = $3;`,
+		pref.CustomerID, pref.WarehouseID, priority)
 	if err != nil {
 		return err
 	}